@@ -14,7 +14,7 @@ type ChunkList struct {
 
 // GetChunk returns the i-th chunk, sorted by the first key.
 func (list *ChunkList) GetChunk(chunkPosition int) *Node {
-	if chunkPosition < len(list.chunks) {
+	if chunkPosition >= 0 && chunkPosition < len(list.chunks) {
 		return list.chunks[chunkPosition]
 	}
 	return nil
@@ -45,7 +45,7 @@ func (list *ChunkList) insertAt(index int, leaf *Node) {
 }
 
 func (list *ChunkList) append(leaf *Node) {
-	indx := list.getInsertionIndex(leaf.chunk.GetSmallestKey())
+	indx := list.getInsertionIndex(leaf.getSmallestKey())
 	list.appendAt(indx, leaf)
 }
 
@@ -70,20 +70,28 @@ func (list *ChunkList) addChunk(leftMostChunkKey []byte, leaf *Node) {
 	}
 }
 
+// remove removes the leaf from the list. The chunk of the leaf must still contain its smallest key.
+func (list *ChunkList) remove(leaf *Node) {
+	index := list.getInsertionIndex(leaf.getSmallestKey()) - 1
+	if index >= 0 && list.chunks[index] == leaf {
+		list.chunks = append(list.chunks[:index], list.chunks[index+1:]...)
+	}
+}
+
 func (list *ChunkList) getInsertionIndex(leftMostChunkKey []byte) int {
 	l, r := 0, len(list.chunks)
 	var compared int
 
 	for l < r {
 		if l == r-1 {
-			compared = bytes.Compare(leftMostChunkKey, list.chunks[l].chunk.GetSmallestKey())
+			compared = bytes.Compare(leftMostChunkKey, list.chunks[l].getSmallestKey())
 			if compared == 0 || compared == 1 {
 				return l + 1
 			}
 			return l
 		}
 		m := (l + r) / 2
-		compared = bytes.Compare(leftMostChunkKey, list.chunks[m].chunk.GetSmallestKey())
+		compared = bytes.Compare(leftMostChunkKey, list.chunks[m].getSmallestKey())
 
 		if compared == 1 {
 			l = m
@@ -2,19 +2,33 @@ package bplusavl
 
 import (
 	hchunk "bplus/chunk"
+	"bytes"
+	"hash/crc32"
 	"io"
 
 	"github.com/pkg/errors"
 	"github.com/tendermint/go-amino"
 )
 
-func (node *Node) Serialize(buffer io.Writer) error {
+// checksumTable is used to compute the optional trailing checksum of serialized leaves.
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksumSize is the number of bytes of the trailing checksum of a serialized leaf.
+const checksumSize = 4
+
+// Serialize serializes the leaf (metadata and chunk) into a buffer.
+// ErrNotLeaf is returned if the node is not a leaf.
+func (node *Node) Serialize(buffer io.Writer) (err error) {
 	if !node.isLeaf() {
-		panic("Trying to serialize a non-leaf node")
+		return ErrNotLeaf
+	}
+	chunk, err := node.getChunk()
+	if err != nil {
+		return err
 	}
 
 	// serialize all METADATA
-	err := amino.EncodeUint32(buffer, node.leafID) // Leaf ID
+	err = amino.EncodeUint32(buffer, node.leafID) // Leaf ID
 	if err != nil {
 		return errors.Wrap(err, "while encoding leaf-id")
 	}
@@ -23,7 +37,7 @@ func (node *Node) Serialize(buffer io.Writer) error {
 		return errors.Wrap(err, "while encoding key Height")
 	}
 
-	err = node.chunk.Serialize(buffer)
+	err = chunk.Serialize(buffer)
 	if err != nil {
 		return err
 	}
@@ -31,13 +45,38 @@ func (node *Node) Serialize(buffer io.Writer) error {
 
 }
 
+// SerializeWithChecksum works like Node.Serialize but appends a CRC-32 checksum of the serialized leaf,
+// so that corrupted data (eg. disk bit-rot) can be detected by Deserialize.
+func (node *Node) SerializeWithChecksum(buffer io.Writer) error {
+	var leafBuffer bytes.Buffer
+	err := node.Serialize(&leafBuffer)
+	if err != nil {
+		return err
+	}
+	_, err = buffer.Write(leafBuffer.Bytes())
+	if err != nil {
+		return errors.Wrap(err, "while writing leaf")
+	}
+	err = amino.EncodeUint32(buffer, crc32.Checksum(leafBuffer.Bytes(), checksumTable))
+	if err != nil {
+		return errors.Wrap(err, "while encoding checksum")
+	}
+	return nil
+}
+
+// Deserialize rebuilds a leaf from a buffer produced by Node.Serialize or Node.SerializeWithChecksum.
+// If the buffer contains a trailing checksum, it is verified and ErrChecksumMismatch is returned on failure.
+// Any other trailing bytes are rejected.
 func Deserialize(buffer []byte, maxSize int32) (*Node, error) {
+	serialized := buffer
+	n := 0
 
 	leafID, j, err := amino.DecodeUint32(buffer)
 	if err != nil {
 		return nil, err
 	}
 	buffer = buffer[j:]
+	n += j
 
 	var keyHeight uint8
 	keyHeight, j, err = amino.DecodeUint8(buffer)
@@ -45,14 +84,33 @@ func Deserialize(buffer []byte, maxSize int32) (*Node, error) {
 		return nil, err
 	}
 	buffer = buffer[j:]
+	n += j
 
 	var chunk *hchunk.HeapChunk
-	chunk, err = hchunk.Deserialize(buffer, maxSize)
+	chunk, j, err = hchunk.DeserializeWithLength(buffer, maxSize)
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrapf(err, "while decoding chunk of leaf %d", leafID)
+	}
+	buffer = buffer[j:]
+	n += j
+
+	// an optional checksum follows the chunk
+	if len(buffer) > 0 {
+		if len(buffer) != checksumSize {
+			return nil, errors.Errorf("%d unexpected trailing bytes after leaf %d", len(buffer), leafID)
+		}
+		var checksum uint32
+		checksum, _, err = amino.DecodeUint32(buffer)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while decoding checksum of leaf %d", leafID)
+		}
+		if checksum != crc32.Checksum(serialized[:n], checksumTable) {
+			return nil, errors.Wrapf(ErrChecksumMismatch, "leaf %d", leafID)
+		}
 	}
 
 	leaf := &Node{
+		size:      chunk.GetCurrSize(),
 		chunk:     chunk,
 		leafID:    leafID,
 		keyHeight: keyHeight,
@@ -62,3 +120,17 @@ func Deserialize(buffer []byte, maxSize int32) (*Node, error) {
 
 	return leaf, nil
 }
+
+// DeserializeAndVerify deserializes a leaf and checks that its hash matches expectedLeafHash.
+// It should be used for leaves coming from disk or from the network before they are passed to RebuildTree.
+// The returned error reports the leafID of the leaf that failed the verification.
+func DeserializeAndVerify(buffer []byte, maxSize int32, expectedLeafHash []byte) (*Node, error) {
+	leaf, err := Deserialize(buffer, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(leaf.hash, expectedLeafHash) {
+		return nil, errors.Wrapf(ErrLeafHashMismatch, "leaf %d", leaf.leafID)
+	}
+	return leaf, nil
+}
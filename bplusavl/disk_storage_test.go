@@ -4,10 +4,12 @@ import (
 	helperfunctions "bplus/helper_functions"
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"math/rand"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -47,3 +49,58 @@ func TestHeapChunk_Serialize(t *testing.T) {
 	assert.True(bytes.Equal(deserializedLeaf.chunk.GetHash(), chunkToCompare.chunk.GetHash()))
 	assert.True(bytes.Equal(deserializedLeaf.GetLeafHash(), tree.GetChunk(chunkToTake).GetLeafHash()))
 }
+
+func TestDeserializeAndVerify(t *testing.T) {
+	assert := assert.New(t)
+
+	size := 2000
+	tree := NewIAVL(64, 4)
+	x := rand.Perm(size)
+	for _, elem := range x {
+		num := make([]byte, 4)
+		binary.LittleEndian.PutUint32(num, uint32(elem))
+		tree.Set(num, helperfunctions.GetRandomString(32))
+	}
+
+	chunkToTake := 3
+	leaf := tree.GetChunk(chunkToTake)
+
+	var buffer bytes.Buffer
+	err := tree.SerializeLeafChunkWithChecksum(chunkToTake, &buffer)
+	assert.Nil(err)
+
+	// a valid leaf with a valid checksum
+	deserializedLeaf, err := DeserializeAndVerify(buffer.Bytes(), 64, leaf.GetLeafHash())
+	assert.Nil(err)
+	assert.Equal(leaf.leafID, deserializedLeaf.leafID)
+	assert.True(bytes.Equal(leaf.GetLeafHash(), deserializedLeaf.GetLeafHash()))
+
+	// a valid leaf checked against a wrong hash
+	_, err = DeserializeAndVerify(buffer.Bytes(), 64, tree.GetChunk(chunkToTake+1).GetLeafHash())
+	assert.True(errors.Is(err, ErrLeafHashMismatch))
+	assert.Contains(err.Error(), fmt.Sprintf("leaf %d", leaf.leafID))
+
+	// flip a bit in the last value: the checksum must catch it
+	corrupted := make([]byte, buffer.Len())
+	copy(corrupted, buffer.Bytes())
+	corrupted[len(corrupted)-6] ^= 0x01
+	_, err = DeserializeAndVerify(corrupted, 64, leaf.GetLeafHash())
+	assert.True(errors.Is(err, ErrChecksumMismatch))
+
+	// leaves without a checksum are still accepted
+	var plainBuffer bytes.Buffer
+	err = tree.SerializeLeafChunk(chunkToTake, &plainBuffer)
+	assert.Nil(err)
+	_, err = DeserializeAndVerify(plainBuffer.Bytes(), 64, leaf.GetLeafHash())
+	assert.Nil(err)
+
+	// trailing bytes are only accepted as a checksum
+	for _, trailing := range [][]byte{{0}, {0, 0, 0}, {0, 0, 0, 0, 0}} {
+		_, err = Deserialize(append(plainBuffer.Bytes(), trailing...), 64)
+		assert.ErrorContains(err, "unexpected trailing bytes")
+	}
+	_, err = Deserialize(append(plainBuffer.Bytes(), 0, 0, 0, 0), 64)
+	assert.True(errors.Is(err, ErrChecksumMismatch))
+	_, err = Deserialize(append(buffer.Bytes(), 0), 64)
+	assert.ErrorContains(err, "unexpected trailing bytes")
+}
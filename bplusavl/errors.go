@@ -0,0 +1,41 @@
+package bplusavl
+
+import (
+	hchunk "bplus/chunk"
+
+	"github.com/pkg/errors"
+)
+
+// Errors returned by the tree. Functions may wrap them with more context: use errors.Is or errors.Cause to test them.
+// Invalid inputs never cause a panic.
+var (
+	// ErrNilValue is returned when setting a nil value. Use an empty slice to store an empty value.
+	ErrNilValue = errors.New("nil value")
+	// ErrNotLeaf is returned when a leaf operation is called on an inner node.
+	ErrNotLeaf = errors.New("not a leaf")
+	// ErrIndexOutOfRange is returned when a chunk position or a key index is out of range.
+	ErrIndexOutOfRange = errors.New("index out of range")
+	// ErrInvalidParameters is returned when writing a tree whose chunk size or key size is invalid
+	// (eg. an odd chunk size, a tree rebuilt from an empty list, or a canonical tree with keys longer than 31 bytes).
+	ErrInvalidParameters = errors.New("invalid chunk size or key size")
+	// ErrInvalidTree is returned when a list of leaves does not describe a valid tree.
+	ErrInvalidTree = errors.New("invalid tree")
+
+	// ErrInvalidKeySize is returned when a key does not have the key size of the tree.
+	ErrInvalidKeySize = hchunk.ErrInvalidKeySize
+	// ErrValueTooLarge is returned when a value is too large to be stored in a chunk.
+	ErrValueTooLarge = hchunk.ErrValueTooLarge
+	// ErrCapacityExceeded is returned when the values of a chunk would exceed its maximal capacity.
+	ErrCapacityExceeded = hchunk.ErrCapacityExceeded
+	// ErrReadOnly is returned when modifying a tree opened from a memory-mapped snapshot.
+	ErrReadOnly = hchunk.ErrReadOnly
+
+	// ErrChecksumMismatch is returned when the trailing checksum of a serialized leaf does not match its content.
+	ErrChecksumMismatch = errors.New("leaf checksum mismatch")
+	// ErrLeafHashMismatch is returned when a deserialized leaf does not hash to the expected value.
+	ErrLeafHashMismatch = errors.New("leaf hash mismatch")
+	// ErrRootHashMismatch is returned when a tree rebuilt from a snapshot does not match the root hash in the snapshot.
+	ErrRootHashMismatch = errors.New("root hash mismatch")
+	// ErrInvalidProof is returned when a proof does not prove the position or the key range of a chunk.
+	ErrInvalidProof = errors.New("invalid proof")
+)
@@ -3,8 +3,10 @@ package bplusavl
 import (
 	hchunk "bplus/chunk"
 	"bytes"
-	"fmt"
+	"crypto/sha256"
 	"io"
+
+	"github.com/pkg/errors"
 )
 
 /*
@@ -42,11 +44,49 @@ type IAVL struct {
 	keySize           int32
 	maxChunkCapacity  int32
 	maxChunkValueSize int32
+
+	splitPolicy hchunk.SplitPolicy
+	chunkBytes  int32 // if positive, chunks are split by serialized size instead of number of keys
+
+	redistribution bool // if set, full leaves move K-V pairs to their neighbours before splitting
+
+	dirtyLeaves   map[uint32]*Node // leaves modified or created since the last commit
+	removedLeaves map[uint32]bool  // IDs of the leaves removed since the last commit
+
+	cache *leafCache // if set, leaves are evicted to a leaf store and loaded on access
+
+	canonical bool // if set, the shape of the tree only depends on its K-V pairs (see WithCanonicalShape)
 }
 
-func NewIAVL(chunkSize, keySize int32) *IAVL {
+// TreeOption configures a tree created by NewIAVL.
+type TreeOption func(tree *IAVL)
+
+// WithSplitPolicy sets the policy used to split full chunks (by default hchunk.SplitMidpoint).
+func WithSplitPolicy(policy hchunk.SplitPolicy) TreeOption {
+	return func(tree *IAVL) {
+		tree.splitPolicy = policy
+	}
+}
+
+// WithChunkBytes makes chunks split when their serialized size would exceed targetBytes, so that chunks
+// have about the same size in bytes regardless of the size of the values. The chunk size given to NewIAVL
+// is replaced by a number of keys that is never reached before the target (see hchunk.MaxKeysForTargetBytes),
+// and full chunks are split by hchunk.SplitBySize unless WithSplitPolicy is given after this option.
+// A chunk with a single K-V pair can exceed the target. The target is kept by snapshots (see IAVL.ExportSnapshot).
+func WithChunkBytes(targetBytes int32) TreeOption {
+	return func(tree *IAVL) {
+		if targetBytes <= 0 {
+			return
+		}
+		tree.chunkBytes = targetBytes
+		tree.chunkSize = hchunk.MaxKeysForTargetBytes(tree.maxChunkCapacity, tree.maxChunkValueSize, tree.keySize, targetBytes)
+		tree.splitPolicy = hchunk.SplitBySize
+	}
+}
 
-	return &IAVL{
+func NewIAVL(chunkSize, keySize int32, options ...TreeOption) *IAVL {
+
+	tree := &IAVL{
 		nil,
 		0, // TODO put in the arguments
 		chunkSize,
@@ -56,22 +96,74 @@ func NewIAVL(chunkSize, keySize int32) *IAVL {
 		keySize,
 		int32(16777216), // around 16 MB total chunk size
 		int32(65536),    // around 65 kB single value limit
+		hchunk.SplitMidpoint,
+		0,
+		false,
+		make(map[uint32]*Node),
+		make(map[uint32]bool),
+		nil,
+		false,
 	}
+	for _, option := range options {
+		option(tree)
+	}
+	return tree
 }
 
 // isFull returns true if the tree has reached its maximal capacity.
 func (tree *IAVL) isFull() bool {
+	if tree.root == nil {
+		return false
+	}
 	return tree.root.size >= tree.maxSize
 }
 
-// Get returns the values associated with the given key.
-// Careful: the returned values is NOT a copy. Modifying it, causes side effects.
+// Get returns a copy of the value associated with the given key, or nil if the key is not found.
 func (tree *IAVL) Get(key []byte) []byte {
-	return tree.root.get(key)
+	return copyBytes(tree.GetUnsafe(key))
+}
+
+// GetUnsafe returns the value associated with the given key without copying it.
+// Careful: the returned value is NOT a copy. Modifying it causes side effects, and later
+// modifications of the tree may change it. Use IAVL.Get or IAVL.ViewValue instead, unless the copy matters.
+func (tree *IAVL) GetUnsafe(key []byte) []byte {
+	if tree.root == nil {
+		return nil
+	}
+	// a leaf that cannot be loaded is reported by IAVL.Err
+	value, _ := tree.root.get(key)
+	return value
+}
+
+// ViewValue calls fn with the value associated with the given key, without copying it.
+// The value must not be modified nor retained after fn returns.
+// It returns false, without calling fn, if the key is not found.
+func (tree *IAVL) ViewValue(key []byte, fn func(value []byte)) bool {
+	value := tree.GetUnsafe(key)
+	if value == nil {
+		return false
+	}
+	fn(value)
+	return true
+}
+
+// copyBytes returns a copy of b, or nil if b is nil.
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	bCopy := make([]byte, len(b))
+
+	copy(bCopy, b)
+	return bCopy
 }
 
 // GetRootHash returns a copy of the hash value found in the root of the tree.
+// The root hash of an empty tree is EmptyRootHash.
 func (tree *IAVL) GetRootHash() []byte {
+	if tree.root == nil {
+		return EmptyRootHash()
+	}
 	rootHash := tree.root.hash
 	rootHashCopy := make([]byte, len(rootHash))
 
@@ -79,6 +171,11 @@ func (tree *IAVL) GetRootHash() []byte {
 	return rootHashCopy
 }
 
+// GetKeySize returns the size in bytes of the keys stored in the tree.
+func (tree *IAVL) GetKeySize() int32 {
+	return tree.keySize
+}
+
 func (tree *IAVL) GetNumberOfChunks() int {
 	return tree.chunkList.GetNumberOfChunks()
 }
@@ -90,126 +187,285 @@ func (tree *IAVL) GetChunk(i int) *Node {
 // CorruptData negates the bits of the first byte in the data, so create an invalid chunk.
 // Used for testing only.
 func (tree *IAVL) CurruptChunkData(i int) {
-	tree.chunkList.GetChunk(i).chunk.CorruptData(0) // TODO check if 0 is ok
+	if chunk, err := tree.chunkList.GetChunk(i).getChunk(); err == nil {
+		chunk.CorruptData(0) // TODO check if 0 is ok
+	}
 }
 
 // SerializeChunk serializes the chunk structure (heap_chunk_improved) within a leaf.
 // It does not serialize the whole leaf. Use IAVL.SerializeLeafChunk instead.
 func (tree *IAVL) SerializeChunk(i int, buffer io.Writer) error {
-	return tree.chunkList.GetChunk(i).chunk.Serialize(buffer)
+	leaf, err := tree.getLeafAt(i)
+	if err != nil {
+		return err
+	}
+	chunk, err := leaf.getChunk()
+	if err != nil {
+		return err
+	}
+	return chunk.Serialize(buffer)
 }
 
 // SerializeLeafChunk serializes the whole i-th leaf containing the chunk and metadata.
 func (tree *IAVL) SerializeLeafChunk(i int, buffer io.Writer) error {
-	return tree.chunkList.GetChunk(i).Serialize(buffer)
+	leaf, err := tree.getLeafAt(i)
+	if err != nil {
+		return err
+	}
+	return leaf.Serialize(buffer)
+}
+
+// SerializeLeafChunkWithChecksum works like IAVL.SerializeLeafChunk but appends a checksum to the leaf.
+func (tree *IAVL) SerializeLeafChunkWithChecksum(i int, buffer io.Writer) error {
+	leaf, err := tree.getLeafAt(i)
+	if err != nil {
+		return err
+	}
+	return leaf.SerializeWithChecksum(buffer)
+}
+
+// getLeafAt returns the i-th leaf, sorted by the smallest key, or ErrIndexOutOfRange.
+func (tree *IAVL) getLeafAt(i int) (*Node, error) {
+	leaf := tree.chunkList.GetChunk(i)
+	if leaf == nil {
+		return nil, errors.Wrapf(ErrIndexOutOfRange, "chunk %d of %d", i, tree.GetNumberOfChunks())
+	}
+	return leaf, nil
 }
 
 func (tree *IAVL) CompleteRehash() {
+	if tree.root == nil {
+		return
+	}
 	tree.root.completeReHash()
 }
 
-// Set sets a key in the working tree.Nil values are invalid.The given
-// key/value byte slices must not be modified after this call, since they point
-// to slices stored within IAVL. It returns true when an existing value was
-// updated, while false means it was a new key.
-func (tree *IAVL) Set(key, value []byte) (updated bool) {
-	updated = tree.set(key, value)
+// Set sets a key in the working tree. Nil values are invalid. The given
+// key/value byte slices are copied into the tree, so the caller is free to modify
+// them after this call. It returns true when an existing value was
+// updated, while false means it was a new key, including the first key of an empty tree.
+// An error is returned, and the tree is left unchanged, if the value is nil, the key does not have
+// the key size of the tree, the value cannot be stored in a chunk or the tree is read-only (see OpenMappedSnapshot).
+// Trees whose chunk size is odd or smaller than 2, and canonical trees with keys longer than 31 bytes
+// (see WithCanonicalShape), return ErrInvalidParameters.
+func (tree *IAVL) Set(key, value []byte) (updated bool, err error) {
+	tree.cache.hold()
+	defer tree.cache.release()
+	updated, err = tree.set(key, value)
+	if err != nil {
+		return false, err
+	}
 	// FIXME uncomment to have hashes
 	tree.recursiveHash()
-	return updated
+	return updated, nil
 }
 
-func (tree *IAVL) set(key []byte, value []byte) bool {
+// validParameters returns true if the chunk size and the key size can be used to build chunks:
+// the heap of hashes of a chunk requires an even chunk size. The keys of a canonical tree are limited
+// to maxCanonicalKeySize bytes.
+func (tree *IAVL) validParameters() bool {
+	return tree.chunkSize >= 2 && tree.chunkSize%2 == 0 && tree.keySize >= 1 &&
+		(!tree.canonical || tree.keySize <= maxCanonicalKeySize)
+}
+
+func (tree *IAVL) set(key []byte, value []byte) (updated bool, err error) {
 	if value == nil {
-		panic(fmt.Sprintf("Attempt to store nil value at key '%s'", key))
+		return false, errors.Wrapf(ErrNilValue, "at key %x", key)
+	}
+	if !tree.validParameters() {
+		return false, ErrInvalidParameters
+	}
+	if int32(len(key)) != tree.keySize {
+		return false, errors.Wrapf(ErrInvalidKeySize, "key %x of %d bytes, expected %d", key, len(key), tree.keySize)
+	}
+	if tree.canonical {
+		return tree.canonicalUpdate(key, value)
 	}
-	updated := true
 	if tree.root == nil {
 		leaf := &Node{
 			height:      0,
 			size:        1,
 			hashIsValid: false,
 			keyHeight:   0,
-			chunk: hchunk.NewHeapChunk(tree.maxChunkCapacity, tree.maxChunkValueSize,
-				tree.keySize, tree.chunkSize),
-			leafID: tree.nextLeafID,
+			chunk:       tree.newChunk(),
+			leafID:      tree.nextLeafID,
+		}
+		err = leaf.chunk.Insert(key, value)
+		if err != nil {
+			return false, errors.Wrapf(err, "at key %x", key)
 		}
 		tree.nextLeafID += 1
-		leaf.chunk.Insert(key, value)
 
 		tree.firstLeaf = leaf
 		tree.root = leaf
+		tree.cache.add(leaf)
 
 		tree.chunkList.append(leaf) // add new chunk to the list
-		return true
+		return false, nil
+	}
+
+	if tree.redistribution && tree.chunkBytes <= 0 {
+		// make room in the leaf before inserting a new key. The K-V pair is checked first,
+		// so that the tree is not changed when the insertion fails
+		leaf := tree.root.getLeaf(key)
+		chunk, err := leaf.getChunk()
+		if err != nil {
+			return false, errors.Wrapf(err, "at key %x", key)
+		}
+		if !chunk.HasRoomFor(value) && chunk.Get(key) == nil && chunk.CheckEntry(key, value) == nil {
+			if err = tree.redistribute(leaf); err != nil {
+				return false, errors.Wrapf(err, "at key %x", key)
+			}
+		}
+	}
+	tree.root, updated, err = tree.recursiveSet(tree.root, key, value)
+	if err != nil {
+		return false, errors.Wrapf(err, "at key %x", key)
 	}
+	return updated, nil
+}
 
-	tree.root, updated = tree.recursiveSet(tree.root, key, value)
-	return updated
+// newChunk returns an empty chunk with the parameters of the tree.
+func (tree *IAVL) newChunk() *hchunk.HeapChunk {
+	chunk := hchunk.NewHeapChunk(tree.maxChunkCapacity, tree.maxChunkValueSize, tree.keySize, tree.chunkSize)
+	chunk.SetTargetBytes(tree.chunkBytes)
+	return chunk
 }
 
+// recursiveSet inserts or updates the K-V pair in the subtree rooted at node.
+// When an error is returned, the subtree is unchanged and newSelf is node.
 func (tree *IAVL) recursiveSet(node *Node, key []byte, value []byte) (
-	newSelf *Node, updated bool,
+	newSelf *Node, updated bool, err error,
 ) {
 
 	if node.isLeaf() {
-
-		if !node.chunk.IsFull() {
+		chunk, err := node.getChunk()
+		if err != nil {
+			return node, false, err
+		}
+		if !chunk.HasRoomForUpdate(key, value) {
+			// the key already exists, but its new value does not fit in the target size of the chunk
+			leftChunk, middleKey, rightChunk, err := chunk.UpdateAndSplitWithPolicy(key, value, tree.splitPolicy)
+			if err == hchunk.ErrSplitNotFound {
+				return tree.splitLeafAt(node, key, value)
+			}
+			if err != nil {
+				return node, false, err
+			}
+			return tree.splitLeaf(node, leftChunk, middleKey, rightChunk), true, nil
+		}
+		updated, err = chunk.Update(key, value)
+		if err != nil {
+			return node, false, err
+		}
+		if updated {
+			// the key already exists: its value is replaced and the structure of the tree does not change
+			node.hashIsValid = false
+			return node, true, nil
+		}
+		if chunk.HasRoomFor(value) {
 			// if the leaf's chunk has space, simply insert the new KV pair in the chunk
-			node.chunk.Insert(key, value)
+			err = chunk.Insert(key, value)
+			if err != nil {
+				return node, false, err
+			}
 			node.size += 1
 			node.hashIsValid = false
-			return node, false
+			return node, false, nil
 		} else {
 			// if the leaf's chunk has no space, it must split into two new chunks for the two new leaves
 
-			leftChunk, middleKey, rightChunk := node.chunk.InsertAndSplit(key, value)
-			// left leaf with its new chunk
-			node.chunk = leftChunk
-			node.size = int32(leftChunk.GetCurrSize())
-
-			// right leaf with its new chunk
-			rightLeaf := &Node{
-				chunk:       rightChunk,
-				keyHeight:   1,
-				size:        int32(rightChunk.GetCurrSize()),
-				leafID:      tree.nextLeafID,
-				hashIsValid: false,
+			leftChunk, middleKey, rightChunk, err := chunk.InsertAndSplitWithPolicy(key, value, tree.splitPolicy)
+			if err == hchunk.ErrSplitNotFound {
+				return tree.splitLeafAt(node, key, value)
 			}
-			tree.nextLeafID += 1
-
-			tree.chunkList.append(rightLeaf) // add new chunk to the list
-
-			rightLeaf.nextLeaf = node.nextLeaf
-			node.nextLeaf = rightLeaf
-			node.hashIsValid = false
-			return &Node{
-				leftNode:    node,
-				rightNode:   rightLeaf,
-				key:         middleKey,
-				leafPointer: rightLeaf,
-				height:      1,
-				size:        node.size + rightLeaf.size,
-				hashIsValid: false,
-			}, false
+			if err != nil {
+				return node, false, err
+			}
+			return tree.splitLeaf(node, leftChunk, middleKey, rightChunk), false, nil
 		}
 	} else {
+		var child, newChild *Node
+		var height uint8
 		if bytes.Compare(key, node.key) < 0 {
-			node.leftNode, updated = tree.recursiveSet(node.getLeftNode(), key, value)
+			child = node.getLeftNode()
+			height = child.height
+			newChild, updated, err = tree.recursiveSet(child, key, value)
+			if err != nil {
+				return node, false, err
+			}
+			node.leftNode = newChild
 			node.leftHash = nil // leftHash is yet unknown
 			node.hashIsValid = false
 		} else {
-			node.rightNode, updated = tree.recursiveSet(node.getRightNode(), key, value)
+			child = node.getRightNode()
+			height = child.height
+			newChild, updated, err = tree.recursiveSet(child, key, value)
+			if err != nil {
+				return node, false, err
+			}
+			node.rightNode = newChild
 			node.rightHash = nil // rightHash is yet unknown
 			node.hashIsValid = false
 		}
 
-		if updated {
-			return node, updated
+		if updated && newChild == child && newChild.height == height {
+			// the heights and the sizes did not change. An update can split a leaf and change the structure
+			return node, updated, nil
 		}
 		node.calcHeightAndSize()
 		newNode := tree.balance(node)
-		return newNode, updated
+		return newNode, updated, nil
+	}
+}
+
+// splitLeafAt splits a leaf whose chunk cannot be split around the new value of the key within the target
+// (see chunk.ErrSplitNotFound) next to the key, without changing the K-V pairs. The key is then set in the new subtree,
+// where it is at the edge of a chunk: a chunk holding the K-V pair alone always fits.
+func (tree *IAVL) splitLeafAt(node *Node, key, value []byte) (newSelf *Node, updated bool, err error) {
+	// the chunk of the leaf is in memory: setting the key already accessed it
+	leftChunk, middleKey, rightChunk, err := node.chunk.SplitAt(node.chunk.SearchKey(key))
+	if err != nil {
+		return node, false, err
+	}
+	return tree.recursiveSet(tree.splitLeaf(node, leftChunk, middleKey, rightChunk), key, value)
+}
+
+// splitLeaf gives the chunks of a split to the leaf, which keeps the left chunk, and to a new leaf on its right.
+// It returns the new inner node whose children are the two leaves.
+func (tree *IAVL) splitLeaf(node *Node, leftChunk *hchunk.HeapChunk, middleKey []byte, rightChunk *hchunk.HeapChunk) *Node {
+	// left leaf with its new chunk
+	node.chunk = leftChunk
+	node.size = int32(leftChunk.GetCurrSize())
+
+	// right leaf with its new chunk
+	rightLeaf := &Node{
+		chunk:       rightChunk,
+		keyHeight:   1,
+		size:        int32(rightChunk.GetCurrSize()),
+		leafID:      tree.nextLeafID,
+		hashIsValid: false,
+	}
+	tree.nextLeafID += 1
+	tree.cache.add(rightLeaf)
+
+	tree.chunkList.append(rightLeaf) // add new chunk to the list
+
+	rightLeaf.nextLeaf = node.nextLeaf
+	rightLeaf.prevLeaf = node
+	if node.nextLeaf != nil {
+		node.nextLeaf.prevLeaf = rightLeaf
+	}
+	node.nextLeaf = rightLeaf
+	node.hashIsValid = false
+	return &Node{
+		leftNode:    node,
+		rightNode:   rightLeaf,
+		key:         middleKey,
+		leafPointer: rightLeaf,
+		height:      1,
+		size:        node.size + rightLeaf.size,
+		hashIsValid: false,
 	}
 }
 
@@ -294,9 +550,21 @@ func (tree *IAVL) rotateLeft(node *Node) *Node {
 // recursiveHash recursively computes the hash of the tree from the root.
 // Only nodes with 'hashIsValud' set to false have their hashes recomputed.
 func (tree *IAVL) recursiveHash() {
-	tree.root.recursiveHash()
+	if tree.root == nil {
+		return
+	}
+	tree.root.recursiveHash(tree.dirtyLeaves)
 }
 
 func (tree *IAVL) isBalanced() bool {
+	if tree.root == nil {
+		return true
+	}
 	return tree.root.isBalancedRecursive()
 }
+
+// EmptyRootHash returns the root hash of an empty tree: the hash of no data.
+func EmptyRootHash() []byte {
+	h := sha256.Sum256(nil)
+	return h[:]
+}
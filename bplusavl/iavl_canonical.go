@@ -0,0 +1,370 @@
+package bplusavl
+
+import (
+	hchunk "bplus/chunk"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/bits"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// WithCanonicalShape makes the shape of the tree, hence its root hash, depend only on its K-V pairs and not on the
+// order of the insertions and removals, so that replicas applying the same changes in different orders agree
+// on the root hash.
+//
+// The chunk boundaries are content-defined: a chunk starts at every key whose hash is a multiple of half
+// the chunk size (see isChunkBoundary), and the keys between two such boundaries, a run, fill chunks from left
+// to right, a new chunk starting when the current one has no room left. The inner nodes form a crit-bit trie over
+// the smallest keys of the leaves: an inner node splits its leaves at the first bit where their smallest keys
+// differ. A change re-chunks the run of the changed key only, and only the inner nodes on the paths to the leaves
+// whose smallest key changed are updated.
+//
+// The tree is not AVL-balanced: its height depends on the distribution of the keys, and is at most the number
+// of bits of a key. Keys are therefore limited to 31 bytes, writing a tree with longer keys returns
+// ErrInvalidParameters. The split policy and the redistribution option are ignored. The option must be given
+// to an empty tree: a tree imported from a snapshot keeps the shape and the mode of the exported tree.
+func WithCanonicalShape() TreeOption {
+	return func(tree *IAVL) {
+		tree.canonical = true
+	}
+}
+
+// maxCanonicalKeySize is the largest key size of a canonical tree: the height of the trie is at most
+// the number of bits of a key, and heights are kept in 8 bits.
+const maxCanonicalKeySize = 31
+
+// isChunkBoundary returns true if a chunk of a canonical tree starts at key.
+func (tree *IAVL) isChunkBoundary(key []byte) bool {
+	period := uint32(tree.chunkSize / 2)
+	if period < 2 {
+		period = 2
+	}
+	h := sha256.Sum256(key)
+	return binary.BigEndian.Uint32(h[:4])%period == 0
+}
+
+// canonicalUpdate sets the value of the key in a canonical tree, or removes the key if value is nil.
+// It returns true if the key was in the tree. The hashes are not recomputed.
+// When an error is returned, the tree is unchanged.
+func (tree *IAVL) canonicalUpdate(key, value []byte) (found bool, err error) {
+	// the run of the key: the leaves from the last boundary up to the next one.
+	// A removed key that starts a chunk may be a boundary: its run is merged with the previous one
+	n := tree.GetNumberOfChunks()
+	lo, hi := 0, 0
+	if n > 0 {
+		lo = tree.chunkList.getInsertionIndex(key) - 1
+		if lo < 0 {
+			lo = 0
+		}
+		hi = lo + 1
+		for lo > 0 {
+			first := tree.chunkList.chunks[lo].getSmallestKey()
+			if tree.isChunkBoundary(first) && (value != nil || !bytes.Equal(first, key)) {
+				break
+			}
+			lo--
+		}
+		for hi < n && !tree.isChunkBoundary(tree.chunkList.chunks[hi].getSmallestKey()) {
+			hi++
+		}
+	}
+	old := make([]*Node, hi-lo)
+	copy(old, tree.chunkList.chunks[lo:hi])
+
+	var keys, values [][]byte
+	for _, leaf := range old {
+		chunk, err := leaf.getChunk()
+		if err != nil {
+			return false, errors.Wrapf(err, "at key %x", key)
+		}
+		if chunk.IsReadOnly() {
+			return false, errors.Wrapf(ErrReadOnly, "at key %x", key)
+		}
+		for i := int32(0); i < chunk.GetCurrSize(); i++ {
+			keys = append(keys, chunk.GetKeyAt(i))
+			values = append(values, chunk.GetValueAt(i))
+		}
+	}
+	i := sort.Search(len(keys), func(i int) bool { return bytes.Compare(keys[i], key) >= 0 })
+	found = i < len(keys) && bytes.Equal(keys[i], key)
+	switch {
+	case found && value == nil:
+		keys = append(keys[:i], keys[i+1:]...)
+		values = append(values[:i], values[i+1:]...)
+	case found:
+		values[i] = value
+	case value == nil:
+		return false, nil
+	default:
+		keys = append(keys[:i], append([][]byte{key}, keys[i:]...)...)
+		values = append(values[:i], append([][]byte{value}, values[i:]...)...)
+	}
+
+	chunks, err := tree.canonicalChunks(keys, values)
+	if err != nil {
+		return false, errors.Wrapf(err, "at key %x", key)
+	}
+	if sameSmallestKeys(old, chunks) {
+		tree.replaceChunks(old, chunks)
+		return found, nil
+	}
+	tree.rechunkCanonical(old, chunks)
+	return found, nil
+}
+
+// sameSmallestKeys returns true if the chunks start with the smallest keys of the leaves, in order.
+func sameSmallestKeys(leaves []*Node, chunks []*hchunk.HeapChunk) bool {
+	if len(leaves) != len(chunks) {
+		return false
+	}
+	for i, leaf := range leaves {
+		if !bytes.Equal(leaf.getSmallestKey(), chunks[i].GetSmallestKeyUnsafe()) {
+			return false
+		}
+	}
+	return true
+}
+
+// canonicalChunks fills chunks with the sorted K-V pairs of a run.
+func (tree *IAVL) canonicalChunks(keys, values [][]byte) ([]*hchunk.HeapChunk, error) {
+	var chunks []*hchunk.HeapChunk
+	var chunk *hchunk.HeapChunk
+	for i, key := range keys {
+		if chunk == nil || (chunk.GetCurrSize() > 0 && tree.isChunkBoundary(key)) || !chunk.HasRoomFor(values[i]) {
+			chunk = tree.newChunk()
+			chunks = append(chunks, chunk)
+		}
+		err := chunk.Insert(key, values[i])
+		if err == hchunk.ErrCapacityExceeded && chunk.GetCurrSize() > 0 {
+			chunk = tree.newChunk()
+			chunks = append(chunks, chunk)
+			err = chunk.Insert(key, values[i])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return chunks, nil
+}
+
+// replaceChunks gives the new chunks, which start with the same keys, to the leaves of a run, in order.
+// The shape of the tree does not change: the inner nodes take their keys from the new chunks,
+// and their sizes and hashes are updated.
+func (tree *IAVL) replaceChunks(leaves []*Node, chunks []*hchunk.HeapChunk) {
+	// the owners are found with the old keys, before any of them changes
+	owners := make([]*Node, len(leaves))
+	for i, leaf := range leaves {
+		owners[i] = tree.keyNodeOf(leaf, leaf.getSmallestKey())
+	}
+	for i, leaf := range leaves {
+		tree.cache.remove(leaf)
+		leaf.chunk = chunks[i]
+		leaf.size = chunks[i].GetCurrSize()
+		leaf.hashIsValid = false
+		tree.cache.add(leaf)
+		if owners[i] != nil {
+			owners[i].key = chunks[i].GetSmallestKeyUnsafe()
+		}
+	}
+	for _, leaf := range leaves {
+		tree.root.setHashInvalidDownTo(leaf.chunk.GetSmallestKeyUnsafe())
+	}
+	tree.root.updateInvalidSizes()
+}
+
+// updateInvalidSizes recomputes the size of the inner nodes whose hash is invalid.
+func (node *Node) updateInvalidSizes() {
+	if node.isLeaf() || node.hashIsValid {
+		return
+	}
+	node.leftNode.updateInvalidSizes()
+	node.rightNode.updateInvalidSizes()
+	node.size = node.leftNode.size + node.rightNode.size
+}
+
+// rechunkCanonical replaces the leaves of a run by leaves holding the new chunks. The old leaves are removed
+// from the trie and the new ones are inserted, so that only the inner nodes on their paths change.
+// The old leaves are reused, in order, as long as possible.
+func (tree *IAVL) rechunkCanonical(old []*Node, chunks []*hchunk.HeapChunk) {
+	for _, leaf := range old {
+		tree.removeCanonicalLeaf(leaf)
+	}
+	for i, chunk := range chunks {
+		var leaf *Node
+		if i < len(old) {
+			leaf = old[i]
+		} else {
+			leaf = &Node{leafID: tree.nextLeafID}
+			tree.nextLeafID++
+		}
+		leaf.chunk = chunk
+		leaf.size = chunk.GetCurrSize()
+		leaf.keyHeight = 0
+		leaf.hashIsValid = false
+		tree.insertCanonicalLeaf(leaf)
+	}
+	for i := len(chunks); i < len(old); i++ {
+		delete(tree.dirtyLeaves, old[i].leafID)
+		tree.removedLeaves[old[i].leafID] = true
+	}
+}
+
+// removeCanonicalLeaf removes a leaf from the trie, the leaf chain and the chunk list.
+// The sibling of the leaf takes the place of its parent.
+func (tree *IAVL) removeCanonicalLeaf(leaf *Node) {
+	var newLeftmost *Node
+	tree.root, newLeftmost = tree.recursiveRemoveLeaf(tree.root, leaf)
+	tree.unlinkLeaf(leaf)
+	if tree.root == nil {
+		tree.firstLeaf = nil
+		return
+	}
+	if newLeftmost != nil {
+		// the left-most leaf was removed: the following leaf does not provide a key any more
+		newLeftmost.keyHeight = 0
+		tree.root.setHashInvalidDownTo(newLeftmost.getSmallestKey())
+		tree.firstLeaf = newLeftmost
+	}
+}
+
+// recursiveRemoveLeaf removes the leaf from the subtree rooted at node, as recursiveRemove removes a leaf,
+// without balancing the subtree.
+func (tree *IAVL) recursiveRemoveLeaf(node *Node, leaf *Node) (newSelf *Node, newLeftmost *Node) {
+	if node.isLeaf() {
+		return nil, node.nextLeaf
+	}
+	if bytes.Compare(leaf.getSmallestKey(), node.key) < 0 {
+		var newLeft *Node
+		newLeft, newLeftmost = tree.recursiveRemoveLeaf(node.leftNode, leaf)
+		if newLeft == nil {
+			return node.rightNode, newLeftmost
+		}
+		node.leftNode = newLeft
+		node.leftHash = nil
+	} else {
+		var newRight *Node
+		newRight, newLeftmost = tree.recursiveRemoveLeaf(node.rightNode, leaf)
+		if newRight == nil {
+			return node.leftNode, nil
+		}
+		node.rightNode = newRight
+		node.rightHash = nil
+		if newLeftmost != nil {
+			node.key = newLeftmost.getSmallestKey()
+			node.leafPointer = newLeftmost
+			newLeftmost = nil
+		}
+	}
+	node.hashIsValid = false
+	node.calcHeightAndSize()
+	return node, newLeftmost
+}
+
+// insertCanonicalLeaf inserts a leaf, whose chunk is set, in the trie, the leaf chain and the chunk list.
+// A new inner node is added above the largest subtree whose smallest keys share a longer prefix with the smallest
+// key of the leaf than the closest smallest key, the crit bit of the new node.
+func (tree *IAVL) insertCanonicalLeaf(leaf *Node) {
+	key := leaf.getSmallestKey()
+	index := tree.chunkList.getInsertionIndex(key)
+	prev, next := tree.chunkList.GetChunk(index-1), tree.chunkList.GetChunk(index)
+	tree.chunkList.appendAt(index, leaf)
+	tree.cache.add(leaf)
+	leaf.prevLeaf, leaf.nextLeaf = prev, next
+	if prev != nil {
+		prev.nextLeaf = leaf
+	} else {
+		tree.firstLeaf = leaf
+	}
+	if next != nil {
+		next.prevLeaf = leaf
+	}
+	if tree.root == nil {
+		tree.root = leaf
+		return
+	}
+
+	bit := -1
+	if prev != nil {
+		bit = firstDifferentBit(key, prev.getSmallestKey())
+	}
+	if next != nil {
+		if nextBit := firstDifferentBit(key, next.getSmallestKey()); nextBit > bit {
+			bit = nextBit
+		}
+	}
+	// if the leaf becomes the left-most one, it does not provide a key
+	tree.root, _ = tree.recursiveInsertLeaf(tree.root, leaf, key, bit)
+}
+
+// recursiveInsertLeaf inserts the leaf in the subtree rooted at node, where the new inner node splits
+// at the given bit. It returns the new root of the subtree and true if the leaf is its left-most leaf.
+func (tree *IAVL) recursiveInsertLeaf(node *Node, leaf *Node, key []byte, bit int) (newSelf *Node, leftmost bool) {
+	if node.isLeaf() || node.critBit() > bit {
+		// the smallest keys of the subtree are all smaller or all larger than the key
+		var inner *Node
+		if provider := node.getLeftmostLeaf(); bytes.Compare(key, provider.getSmallestKey()) < 0 {
+			// the left-most leaf of the subtree now provides the key of the new node
+			inner = &Node{leftNode: leaf, rightNode: node, key: provider.getSmallestKey(), leafPointer: provider}
+			leftmost = true
+		} else {
+			inner = &Node{leftNode: node, rightNode: leaf, key: key, leafPointer: leaf}
+		}
+		inner.calcHeightAndSize()
+		return inner, leftmost
+	}
+	// the key shares the prefix of the keys of the subtree: it goes to the side of its crit bit,
+	// possibly as the new left-most leaf of the right subtree
+	if !isBitSet(key, node.critBit()) {
+		node.leftNode, leftmost = tree.recursiveInsertLeaf(node.leftNode, leaf, key, bit)
+		node.leftHash = nil
+	} else {
+		node.rightNode, leftmost = tree.recursiveInsertLeaf(node.rightNode, leaf, key, bit)
+		node.rightHash = nil
+		if leftmost {
+			// the leaf is the new left-most leaf of the right subtree
+			node.key = key
+			node.leafPointer = leaf
+			leftmost = false
+		}
+	}
+	node.hashIsValid = false
+	node.calcHeightAndSize()
+	return node, leftmost
+}
+
+// critBit returns the first bit where the smallest keys of the leaves of an inner node of a canonical tree differ:
+// it is set in the keys of the right subtree and not in the keys of the left subtree.
+func (node *Node) critBit() int {
+	if node.leftNode.isLeaf() {
+		return firstDifferentBit(node.leftNode.getSmallestKey(), node.key)
+	}
+	return firstDifferentBit(node.leftNode.key, node.key)
+}
+
+// getLeftmostLeaf returns the left-most leaf of the subtree rooted at node.
+func (node *Node) getLeftmostLeaf() *Node {
+	for !node.isLeaf() {
+		node = node.leftNode
+	}
+	return node
+}
+
+// isBitSet returns true if the bit of the key at the given index, from the most significant bit of the first byte,
+// is set.
+func isBitSet(key []byte, bit int) bool {
+	return key[bit/8]&(0x80>>(bit%8)) != 0
+}
+
+// firstDifferentBit returns the index of the first bit, from the most significant bit of the first byte,
+// where two keys of the same size differ, or their size in bits if they are equal.
+func firstDifferentBit(a, b []byte) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return len(a) * 8
+}
@@ -0,0 +1,151 @@
+package bplusavl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/bits"
+	"math/rand"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalShape(t *testing.T) {
+	assert := assert.New(t)
+	key := func(k int) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(k))
+		return b
+	}
+	const keys = 3000
+	for _, options := range [][]TreeOption{
+		{WithCanonicalShape()},
+		{WithChunkBytes(256), WithCanonicalShape()},
+	} {
+		var rootHash []byte
+		for round := 0; round < 4; round++ {
+			tree := NewIAVL(16, 4, options...)
+			// a different order each time, with keys that are removed later
+			for _, k := range rand.Perm(keys + 500) {
+				_, err := tree.Set(key(k), bytes.Repeat([]byte{byte(k)}, 1+k%20))
+				assert.NoError(err)
+			}
+			for _, k := range rand.Perm(500) {
+				_, removed, err := tree.Remove(key(keys + k))
+				assert.NoError(err)
+				assert.True(removed)
+			}
+			assert.NoError(tree.Verify())
+			if rootHash == nil {
+				rootHash = tree.GetRootHash()
+			}
+			assert.Equal(rootHash, tree.GetRootHash())
+		}
+	}
+
+	// updates in different orders
+	a, b := NewIAVL(8, 4, WithCanonicalShape()), NewIAVL(8, 4, WithCanonicalShape())
+	for k := 0; k < 500; k++ {
+		a.Set(key(k), key(k))
+		b.Set(key(499-k), key(499-k))
+	}
+	assert.Equal(a.GetRootHash(), b.GetRootHash())
+	for _, k := range rand.Perm(500) {
+		a.Set(key(k), []byte("updated"))
+	}
+	for k := 0; k < 500; k++ {
+		b.Set(key(k), []byte("updated"))
+	}
+	assert.Equal(a.GetRootHash(), b.GetRootHash())
+	for k := 0; k < 500; k += 7 {
+		proof, err := a.GetElementProof(key(k))
+		assert.NoError(err)
+		assert.Equal(a.GetRootHash(), proof.ValidateProof(key(k), []byte("updated")))
+	}
+
+	// removing every key
+	for _, k := range rand.Perm(500) {
+		_, removed, err := a.Remove(key(k))
+		assert.NoError(err)
+		assert.True(removed)
+		if k%50 == 0 {
+			assert.NoError(a.Verify())
+		}
+	}
+	assert.Equal(EmptyRootHash(), a.GetRootHash())
+	assert.Equal(0, a.GetNumberOfChunks())
+	_, err := a.Set(key(1), key(1))
+	assert.NoError(err)
+	assert.Equal(key(1), a.Get(key(1)))
+}
+
+func TestCanonicalShapeSnapshot(t *testing.T) {
+	assert := assert.New(t)
+	a := NewIAVL(4, 2, WithCanonicalShape())
+	for _, k := range rand.Perm(1000) {
+		a.Set([]byte{byte(k >> 8), byte(k)}, []byte{byte(k)})
+	}
+	var buffer bytes.Buffer
+	assert.NoError(a.ExportSnapshot(&buffer))
+	b, err := ImportSnapshot(buffer.Bytes())
+	assert.NoError(err)
+	assert.True(b.canonical)
+
+	// the imported tree stays canonical, and its leaves are committed like the others
+	store := &mapSink{leaves: make(map[uint32][]byte)}
+	assert.NoError(b.Commit(store))
+	for _, k := range rand.Perm(1200) {
+		if k%3 == 0 {
+			a.Remove([]byte{byte(k >> 8), byte(k)})
+			b.Remove([]byte{byte(k >> 8), byte(k)})
+		} else {
+			a.Set([]byte{byte(k >> 8), byte(k)}, []byte("changed"))
+			b.Set([]byte{byte(k >> 8), byte(k)}, []byte("changed"))
+		}
+	}
+	assert.Equal(a.GetRootHash(), b.GetRootHash())
+	assert.NoError(b.Verify())
+	assert.NoError(b.Commit(store))
+	rebuilt := store.rebuild(t, WithCanonicalShape())
+	assert.Equal(b.GetRootHash(), rebuilt.GetRootHash())
+}
+
+func TestCanonicalShapeLocalUpdates(t *testing.T) {
+	assert := assert.New(t)
+	key := func(k int) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(k))
+		return b
+	}
+	tree := NewIAVL(4, 4, WithCanonicalShape())
+	for _, k := range rand.Perm(20000) {
+		tree.Set(key(2*k), key(k))
+	}
+	store := &mapSink{leaves: make(map[uint32][]byte)}
+	assert.NoError(tree.Commit(store))
+
+	// a change only modifies the leaves of its run and the leaves providing the keys of the nodes on the changed paths
+	for i := 0; i < 200; i++ {
+		k := 2*rand.Intn(20000) + rand.Intn(2)
+		if i%2 == 0 {
+			_, err := tree.Set(key(k), key(k))
+			assert.NoError(err)
+		} else {
+			_, _, err := tree.Remove(key(k))
+			assert.NoError(err)
+		}
+		assert.LessOrEqual(len(tree.DirtyLeaves()), 4*int(tree.root.height))
+		assert.NoError(tree.Commit(store))
+	}
+	assert.NoError(tree.Verify())
+	assert.Equal(tree.GetRootHash(), store.rebuild(t, WithCanonicalShape()).GetRootHash())
+	// the keys are evenly distributed: the trie is about as high as a balanced tree
+	assert.Less(int(tree.root.height), 2*bits.Len(uint(tree.GetNumberOfChunks())))
+
+	// the height is bounded by the number of bits of a key
+	_, err := NewIAVL(8, maxCanonicalKeySize, WithCanonicalShape()).Set(make([]byte, maxCanonicalKeySize), []byte{1})
+	assert.NoError(err)
+	_, err = NewIAVL(8, maxCanonicalKeySize+1, WithCanonicalShape()).Set(make([]byte, maxCanonicalKeySize+1), []byte{1})
+	assert.True(errors.Is(err, ErrInvalidParameters))
+}
@@ -0,0 +1,74 @@
+package bplusavl
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// LeafSink receives the changes written by IAVL.Commit, so that an external store of leaves
+// can be updated incrementally. Inner nodes are never stored: RebuildTree recovers them from the leaves.
+type LeafSink interface {
+	// WriteLeaf stores a leaf modified or created since the last commit, serialized with Node.Serialize.
+	// The data must be copied if it is retained.
+	WriteLeaf(leafID uint32, data []byte) error
+	// RemoveLeaf deletes a leaf removed since the last commit.
+	RemoveLeaf(leafID uint32) error
+}
+
+// DirtyLeaves returns views of the leaves modified or created since the last commit, sorted by leaf ID.
+// A tree rebuilt by RebuildTree or ImportSnapshot starts with no dirty leaves.
+func (tree *IAVL) DirtyLeaves() []*LeafView {
+	views := make([]*LeafView, 0, len(tree.dirtyLeaves))
+	for _, leaf := range tree.sortedDirtyLeaves() {
+		views = append(views, newLeafView(leaf))
+	}
+	return views
+}
+
+// RemovedLeaves returns the IDs of the leaves removed since the last commit, in increasing order.
+// It may contain leaves that were created and removed after the last commit.
+func (tree *IAVL) RemovedLeaves() []uint32 {
+	leafIDs := make([]uint32, 0, len(tree.removedLeaves))
+	for leafID := range tree.removedLeaves {
+		leafIDs = append(leafIDs, leafID)
+	}
+	sort.Slice(leafIDs, func(i, j int) bool { return leafIDs[i] < leafIDs[j] })
+	return leafIDs
+}
+
+// Commit writes the leaves modified or created since the last commit to sink, followed by the IDs
+// of the removed leaves as tombstones. If sink returns an error, the commit stops and the changes are kept:
+// a later commit writes them again.
+func (tree *IAVL) Commit(sink LeafSink) error {
+	var buffer bytes.Buffer
+	for _, leaf := range tree.sortedDirtyLeaves() {
+		buffer.Reset()
+		if err := leaf.Serialize(&buffer); err != nil {
+			return err
+		}
+		if err := sink.WriteLeaf(leaf.leafID, buffer.Bytes()); err != nil {
+			return errors.Wrapf(err, "while writing leaf %d", leaf.leafID)
+		}
+	}
+	for _, leafID := range tree.RemovedLeaves() {
+		if err := sink.RemoveLeaf(leafID); err != nil {
+			return errors.Wrapf(err, "while removing leaf %d", leafID)
+		}
+	}
+	tree.dirtyLeaves = make(map[uint32]*Node)
+	tree.removedLeaves = make(map[uint32]bool)
+	// the committed leaves can be evicted (see WithLeafStore)
+	tree.cache.shrink()
+	return nil
+}
+
+func (tree *IAVL) sortedDirtyLeaves() []*Node {
+	leaves := make([]*Node, 0, len(tree.dirtyLeaves))
+	for _, leaf := range tree.dirtyLeaves {
+		leaves = append(leaves, leaf)
+	}
+	sort.Slice(leaves, func(i, j int) bool { return leaves[i].leafID < leaves[j].leafID })
+	return leaves
+}
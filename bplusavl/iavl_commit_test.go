@@ -0,0 +1,99 @@
+package bplusavl
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// mapSink is a LeafSink storing the serialized leaves in memory.
+type mapSink struct {
+	leaves map[uint32][]byte
+	writes int
+	reads  int
+	fail   bool
+}
+
+func (sink *mapSink) WriteLeaf(leafID uint32, data []byte) error {
+	if sink.fail {
+		return errors.New("sink failure")
+	}
+	sink.leaves[leafID] = append([]byte(nil), data...)
+	sink.writes++
+	return nil
+}
+
+func (sink *mapSink) RemoveLeaf(leafID uint32) error {
+	delete(sink.leaves, leafID)
+	return nil
+}
+
+// rebuild rebuilds a tree from the stored leaves, with the given options.
+func (sink *mapSink) rebuild(t *testing.T, options ...TreeOption) *IAVL {
+	var leaves []*Node
+	for _, data := range sink.leaves {
+		leaf, err := Deserialize(data, 4)
+		assert.NoError(t, err)
+		leaves = append(leaves, leaf)
+	}
+	SortNodeList(leaves)
+	tree, err := RebuildTree(leaves, options...)
+	assert.NoError(t, err)
+	tree.CompleteRehash()
+	return tree
+}
+
+func TestCommit(t *testing.T) {
+	assert := assert.New(t)
+	tree := NewIAVL(4, 1)
+	sink := &mapSink{leaves: make(map[uint32][]byte)}
+	assert.NoError(tree.Commit(sink))
+	assert.Empty(sink.leaves)
+
+	for k := byte(0); k < 100; k++ {
+		tree.Set([]byte{k}, []byte{k})
+	}
+	assert.Len(tree.DirtyLeaves(), tree.GetNumberOfChunks())
+	assert.NoError(tree.Commit(sink))
+	assert.Len(sink.leaves, tree.GetNumberOfChunks())
+	assert.Empty(tree.DirtyLeaves())
+	assert.Equal(tree.GetRootHash(), sink.rebuild(t).GetRootHash())
+
+	// an update only dirties its leaf
+	tree.Set([]byte{50}, []byte("new value"))
+	dirty := tree.DirtyLeaves()
+	assert.Len(dirty, 1)
+	assert.Equal([]byte("new value"), dirty[0].ValueAt(50-int(dirty[0].SmallestKey()[0])))
+	writes := sink.writes
+	assert.NoError(tree.Commit(sink))
+	assert.Equal(writes+1, sink.writes)
+
+	// random insertions and removals
+	for i := 0; i < 20; i++ {
+		for j := 0; j < 30; j++ {
+			key := []byte{byte(rand.Intn(256))}
+			if rand.Intn(2) == 0 {
+				tree.Remove(key)
+			} else {
+				tree.Set(key, key)
+			}
+		}
+		assert.NoError(tree.Commit(sink))
+		assert.Equal(tree.GetRootHash(), sink.rebuild(t).GetRootHash())
+	}
+
+	// a failed commit keeps the changes
+	for k := byte(0); k < 100; k++ {
+		tree.Remove([]byte{k})
+	}
+	assert.NotEmpty(tree.RemovedLeaves())
+	sink.fail = true
+	assert.Error(tree.Commit(sink))
+	assert.NotEmpty(tree.RemovedLeaves())
+	sink.fail = false
+	assert.NoError(tree.Commit(sink))
+	assert.Empty(tree.RemovedLeaves())
+	assert.Equal(tree.GetRootHash(), sink.rebuild(t).GetRootHash())
+}
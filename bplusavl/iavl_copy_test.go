@@ -0,0 +1,53 @@
+package bplusavl
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopySafeAccessors(t *testing.T) {
+	assert := assert.New(t)
+	tree := NewIAVL(int32(4), int32(2))
+
+	// the caller's slices are copied by Set, even if they have spare capacity
+	key := make([]byte, 2, 16)
+	value := []byte("value")
+	key[0], key[1] = 1, 1
+	tree.Set(key, value)
+	extended := key[:4]
+	assert.Equal([]byte{0, 0}, extended[2:])
+
+	key[0] = 9
+	value[0] = 'X'
+	assert.Equal([]byte("value"), tree.Get([]byte{1, 1}))
+	assert.Nil(tree.Get(key))
+
+	// Get returns a copy
+	got := tree.Get([]byte{1, 1})
+	got[0] = 'X'
+	assert.Equal([]byte("value"), tree.Get([]byte{1, 1}))
+
+	// GetUnsafe and ViewValue do not copy
+	unsafe := tree.GetUnsafe([]byte{1, 1})
+	unsafe[0] = 'V'
+	assert.Equal([]byte("Value"), tree.Get([]byte{1, 1}))
+	for i := byte(2); i < 50; i++ {
+		tree.Set([]byte{i, i}, bytes.Repeat([]byte{i}, 10))
+	}
+	tree.Set([]byte{1, 1}, []byte("other"))
+
+	viewed := false
+	assert.True(tree.ViewValue([]byte{1, 1}, func(value []byte) {
+		viewed = true
+		assert.Equal([]byte("other"), value)
+	}))
+	assert.True(viewed)
+	assert.False(tree.ViewValue([]byte{0, 0}, func(value []byte) { t.Fail() }))
+
+	// the key of an inner node is not affected by the caller
+	smallest := tree.GetChunk(1).GetSmallestKey()
+	smallest[0] = 0
+	assert.Nil(tree.Verify())
+}
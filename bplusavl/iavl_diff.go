@@ -0,0 +1,225 @@
+package bplusavl
+
+import (
+	hchunk "bplus/chunk"
+	"bytes"
+)
+
+// DiffKind tells how a key differs between two trees.
+type DiffKind uint8
+
+const (
+	// DiffAdded means that the key is only in the second tree.
+	DiffAdded DiffKind = iota
+	// DiffRemoved means that the key is only in the first tree.
+	DiffRemoved
+	// DiffChanged means that the key is in both trees with different values.
+	DiffChanged
+)
+
+func (kind DiffKind) String() string {
+	switch kind {
+	case DiffAdded:
+		return "added"
+	case DiffRemoved:
+		return "removed"
+	case DiffChanged:
+		return "changed"
+	}
+	return "unknown"
+}
+
+// DiffEntry is a key that differs between two trees. OldValue is nil for an added key,
+// NewValue is nil for a removed key. The key and the values are copies.
+type DiffEntry struct {
+	Kind     DiffKind
+	Key      []byte
+	OldValue []byte
+	NewValue []byte
+}
+
+// TreeDiff lists the keys that differ between two trees, each in ascending order.
+type TreeDiff struct {
+	Added   [][]byte // keys only in the second tree
+	Removed [][]byte // keys only in the first tree
+	Changed [][]byte // keys in both trees with different values
+}
+
+// Diff returns the keys added, removed and changed from tree a to tree b (see DiffFunc).
+func Diff(a, b *IAVL) (*TreeDiff, error) {
+	diff := &TreeDiff{}
+	err := DiffFunc(a, b, func(entry DiffEntry) bool {
+		switch entry.Kind {
+		case DiffAdded:
+			diff.Added = append(diff.Added, entry.Key)
+		case DiffRemoved:
+			diff.Removed = append(diff.Removed, entry.Key)
+		case DiffChanged:
+			diff.Changed = append(diff.Changed, entry.Key)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return diff, nil
+}
+
+// DiffFunc calls fn for every key that differs from tree a to tree b, in ascending key order, until fn returns false.
+// Both trees are descended together from their roots, and identical content is skipped by comparing hashes:
+// two subtrees with the same hash, or two leaves with the same chunk hash, are not visited. When the hashes differ,
+// only the larger subtree is descended into, so that the subtrees of trees with different shapes can still match.
+// The K-V pairs of the leaves left are compared one by one, and only their chunks are loaded.
+// Both trees must have their hashes up-to-date, and must not be modified during the call.
+// An error is returned if a leaf cannot be loaded.
+func DiffFunc(a, b *IAVL, fn func(entry DiffEntry) bool) error {
+	return diffSides(newDiffSide(a), newDiffSide(b), fn)
+}
+
+// diffSides compares the content left in two sides, see DiffFunc.
+func diffSides(a, b *diffSide, fn func(entry DiffEntry) bool) error {
+	for a.valid() || b.valid() {
+		if skipOrExpand(a, b) {
+			continue
+		}
+		for _, side := range []*diffSide{a, b} {
+			if side.valid() {
+				if err := side.load(); err != nil {
+					return err
+				}
+			}
+		}
+
+		var entry DiffEntry
+		compared := 0
+		switch {
+		case !a.valid():
+			compared = 1
+		case !b.valid():
+			compared = -1
+		default:
+			compared = bytes.Compare(a.key(), b.key())
+		}
+		switch compared {
+		case -1:
+			entry = DiffEntry{Kind: DiffRemoved, Key: a.key(), OldValue: copyBytes(a.value())}
+			a.next()
+		case 1:
+			entry = DiffEntry{Kind: DiffAdded, Key: b.key(), NewValue: copyBytes(b.value())}
+			b.next()
+		default:
+			same := bytes.Equal(a.value(), b.value())
+			entry = DiffEntry{Kind: DiffChanged, Key: a.key(),
+				OldValue: copyBytes(a.value()), NewValue: copyBytes(b.value())}
+			a.next()
+			b.next()
+			if same {
+				continue
+			}
+		}
+		if !fn(entry) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// skipOrExpand skips the next subtrees of both sides if they have the same content, or otherwise descends into
+// the larger one if it is an inner node. It returns false if the K-V pairs of the next leaves must be compared,
+// which is also the case when a side is in the middle of a chunk.
+func skipOrExpand(a, b *diffSide) bool {
+	if !a.valid() || !b.valid() || a.index > 0 || b.index > 0 {
+		return false
+	}
+	nodeA, nodeB := a.head(), b.head()
+	if bytes.Equal(nodeA.hash, nodeB.hash) ||
+		(nodeA.isLeaf() && nodeB.isLeaf() && bytes.Equal(nodeA.getChunkHash(), nodeB.getChunkHash())) {
+		a.pop()
+		b.pop()
+		return true
+	}
+	switch {
+	case nodeA.isLeaf() && nodeB.isLeaf():
+		return false
+	case nodeB.isLeaf() || (!nodeA.isLeaf() && nodeA.size > nodeB.size):
+		a.expand()
+	case nodeA.isLeaf() || nodeB.size > nodeA.size:
+		b.expand()
+	default:
+		a.expand()
+		b.expand()
+	}
+	return true
+}
+
+// diffSide goes through the subtrees of a tree in ascending key order, down to its K-V pairs
+// when they have to be compared.
+type diffSide struct {
+	pending []*Node           // subtrees left, the next one last
+	chunk   *hchunk.HeapChunk // chunk of the next subtree once it is loaded, nil before
+	index   int32             // position in chunk of the next K-V pair
+	loaded  int               // number of chunks loaded so far
+}
+
+func newDiffSide(tree *IAVL) *diffSide {
+	side := &diffSide{}
+	if tree.root != nil {
+		side.pending = []*Node{tree.root}
+	}
+	return side
+}
+
+func (side *diffSide) valid() bool {
+	return len(side.pending) > 0
+}
+
+// head returns the next subtree.
+func (side *diffSide) head() *Node {
+	return side.pending[len(side.pending)-1]
+}
+
+// pop skips the next subtree.
+func (side *diffSide) pop() {
+	side.pending = side.pending[:len(side.pending)-1]
+	side.chunk, side.index = nil, 0
+}
+
+// expand replaces the next subtree, an inner node, by its children.
+func (side *diffSide) expand() {
+	node := side.head()
+	side.pending[len(side.pending)-1] = node.rightNode
+	side.pending = append(side.pending, node.leftNode)
+}
+
+// load descends into the next subtree down to its left-most leaf and loads its chunk.
+func (side *diffSide) load() error {
+	if side.chunk != nil {
+		return nil
+	}
+	for !side.head().isLeaf() {
+		side.expand()
+	}
+	chunk, err := side.head().getChunk()
+	if err != nil {
+		return err
+	}
+	side.chunk = chunk
+	side.loaded++
+	return nil
+}
+
+func (side *diffSide) key() []byte {
+	return side.chunk.GetKeyAt(side.index)
+}
+
+func (side *diffSide) value() []byte {
+	return side.chunk.GetValueAt(side.index)
+}
+
+// next moves to the next K-V pair, and to the next subtree at the end of the chunk.
+func (side *diffSide) next() {
+	side.index++
+	if side.index == side.chunk.GetCurrSize() {
+		side.pop()
+	}
+}
@@ -0,0 +1,101 @@
+package bplusavl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// bruteForceDiff compares the K-V pairs of the trees one by one.
+func bruteForceDiff(a, b *IAVL) *TreeDiff {
+	diff := &TreeDiff{}
+	keysA, valuesA := treeEntries(a)
+	keysB, valuesB := treeEntries(b)
+	i, j := 0, 0
+	for i < len(keysA) || j < len(keysB) {
+		switch {
+		case j == len(keysB) || (i < len(keysA) && bytes.Compare(keysA[i], keysB[j]) == -1):
+			diff.Removed = append(diff.Removed, keysA[i])
+			i++
+		case i == len(keysA) || bytes.Compare(keysA[i], keysB[j]) == 1:
+			diff.Added = append(diff.Added, keysB[j])
+			j++
+		default:
+			if !bytes.Equal(valuesA[i], valuesB[j]) {
+				diff.Changed = append(diff.Changed, keysA[i])
+			}
+			i++
+			j++
+		}
+	}
+	return diff
+}
+
+func TestDiff(t *testing.T) {
+	assert := assert.New(t)
+	key := func(k int) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(k))
+		return b
+	}
+	a := NewIAVL(16, 4)
+	for _, k := range rand.Perm(5000) {
+		a.Set(key(2*k), key(k))
+	}
+	var buffer bytes.Buffer
+	assert.NoError(a.ExportSnapshot(&buffer))
+	b, err := ImportSnapshot(buffer.Bytes())
+	assert.NoError(err)
+	diff, err := Diff(a, b)
+	assert.NoError(err)
+	assert.Equal(&TreeDiff{}, diff)
+	sideA, sideB := newDiffSide(a), newDiffSide(b)
+	assert.NoError(diffSides(sideA, sideB, func(DiffEntry) bool { return true }))
+	assert.Equal(0, sideA.loaded+sideB.loaded)
+
+	b.Set(key(2*100), []byte("changed"))
+	b.Set(key(2*3000+1), []byte("added"))
+	b.Remove(key(2 * 4000))
+	b.Set(key(2*4999), []byte("changed"))
+	diff, err = Diff(a, b)
+	assert.NoError(err)
+	assert.Equal(bruteForceDiff(a, b), diff)
+	assert.Equal([][]byte{key(2*3000 + 1)}, diff.Added)
+	assert.Equal([][]byte{key(2 * 4000)}, diff.Removed)
+	assert.Equal([][]byte{key(2 * 100), key(2 * 4999)}, diff.Changed)
+
+	// only the chunks of the changed keys, and their neighbours when they were split, are loaded
+	sideA, sideB = newDiffSide(a), newDiffSide(b)
+	assert.NoError(diffSides(sideA, sideB, func(DiffEntry) bool { return true }))
+	assert.LessOrEqual(sideA.loaded, 8)
+	assert.LessOrEqual(sideB.loaded, 8)
+
+	// the callbacks get the values and can stop the diff
+	var entries []DiffEntry
+	assert.NoError(DiffFunc(a, b, func(entry DiffEntry) bool {
+		entries = append(entries, entry)
+		return len(entries) < 2
+	}))
+	assert.Equal([]DiffEntry{
+		{Kind: DiffChanged, Key: key(2 * 100), OldValue: key(100), NewValue: []byte("changed")},
+		{Kind: DiffAdded, Key: key(2*3000 + 1), NewValue: []byte("added")},
+	}, entries)
+
+	// trees with different shapes
+	for i := 0; i < 500; i++ {
+		k := rand.Intn(12000)
+		if rand.Intn(3) == 0 {
+			b.Remove(key(k))
+		} else {
+			b.Set(key(k), key(rand.Intn(3)))
+		}
+	}
+	for _, trees := range [][2]*IAVL{{a, b}, {b, a}, {NewIAVL(16, 4), b}, {b, NewIAVL(16, 4)}} {
+		diff, err = Diff(trees[0], trees[1])
+		assert.NoError(err)
+		assert.Equal(bruteForceDiff(trees[0], trees[1]), diff)
+	}
+}
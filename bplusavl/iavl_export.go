@@ -0,0 +1,285 @@
+package bplusavl
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/tendermint/go-amino"
+)
+
+// ErrExportDone is returned by ExportSource.Next when all the nodes have been returned.
+var ErrExportDone = errors.New("export done")
+
+// ExportNode is a node of a Tendermint IAVL tree, as returned by the exporter of cosmos/iavl.
+// In an IAVL tree every leaf holds a single K-V pair (Height 0), and every inner node holds the smallest key
+// of its right subtree, no value, and its height (1 + the height of its highest child).
+// Nodes are exported in post-order: left subtree, right subtree, then the node itself. Hence the leaves come
+// in ascending key order, and the last node is the root.
+type ExportNode struct {
+	Key     []byte
+	Value   []byte
+	Version int64
+	Height  int8
+}
+
+// ExportSource is a stream of IAVL export nodes, like the exporter of cosmos/iavl.
+// Next returns ErrExportDone after the last node.
+type ExportSource interface {
+	Next() (*ExportNode, error)
+}
+
+// ImportIAVL bulk loads a tree from the export of a Tendermint IAVL tree. The structure of the exported tree is
+// checked (keys sorted, inner keys and heights consistent, a single root), but the IAVL hashes are not computed:
+// the two trees have different hashes. Versions are ignored: the tree holds the K-V pairs of the exported version.
+// The leaves are filled to the chunk size (or the target size, see WithChunkBytes) and the tree is
+// perfectly balanced. The options are applied to the returned tree as in NewIAVL.
+func ImportIAVL(source ExportSource, chunkSize, keySize int32, options ...TreeOption) (*IAVL, error) {
+	template := NewIAVL(chunkSize, keySize, options...)
+	if !template.validParameters() {
+		return nil, ErrInvalidParameters
+	}
+
+	// subtrees waiting for their parent: their height and smallest key
+	type subtree struct {
+		height int8
+		key    []byte
+	}
+	var stack []subtree
+	var leaves []*Node
+	var leaf *Node
+	var lastKey []byte
+	for {
+		node, err := source.Next()
+		if err == ErrExportDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if node.Height > 0 {
+			if len(stack) < 2 {
+				return nil, errors.Wrapf(ErrInvalidTree, "inner node %x without children", node.Key)
+			}
+			left, right := stack[len(stack)-2], stack[len(stack)-1]
+			if !bytes.Equal(node.Key, right.key) || node.Height != maxHeight(left.height, right.height)+1 {
+				return nil, errors.Wrapf(ErrInvalidTree, "inner node %x does not match its children", node.Key)
+			}
+			stack = append(stack[:len(stack)-2], subtree{node.Height, left.key})
+			continue
+		}
+
+		if node.Value == nil {
+			return nil, errors.Wrapf(ErrNilValue, "at key %x", node.Key)
+		}
+		if lastKey != nil && bytes.Compare(node.Key, lastKey) != 1 {
+			return nil, errors.Wrapf(ErrInvalidTree, "key %x is not sorted", node.Key)
+		}
+		if leaf == nil || !leaf.chunk.HasRoomFor(node.Value) {
+			leaf = &Node{chunk: template.newChunk(), leafID: uint32(len(leaves))}
+			leaves = append(leaves, leaf)
+		}
+		if err = leaf.chunk.Insert(node.Key, node.Value); err != nil {
+			return nil, errors.Wrapf(err, "at key %x", node.Key)
+		}
+		leaf.size++
+		lastKey = node.Key
+		stack = append(stack, subtree{0, node.Key})
+	}
+	if len(stack) > 1 {
+		return nil, errors.Wrapf(ErrInvalidTree, "%d subtrees without a root", len(stack))
+	}
+	if len(leaves) == 0 {
+		return template, nil
+	}
+
+	setBalancedKeyHeights(leaves)
+	tree, err := RebuildTree(leaves, options...)
+	if err != nil {
+		return nil, err
+	}
+	tree.CompleteRehash()
+	return tree, nil
+}
+
+// setBalancedKeyHeights sets the keyHeights of the leaves, sorted by key, so that RebuildTree
+// builds a perfectly balanced tree from them.
+func setBalancedKeyHeights(leaves []*Node) uint8 {
+	if len(leaves) == 1 {
+		return 0
+	}
+	mid := len(leaves) / 2
+	height := maxInt8(setBalancedKeyHeights(leaves[:mid]), setBalancedKeyHeights(leaves[mid:])) + 1
+	// the first leaf of the right half provides the key of the node
+	leaves[mid].keyHeight = height
+	return height
+}
+
+func maxHeight(a, b int8) int8 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Exporter exports a tree as a Tendermint IAVL tree holding the same K-V pairs, so that it can be imported by
+// cosmos/iavl. The exported IAVL tree is perfectly balanced, every node has the same version, and its leaves
+// come in ascending key order. The tree must not be modified while it is exported.
+type Exporter struct {
+	tree     *IAVL
+	iterator *Iterator
+	version  int64
+	stack    []exportFrame
+}
+
+// exportFrame is a subtree of the exported tree, covering the K-V pairs in [lo, hi), being exported.
+type exportFrame struct {
+	lo, hi      int
+	stage       int // 0: export the left subtree, 1: export the right subtree, 2: export the node
+	leftHeight  int8
+	leftKey     []byte // smallest key of the left subtree
+	rightHeight int8
+	rightKey    []byte // smallest key of the right subtree
+}
+
+// ExportIAVL returns an exporter of the tree in the format of the cosmos/iavl exporter (see ExportNode),
+// with every node at the given version.
+func (tree *IAVL) ExportIAVL(version int64) *Exporter {
+	exporter := &Exporter{tree: tree, iterator: tree.Iterate(nil, nil), version: version}
+	if tree.root != nil {
+		exporter.stack = []exportFrame{{lo: 0, hi: int(tree.root.size)}}
+	}
+	return exporter
+}
+
+// Next returns the next node in post-order, or ErrExportDone after the root.
+func (exporter *Exporter) Next() (*ExportNode, error) {
+	for len(exporter.stack) > 0 {
+		frame := &exporter.stack[len(exporter.stack)-1]
+		if frame.hi-frame.lo == 1 {
+			if !exporter.iterator.Valid() {
+				if err := exporter.iterator.Err(); err != nil {
+					return nil, err
+				}
+				return nil, errors.New("the tree was modified during the export")
+			}
+			node := &ExportNode{
+				Key:     exporter.iterator.Key(),
+				Value:   exporter.iterator.Value(),
+				Version: exporter.version,
+			}
+			exporter.iterator.Next()
+			exporter.pop(0, node.Key)
+			return node, nil
+		}
+
+		mid := frame.lo + (frame.hi-frame.lo)/2
+		switch frame.stage {
+		case 0:
+			frame.stage = 1
+			exporter.stack = append(exporter.stack, exportFrame{lo: frame.lo, hi: mid})
+		case 1:
+			frame.stage = 2
+			exporter.stack = append(exporter.stack, exportFrame{lo: mid, hi: frame.hi})
+		default:
+			node := &ExportNode{
+				Key:     frame.rightKey,
+				Version: exporter.version,
+				Height:  maxHeight(frame.leftHeight, frame.rightHeight) + 1,
+			}
+			exporter.pop(node.Height, frame.leftKey)
+			return node, nil
+		}
+	}
+	return nil, ErrExportDone
+}
+
+// pop removes the exported subtree on top of the stack and passes its height and smallest key to its parent.
+func (exporter *Exporter) pop(height int8, key []byte) {
+	exporter.stack = exporter.stack[:len(exporter.stack)-1]
+	if len(exporter.stack) == 0 {
+		return
+	}
+	parent := &exporter.stack[len(exporter.stack)-1]
+	if parent.stage == 1 {
+		parent.leftHeight, parent.leftKey = height, key
+	} else {
+		parent.rightHeight, parent.rightKey = height, key
+	}
+}
+
+// WriteExport writes all the nodes of source to buffer. Each node is encoded as its height, key, value
+// (as amino byte slices) and version. The stream can be read back by NewExportReader.
+func WriteExport(buffer io.Writer, source ExportSource) error {
+	for {
+		node, err := source.Next()
+		if err == ErrExportDone {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = amino.EncodeInt8(buffer, node.Height)
+		if err != nil {
+			return errors.Wrap(err, "while encoding height")
+		}
+		err = amino.EncodeByteSlice(buffer, node.Key)
+		if err != nil {
+			return errors.Wrap(err, "while encoding key")
+		}
+		err = amino.EncodeByteSlice(buffer, node.Value)
+		if err != nil {
+			return errors.Wrap(err, "while encoding value")
+		}
+		err = amino.EncodeVarint(buffer, node.Version)
+		if err != nil {
+			return errors.Wrap(err, "while encoding version")
+		}
+	}
+}
+
+// ExportReader reads the nodes written by WriteExport.
+type ExportReader struct {
+	buffer []byte
+}
+
+// NewExportReader returns an ExportSource reading the nodes written by WriteExport in buffer.
+func NewExportReader(buffer []byte) *ExportReader {
+	return &ExportReader{buffer: buffer}
+}
+
+// Next decodes the next node, or returns ErrExportDone at the end of the buffer.
+func (reader *ExportReader) Next() (*ExportNode, error) {
+	if len(reader.buffer) == 0 {
+		return nil, ErrExportDone
+	}
+	node := &ExportNode{}
+	var j int
+	var err error
+	node.Height, j, err = amino.DecodeInt8(reader.buffer)
+	if err != nil {
+		return nil, errors.Wrap(err, "while decoding height")
+	}
+	reader.buffer = reader.buffer[j:]
+	node.Key, j, err = amino.DecodeByteSlice(reader.buffer)
+	if err != nil {
+		return nil, errors.Wrap(err, "while decoding key")
+	}
+	reader.buffer = reader.buffer[j:]
+	node.Value, j, err = amino.DecodeByteSlice(reader.buffer)
+	if err != nil {
+		return nil, errors.Wrap(err, "while decoding value")
+	}
+	reader.buffer = reader.buffer[j:]
+	node.Version, j, err = amino.DecodeVarint(reader.buffer)
+	if err != nil {
+		return nil, errors.Wrap(err, "while decoding version")
+	}
+	reader.buffer = reader.buffer[j:]
+	if node.Height == 0 && node.Value == nil {
+		// amino decodes empty slices as nil: leaves always have a value
+		node.Value = []byte{}
+	}
+	return node, nil
+}
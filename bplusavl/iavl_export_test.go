@@ -0,0 +1,219 @@
+package bplusavl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// avlNode is a node of a Tendermint IAVL tree, reproduced to test the conversion:
+// leaves hold one K-V pair, inner nodes hold the smallest key of their right subtree.
+type avlNode struct {
+	key, value  []byte
+	version     int64
+	height      int8
+	left, right *avlNode
+}
+
+func (node *avlNode) set(key, value []byte, version int64) *avlNode {
+	if node == nil {
+		return &avlNode{key: key, value: value, version: version}
+	}
+	if node.height == 0 {
+		switch bytes.Compare(key, node.key) {
+		case -1:
+			return &avlNode{key: node.key, version: version, height: 1, left: &avlNode{key: key, value: value, version: version}, right: node}
+		case 1:
+			return &avlNode{key: key, version: version, height: 1, left: node, right: &avlNode{key: key, value: value, version: version}}
+		}
+		return &avlNode{key: key, value: value, version: version}
+	}
+	if bytes.Compare(key, node.key) == -1 {
+		node.left = node.left.set(key, value, version)
+	} else {
+		node.right = node.right.set(key, value, version)
+	}
+	node.update()
+	switch balance := node.left.height - node.right.height; {
+	case balance > 1:
+		if node.left.left.height < node.left.right.height {
+			node.left = node.left.rotateLeft()
+		}
+		return node.rotateRight()
+	case balance < -1:
+		if node.right.right.height < node.right.left.height {
+			node.right = node.right.rotateRight()
+		}
+		return node.rotateLeft()
+	}
+	return node
+}
+
+func (node *avlNode) update() {
+	node.height = maxHeight(node.left.height, node.right.height) + 1
+}
+
+func (node *avlNode) rotateRight() *avlNode {
+	root := node.left
+	node.left, root.right = root.right, node
+	node.update()
+	root.update()
+	return root
+}
+
+func (node *avlNode) rotateLeft() *avlNode {
+	root := node.right
+	node.right, root.left = root.left, node
+	node.update()
+	root.update()
+	return root
+}
+
+// avlExporter exports a Tendermint IAVL tree in post-order, like the exporter of cosmos/iavl.
+type avlExporter struct {
+	nodes []*ExportNode
+}
+
+func newAVLExporter(root *avlNode) *avlExporter {
+	exporter := &avlExporter{}
+	var visit func(node *avlNode)
+	visit = func(node *avlNode) {
+		if node == nil {
+			return
+		}
+		visit(node.left)
+		visit(node.right)
+		exporter.nodes = append(exporter.nodes, &ExportNode{node.key, node.value, node.version, node.height})
+	}
+	visit(root)
+	return exporter
+}
+
+func (exporter *avlExporter) Next() (*ExportNode, error) {
+	if len(exporter.nodes) == 0 {
+		return nil, ErrExportDone
+	}
+	node := exporter.nodes[0]
+	exporter.nodes = exporter.nodes[1:]
+	return node, nil
+}
+
+// importAVL rebuilds a Tendermint IAVL tree from an export, checking that it is a valid AVL tree.
+func importAVL(t *testing.T, source ExportSource) *avlNode {
+	var stack []*avlNode
+	for {
+		node, err := source.Next()
+		if err == ErrExportDone {
+			break
+		}
+		assert.NoError(t, err)
+		avl := &avlNode{key: node.Key, value: node.Value, version: node.Version, height: node.Height}
+		if node.Height > 0 {
+			avl.left, avl.right = stack[len(stack)-2], stack[len(stack)-1]
+			stack = stack[:len(stack)-2]
+			assert.Equal(t, avl.right.smallest().key, avl.key)
+			assert.Equal(t, maxHeight(avl.left.height, avl.right.height)+1, avl.height)
+			balance := avl.left.height - avl.right.height
+			assert.True(t, balance >= -1 && balance <= 1)
+		}
+		stack = append(stack, avl)
+	}
+	assert.LessOrEqual(t, len(stack), 1)
+	if len(stack) == 0 {
+		return nil
+	}
+	return stack[0]
+}
+
+func (node *avlNode) smallest() *avlNode {
+	for node.height > 0 {
+		node = node.left
+	}
+	return node
+}
+
+func (node *avlNode) entries(keys, values [][]byte) ([][]byte, [][]byte) {
+	if node == nil {
+		return keys, values
+	}
+	if node.height == 0 {
+		return append(keys, node.key), append(values, node.value)
+	}
+	keys, values = node.left.entries(keys, values)
+	return node.right.entries(keys, values)
+}
+
+func treeEntries(tree *IAVL) (keys, values [][]byte) {
+	for it := tree.Iterate(nil, nil); it.Valid(); it.Next() {
+		keys, values = append(keys, it.Key()), append(values, it.Value())
+	}
+	return keys, values
+}
+
+func TestImportExportIAVL(t *testing.T) {
+	assert := assert.New(t)
+	var avl *avlNode
+	for i, k := range rand.Perm(3000) {
+		key := make([]byte, 4)
+		binary.BigEndian.PutUint32(key, uint32(k))
+		avl = avl.set(key, bytes.Repeat(key, k%3), int64(1+i/100))
+	}
+	avlKeys, avlValues := avl.entries(nil, nil)
+
+	// through the encoded stream
+	var buffer bytes.Buffer
+	assert.NoError(WriteExport(&buffer, newAVLExporter(avl)))
+	tree, err := ImportIAVL(NewExportReader(buffer.Bytes()), 16, 4)
+	assert.NoError(err)
+	assert.NoError(tree.Verify())
+	keys, values := treeEntries(tree)
+	assert.Equal(avlKeys, keys)
+	assert.Equal(avlValues, values)
+	stats := tree.Stats()
+	assert.Equal((3000+15)/16, stats.Chunks)
+
+	// the tree stays writable after a bulk load
+	_, err = tree.Set([]byte{0, 0, 0, 1}, []byte("new"))
+	assert.NoError(err)
+	assert.NoError(tree.Verify())
+
+	// and back to an IAVL tree
+	exported := importAVL(t, tree.ExportIAVL(7))
+	keys, values = exported.entries(nil, nil)
+	treeKeys, treeValues := treeEntries(tree)
+	assert.Equal(treeKeys, keys)
+	assert.Equal(treeValues, values)
+	assert.Equal(int64(7), exported.version)
+
+	// empty trees
+	empty, err := ImportIAVL(newAVLExporter(nil), 16, 4)
+	assert.NoError(err)
+	assert.Equal(EmptyRootHash(), empty.GetRootHash())
+	assert.Nil(importAVL(t, empty.ExportIAVL(1)))
+}
+
+func TestImportIAVLInvalid(t *testing.T) {
+	assert := assert.New(t)
+	leaf := func(k byte) *ExportNode { return &ExportNode{Key: []byte{k}, Value: []byte{k}, Height: 0} }
+	inner := func(k byte, height int8) *ExportNode { return &ExportNode{Key: []byte{k}, Height: height} }
+
+	for _, nodes := range [][]*ExportNode{
+		{leaf(2), leaf(1), inner(1, 1)},          // unsorted
+		{leaf(1), leaf(2), inner(1, 1)},          // wrong inner key
+		{leaf(1), leaf(2), inner(2, 2)},          // wrong height
+		{leaf(1), inner(1, 1)},                   // missing child
+		{leaf(1), leaf(2)},                       // missing root
+		{leaf(1), {Key: []byte{2}}, inner(2, 1)}, // nil value
+	} {
+		_, err := ImportIAVL(&avlExporter{nodes: nodes}, 4, 1)
+		assert.Error(err)
+	}
+	_, err := ImportIAVL(&avlExporter{nodes: []*ExportNode{leaf(1), leaf(2), inner(2, 1)}}, 4, 1)
+	assert.NoError(err)
+	_, err = ImportIAVL(&avlExporter{nodes: []*ExportNode{leaf(1)}}, 4, 2)
+	assert.True(errors.Is(err, ErrInvalidKeySize))
+}
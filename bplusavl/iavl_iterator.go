@@ -0,0 +1,133 @@
+package bplusavl
+
+import (
+	hchunk "bplus/chunk"
+	"bytes"
+)
+
+// Iterator iterates over the K-V pairs of a tree in ascending key order, following the leaf chain.
+// It must not be used after the tree is modified.
+//
+//	for it := tree.IteratePrefix(prefix); it.Valid(); it.Next() {
+//		use(it.Key(), it.Value())
+//	}
+type Iterator struct {
+	leaf  *Node
+	chunk *hchunk.HeapChunk // the chunk of leaf
+	index int32
+	end   []byte // exclusive upper bound, nil if unbounded
+	err   error  // the error that ended the iteration, see Iterator.Err
+}
+
+// Iterate returns an iterator over the keys in the range [start, end).
+// A nil start or end means that the range is unbounded on that side.
+func (tree *IAVL) Iterate(start, end []byte) *Iterator {
+	it := &Iterator{end: end}
+	if tree.root == nil {
+		return it
+	}
+	if start == nil {
+		it.setLeaf(tree.firstLeaf)
+	} else {
+		it.setLeaf(tree.root.getLeaf(start))
+		if it.leaf != nil {
+			it.index = it.chunk.SearchKey(start)
+		}
+	}
+	it.skipExhaustedLeaf()
+	return it
+}
+
+// IteratePrefix returns an iterator over all the keys starting with prefix.
+func (tree *IAVL) IteratePrefix(prefix []byte) *Iterator {
+	return tree.Iterate(prefix, prefixEnd(prefix))
+}
+
+// Valid returns false once the iterator has gone past the last key in its range.
+// It also returns false once a leaf could not be loaded (see Iterator.Err).
+func (it *Iterator) Valid() bool {
+	if it.leaf == nil {
+		return false
+	}
+	if it.end != nil && bytes.Compare(it.chunk.GetKeyAt(it.index), it.end) != -1 {
+		it.leaf = nil
+		return false
+	}
+	return true
+}
+
+// Next moves the iterator to the next key.
+func (it *Iterator) Next() {
+	it.index++
+	it.skipExhaustedLeaf()
+}
+
+// Key returns a copy of the current key.
+func (it *Iterator) Key() []byte {
+	return it.chunk.GetKeyAt(it.index)
+}
+
+// Value returns a copy of the current value.
+func (it *Iterator) Value() []byte {
+	return copyBytes(it.ValueUnsafe())
+}
+
+// ValueUnsafe returns the current value without copying it.
+// Careful: the returned value is NOT a copy. Modifying it, causes side effects.
+func (it *Iterator) ValueUnsafe() []byte {
+	return it.chunk.GetValueAt(it.index)
+}
+
+// Err returns the error met while loading a leaf of a memory-bounded tree (see WithLeafStore), which ended
+// the iteration, or nil if the iteration was not ended by an error.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// setLeaf moves the iterator to the first K-V pair of the leaf. If the chunk of the leaf cannot be loaded,
+// the iteration ends with the error.
+func (it *Iterator) setLeaf(leaf *Node) {
+	it.leaf, it.chunk, it.index = nil, nil, 0
+	if leaf == nil {
+		return
+	}
+	chunk, err := leaf.getChunk()
+	if err != nil {
+		it.err = err
+		return
+	}
+	it.leaf, it.chunk = leaf, chunk
+}
+
+// skipExhaustedLeaf moves the iterator to the following leaf when all keys of the current one were visited.
+func (it *Iterator) skipExhaustedLeaf() {
+	for it.leaf != nil && it.index >= it.chunk.GetCurrSize() {
+		it.setLeaf(it.leaf.nextLeaf)
+	}
+}
+
+// getLeaf returns the leaf where the given key is (or would be) stored.
+func (node *Node) getLeaf(key []byte) *Node {
+	for !node.isLeaf() {
+		if bytes.Compare(key, node.key) == -1 {
+			node = node.leftNode
+		} else {
+			node = node.rightNode
+		}
+	}
+	return node
+}
+
+// prefixEnd returns the smallest key that is larger than every key starting with prefix.
+// It returns nil if there is no such key (eg. the prefix is empty or only made of 0xFF bytes).
+func prefixEnd(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
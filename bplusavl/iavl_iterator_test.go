@@ -0,0 +1,112 @@
+package bplusavl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIterate(t *testing.T) {
+	assert := assert.New(t)
+	tree := NewIAVL(int32(8), int32(4))
+	assert.False(tree.Iterate(nil, nil).Valid())
+
+	size := 2000
+	rand.Seed(time.Now().UnixNano())
+	x := rand.Perm(size)
+	for _, elem := range x {
+		num := make([]byte, 4)
+		binary.BigEndian.PutUint32(num, uint32(elem*2)) // only even keys
+		tree.Set(num, num)
+	}
+
+	// full iteration
+	count := 0
+	for it := tree.Iterate(nil, nil); it.Valid(); it.Next() {
+		assert.Equal(uint32(count*2), binary.BigEndian.Uint32(it.Key()))
+		assert.True(bytes.Equal(it.Key(), it.Value()))
+		count++
+	}
+	assert.Equal(size, count)
+
+	// iteration on a range with bounds that are not in the tree
+	start := binary.BigEndian.AppendUint32(nil, 101)
+	end := binary.BigEndian.AppendUint32(nil, 301)
+	count = 0
+	for it := tree.Iterate(start, end); it.Valid(); it.Next() {
+		assert.Equal(uint32(102+count*2), binary.BigEndian.Uint32(it.Key()))
+		count++
+	}
+	assert.Equal(100, count)
+
+	// iteration past the last key
+	assert.False(tree.Iterate(binary.BigEndian.AppendUint32(nil, uint32(size*2)), nil).Valid())
+}
+
+func TestIteratePrefix(t *testing.T) {
+	assert := assert.New(t)
+	tree := NewIAVL(int32(4), int32(3))
+	keys := []string{"aaa", "aab", "abc", "abd", "abz", "acc", "bcd", "bdd", "xyz", "zzz"}
+	for _, k := range rand.Perm(len(keys)) {
+		tree.Set([]byte(keys[k]), []byte(keys[k]))
+	}
+
+	collect := func(prefix string) []string {
+		var found []string
+		for it := tree.IteratePrefix([]byte(prefix)); it.Valid(); it.Next() {
+			found = append(found, string(it.Key()))
+		}
+		return found
+	}
+	assert.Equal([]string{"abc", "abd", "abz"}, collect("ab"))
+	assert.Equal([]string{"bcd", "bdd"}, collect("b"))
+	assert.Equal([]string{"zzz"}, collect("z"))
+	assert.Equal(keys, collect(""))
+	assert.Nil(collect("c"))
+	assert.Nil(collect("abe"))
+}
+
+func TestPrefixEnd(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal([]byte{1, 3}, prefixEnd([]byte{1, 2}))
+	assert.Equal([]byte{2}, prefixEnd([]byte{1, 0xFF}))
+	assert.Nil(prefixEnd([]byte{0xFF, 0xFF}))
+	assert.Nil(prefixEnd(nil))
+}
+
+func TestWalkLeavesBothDirections(t *testing.T) {
+	assert := assert.New(t)
+	tree := NewIAVL(int32(4), int32(4))
+	for _, elem := range rand.Perm(500) {
+		num := make([]byte, 4)
+		binary.BigEndian.PutUint32(num, uint32(elem))
+		tree.Set(num, num)
+	}
+	assert.Nil(tree.Verify())
+
+	n := tree.GetNumberOfChunks()
+	last := tree.GetChunk(n - 1)
+	assert.Nil(last.Next())
+	assert.Nil(tree.GetChunk(0).Prev())
+
+	i := n - 1
+	for leaf := last; leaf != nil; leaf = leaf.Prev() {
+		assert.Equal(tree.GetChunk(i), leaf)
+		i--
+	}
+	assert.Equal(-1, i)
+
+	var leafList []*Node
+	for leaf := tree.GetChunk(0); leaf != nil; leaf = leaf.Next() {
+		leafList = append(leafList, leaf)
+	}
+	assert.Equal(n, len(leafList))
+	rebuiltTree, err := RebuildTree(leafList)
+	assert.NoError(err)
+	rebuiltTree.CompleteRehash()
+	assert.Nil(rebuiltTree.Verify())
+}
@@ -0,0 +1,215 @@
+package bplusavl
+
+import (
+	"bytes"
+	"container/list"
+
+	"github.com/pkg/errors"
+)
+
+// LeafStore stores the leaves of a memory-bounded tree (see WithLeafStore). Leaves are written by IAVL.Commit
+// and read back, serialized with Node.Serialize, when an evicted leaf is accessed.
+type LeafStore interface {
+	LeafSink
+	// ReadLeaf returns the leaf last written with the given ID.
+	ReadLeaf(leafID uint32) ([]byte, error)
+}
+
+// leafCache keeps the chunks of a memory-bounded tree in memory, evicting the least recently used ones
+// when their total serialized size exceeds the budget.
+// Only clean leaves (committed to the store, with a valid hash) are evicted: an evicted leaf keeps
+// its ID and its hash, so that the hashes of the tree and the proofs of other leaves are not affected.
+type leafCache struct {
+	tree   *IAVL
+	store  LeafStore
+	budget int
+	bytes  int        // serialized size of the resident chunks, measured when they were last accessed
+	lru    *list.List // resident leaves, the most recently used first
+	holds  int        // while positive, a mutation is in progress and nothing is evicted
+	err    error      // the last error met while loading a leaf, see IAVL.Err
+}
+
+// cacheEntry is a resident leaf in the cache.
+type cacheEntry struct {
+	leaf  *Node
+	bytes int
+}
+
+// WithLeafStore makes the tree memory-bounded: leaves that have been committed to store (see IAVL.Commit)
+// are evicted from memory when the chunks in memory take more than budgetBytes (measured by their serialized
+// size), the least recently used first. Evicted leaves only keep their ID and hash. Get, Set, Remove, proofs
+// and iteration transparently load them back from store.
+// Leaves modified since the last commit are never evicted: commit regularly, and always to store.
+// The leaves given to RebuildTree (or ImportSnapshot) with this option must already be in store.
+// A leaf that cannot be read from store, or that does not match its hash, is not loaded: the methods with
+// an error result return the error, the others return zero values and the error is reported by IAVL.Err
+// (Iterator.Err for iterators).
+// Set and Remove leave the tree unchanged when a leaf cannot be loaded.
+func WithLeafStore(store LeafStore, budgetBytes int) TreeOption {
+	return func(tree *IAVL) {
+		tree.cache = &leafCache{tree: tree, store: store, budget: budgetBytes, lru: list.New()}
+	}
+}
+
+// ResidentLeaves returns the number of leaves whose chunk is in memory and their serialized size.
+// All leaves are resident unless the tree has a leaf store (see WithLeafStore).
+func (tree *IAVL) ResidentLeaves() (leaves int, bytes int) {
+	if tree.cache == nil {
+		for i := 0; i < tree.chunkList.GetNumberOfChunks(); i++ {
+			bytes += tree.chunkList.GetChunk(i).chunk.SerializedSize()
+		}
+		return tree.chunkList.GetNumberOfChunks(), bytes
+	}
+	return tree.cache.lru.Len(), tree.cache.bytes
+}
+
+// Err returns the last error met while loading an evicted leaf from the leaf store (see WithLeafStore),
+// or nil if every leaf could be loaded. Methods without an error result, such as Get and the lookups,
+// return zero values when a leaf cannot be loaded: check Err to tell a failure from a missing key.
+// Iterators report the error that ended them with Iterator.Err.
+func (tree *IAVL) Err() error {
+	if tree.cache == nil {
+		return nil
+	}
+	return tree.cache.err
+}
+
+// add makes the leaf, whose chunk is in memory, managed by the cache.
+func (cache *leafCache) add(leaf *Node) {
+	if cache == nil {
+		return
+	}
+	leaf.cache = cache
+	entry := &cacheEntry{leaf: leaf, bytes: leaf.chunk.SerializedSize()}
+	leaf.cacheElement = cache.lru.PushFront(entry)
+	cache.bytes += entry.bytes
+}
+
+// remove stops managing a leaf removed from the tree.
+func (cache *leafCache) remove(leaf *Node) {
+	if cache == nil || leaf.cacheElement == nil {
+		return
+	}
+	cache.bytes -= cache.lru.Remove(leaf.cacheElement).(*cacheEntry).bytes
+	leaf.cacheElement = nil
+}
+
+// access marks the leaf as the most recently used, loading it if it was evicted.
+func (cache *leafCache) access(leaf *Node) error {
+	if leaf.cacheElement == nil {
+		return cache.load(leaf)
+	}
+	entry := leaf.cacheElement.Value.(*cacheEntry)
+	size := leaf.chunk.SerializedSize()
+	cache.bytes += size - entry.bytes
+	entry.bytes = size
+	cache.lru.MoveToFront(leaf.cacheElement)
+	return nil
+}
+
+// load reads an evicted leaf from the store and checks it against the chunk hash kept by the leaf.
+// If the leaf cannot be loaded, it stays evicted and the error is returned, and recorded for IAVL.Err.
+func (cache *leafCache) load(leaf *Node) error {
+	stored, err := cache.read(leaf)
+	if err != nil {
+		cache.err = errors.Wrapf(err, "while loading leaf %d", leaf.leafID)
+		return cache.err
+	}
+	leaf.chunk = stored.chunk
+	leaf.smallestKey, leaf.chunkHash = nil, nil
+	if cache.tree.chunkBytes > 0 {
+		leaf.chunk.SetTargetBytes(cache.tree.chunkBytes)
+	}
+	// the inner node providing the key of the leaf shares the chunk memory again
+	key := leaf.chunk.GetSmallestKeyUnsafe()
+	if owner := cache.tree.keyNodeOf(leaf, key); owner != nil {
+		owner.key = key
+	}
+	cache.add(leaf)
+	if cache.holds == 0 {
+		cache.shrink()
+	}
+	return nil
+}
+
+// read reads an evicted leaf from the store.
+func (cache *leafCache) read(leaf *Node) (*Node, error) {
+	data, err := cache.store.ReadLeaf(leaf.leafID)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := Deserialize(data, cache.tree.chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	// the key height, hence the hash, of the leaf may have changed since it was evicted, not its chunk
+	if stored.leafID != leaf.leafID || !bytes.Equal(stored.chunk.GetHash(), leaf.chunkHash) {
+		return nil, ErrLeafHashMismatch
+	}
+	return stored, nil
+}
+
+// evict drops the chunk of a clean leaf.
+func (cache *leafCache) evict(leaf *Node) {
+	// the inner node providing the key of the leaf must not keep the chunk memory alive.
+	// The leaf keeps a copy of the key and of the chunk hash, so that the chunk list can be searched
+	// and the hash of the leaf recomputed after a rotation without loading the chunk
+	leaf.smallestKey = copyBytes(leaf.chunk.GetSmallestKeyUnsafe())
+	leaf.chunkHash = leaf.chunk.GetHash()
+	if owner := cache.tree.keyNodeOf(leaf, leaf.smallestKey); owner != nil {
+		owner.key = leaf.smallestKey
+	}
+	cache.remove(leaf)
+	leaf.chunk = nil
+}
+
+// shrink evicts the least recently used clean leaves until the resident chunks fit the budget.
+// The most recently used leaf is never evicted.
+func (cache *leafCache) shrink() {
+	if cache == nil {
+		return
+	}
+	element := cache.lru.Back()
+	for cache.bytes > cache.budget && element != nil && element != cache.lru.Front() {
+		previous := element.Prev()
+		leaf := element.Value.(*cacheEntry).leaf
+		if _, dirty := cache.tree.dirtyLeaves[leaf.leafID]; !dirty && leaf.hashIsValid {
+			cache.evict(leaf)
+		}
+		element = previous
+	}
+}
+
+// hold prevents evictions until the matching release, while the tree is being modified:
+// the chunks of the modified leaves must stay in memory until they are committed.
+func (cache *leafCache) hold() {
+	if cache != nil {
+		cache.holds++
+	}
+}
+
+func (cache *leafCache) release() {
+	if cache == nil {
+		return
+	}
+	cache.holds--
+	if cache.holds == 0 {
+		cache.shrink()
+	}
+}
+
+// keyNodeOf returns the inner node whose key is the smallest key of the leaf, or nil for the left-most leaf.
+func (tree *IAVL) keyNodeOf(leaf *Node, key []byte) *Node {
+	node := tree.root
+	for node != nil && !node.isLeaf() {
+		if node.leafPointer == leaf {
+			return node
+		}
+		if bytes.Compare(key, node.key) == -1 {
+			node = node.leftNode
+		} else {
+			node = node.rightNode
+		}
+	}
+	return nil
+}
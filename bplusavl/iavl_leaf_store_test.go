@@ -0,0 +1,171 @@
+package bplusavl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func (sink *mapSink) ReadLeaf(leafID uint32) ([]byte, error) {
+	data, ok := sink.leaves[leafID]
+	if !ok {
+		return nil, errors.Errorf("leaf %d not found", leafID)
+	}
+	sink.reads++
+	return data, nil
+}
+
+func TestLeafStore(t *testing.T) {
+	assert := assert.New(t)
+	store := &mapSink{leaves: make(map[uint32][]byte)}
+	const budget = 1024
+	tree := NewIAVL(8, 2, WithLeafStore(store, budget))
+	reference := NewIAVL(8, 2)
+
+	key := func(k int) []byte {
+		b := make([]byte, 2)
+		binary.BigEndian.PutUint16(b, uint16(k))
+		return b
+	}
+	for i := 0; i < 40; i++ {
+		for j := 0; j < 50; j++ {
+			k := key(rand.Intn(2000))
+			if rand.Intn(4) == 0 {
+				tree.Remove(k)
+				reference.Remove(k)
+			} else {
+				value := bytes.Repeat(k, 1+rand.Intn(4))
+				tree.Set(k, value)
+				reference.Set(k, value)
+			}
+		}
+		assert.Equal(reference.GetRootHash(), tree.GetRootHash())
+		assert.NoError(tree.Commit(store))
+
+		// only the most recently used leaf may exceed the budget
+		_, residentBytes := tree.ResidentLeaves()
+		assert.LessOrEqual(residentBytes, budget+1024)
+	}
+	leaves, _ := tree.ResidentLeaves()
+	assert.Less(leaves, tree.GetNumberOfChunks())
+
+	// reads fault the evicted leaves in
+	reads := store.reads
+	for k := 0; k < 2000; k++ {
+		assert.Equal(reference.Get(key(k)), tree.Get(key(k)))
+	}
+	assert.Greater(store.reads, reads)
+
+	it, expected := tree.Iterate(nil, nil), reference.Iterate(nil, nil)
+	for ; expected.Valid(); expected.Next() {
+		assert.True(it.Valid())
+		assert.Equal(expected.Key(), it.Key())
+		assert.Equal(expected.Value(), it.Value())
+		it.Next()
+	}
+	assert.False(it.Valid())
+
+	for k := 0; k < 2000; k += 7 {
+		value := reference.Get(key(k))
+		if value == nil {
+			continue
+		}
+		proof, err := tree.GetElementProof(key(k))
+		assert.NoError(err)
+		assert.Equal(tree.GetRootHash(), proof.ValidateProof(key(k), value))
+	}
+	assert.NoError(tree.Verify())
+	leaves, _ = tree.ResidentLeaves()
+	assert.Less(leaves, tree.GetNumberOfChunks())
+}
+
+func TestLeafStoreRebuild(t *testing.T) {
+	assert := assert.New(t)
+	store := &mapSink{leaves: make(map[uint32][]byte)}
+	tree := NewIAVL(4, 1)
+	for k := 0; k < 200; k++ {
+		tree.Set([]byte{byte(k)}, []byte{byte(k)})
+	}
+	assert.NoError(tree.Commit(store))
+
+	var list []*Node
+	for _, data := range store.leaves {
+		leaf, err := Deserialize(data, 4)
+		assert.NoError(err)
+		list = append(list, leaf)
+	}
+	SortNodeList(list)
+	rebuilt, err := RebuildTree(list, WithLeafStore(store, 0))
+	assert.NoError(err)
+	rebuilt.CompleteRehash()
+	assert.Equal(tree.GetRootHash(), rebuilt.GetRootHash())
+	leaves, _ := rebuilt.ResidentLeaves()
+	assert.Equal(1, leaves)
+
+	// the evicted leaves are loaded when modified, and kept until the next commit
+	for k := 0; k < 200; k += 10 {
+		_, err = rebuilt.Set([]byte{byte(k)}, []byte("updated"))
+		assert.NoError(err)
+		_, err = tree.Set([]byte{byte(k)}, []byte("updated"))
+		assert.NoError(err)
+	}
+	assert.Equal(tree.GetRootHash(), rebuilt.GetRootHash())
+	leaves, _ = rebuilt.ResidentLeaves()
+	assert.Equal(len(rebuilt.DirtyLeaves()), leaves)
+	assert.NoError(rebuilt.Commit(store))
+	leaves, _ = rebuilt.ResidentLeaves()
+	assert.Equal(1, leaves)
+	assert.Equal([]byte("updated"), rebuilt.Get([]byte{100}))
+
+	// splitting a leaf does not load the other leaves to find the position of the new leaf
+	reads := store.reads
+	_, err = rebuilt.Set([]byte{250}, []byte{250})
+	assert.NoError(err)
+	_, err = tree.Set([]byte{250}, []byte{250})
+	assert.NoError(err)
+	assert.Equal(tree.GetRootHash(), rebuilt.GetRootHash())
+	assert.Equal(reads+1, store.reads)
+	assert.NoError(rebuilt.Commit(store))
+
+	// a leaf that does not match its hash cannot be loaded, and the tree is left unchanged
+	for leafID, data := range store.leaves {
+		leaf, err := Deserialize(data, 4)
+		assert.NoError(err)
+		_, err = leaf.chunk.Update(leaf.chunk.GetSmallestKey(), []byte("tampered"))
+		assert.NoError(err)
+		var buffer bytes.Buffer
+		assert.NoError(leaf.Serialize(&buffer))
+		store.leaves[leafID] = buffer.Bytes()
+	}
+	rootHash := rebuilt.GetRootHash()
+	assert.Nil(rebuilt.Get([]byte{50}))
+	assert.True(errors.Is(rebuilt.Err(), ErrLeafHashMismatch))
+	_, err = rebuilt.Set([]byte{60}, []byte("updated"))
+	assert.True(errors.Is(err, ErrLeafHashMismatch))
+	_, _, err = rebuilt.Remove([]byte{70})
+	assert.True(errors.Is(err, ErrLeafHashMismatch))
+	_, err = rebuilt.GetElementProof([]byte{80})
+	assert.True(errors.Is(err, ErrLeafHashMismatch))
+	assert.True(errors.Is(rebuilt.Verify(), ErrLeafHashMismatch))
+	assert.Equal(rootHash, rebuilt.GetRootHash())
+	_, err = rebuilt.GetPrefixProof([]byte{90})
+	assert.True(errors.Is(err, ErrLeafHashMismatch))
+	assert.True(errors.Is(rebuilt.ExportSnapshot(&bytes.Buffer{}), ErrLeafHashMismatch))
+	_, err = Diff(rebuilt, NewIAVL(4, 1))
+	assert.True(errors.Is(err, ErrLeafHashMismatch))
+	key, value := rebuilt.Ceiling([]byte{110})
+	assert.Nil(key)
+	assert.Nil(value)
+	count := 0
+	it := rebuilt.Iterate(nil, nil)
+	for ; it.Valid(); it.Next() {
+		count++
+	}
+	assert.Less(count, 201)
+	assert.True(errors.Is(it.Err(), ErrLeafHashMismatch))
+	assert.NoError(tree.Iterate(nil, nil).Err())
+}
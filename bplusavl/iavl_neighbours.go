@@ -0,0 +1,81 @@
+package bplusavl
+
+import hchunk "bplus/chunk"
+
+// Neighbour lookups. The leaf that may contain the answer is found as in IAVL.Get, then the position is found
+// with a binary search in its chunk. When the answer is past the end of the chunk, it is the first key of the next leaf,
+// when it is before the start of the chunk, it is the last key of the previous leaf.
+// All functions return copies of the key and value, or nil for both if there is no such key
+// or if a leaf cannot be loaded (see IAVL.Err).
+
+// First returns the smallest key in the tree and its value.
+func (tree *IAVL) First() (key, value []byte) {
+	if tree.root == nil {
+		return nil, nil
+	}
+	return leafEntry(tree.firstLeaf, 0)
+}
+
+// Last returns the largest key in the tree and its value.
+func (tree *IAVL) Last() (key, value []byte) {
+	if tree.root == nil {
+		return nil, nil
+	}
+	leaf := tree.chunkList.GetChunk(tree.chunkList.GetNumberOfChunks() - 1)
+	return leafEntry(leaf, leaf.size-1)
+}
+
+// Floor returns the largest key smaller or equal to key, and its value.
+func (tree *IAVL) Floor(key []byte) ([]byte, []byte) {
+	return tree.neighbour(key, func(chunk *hchunk.HeapChunk) int32 { return chunk.SearchKeyAfter(key) - 1 })
+}
+
+// Lower returns the largest key strictly smaller than key, and its value.
+func (tree *IAVL) Lower(key []byte) ([]byte, []byte) {
+	return tree.neighbour(key, func(chunk *hchunk.HeapChunk) int32 { return chunk.SearchKey(key) - 1 })
+}
+
+// Ceiling returns the smallest key greater or equal to key, and its value.
+func (tree *IAVL) Ceiling(key []byte) ([]byte, []byte) {
+	return tree.neighbour(key, func(chunk *hchunk.HeapChunk) int32 { return chunk.SearchKey(key) })
+}
+
+// Higher returns the smallest key strictly greater than key, and its value.
+func (tree *IAVL) Higher(key []byte) ([]byte, []byte) {
+	return tree.neighbour(key, func(chunk *hchunk.HeapChunk) int32 { return chunk.SearchKeyAfter(key) })
+}
+
+// neighbour returns the entry found by leafEntry at the position given by the chunk of the leaf of key.
+func (tree *IAVL) neighbour(key []byte, position func(chunk *hchunk.HeapChunk) int32) ([]byte, []byte) {
+	if tree.root == nil {
+		return nil, nil
+	}
+	leaf := tree.root.getLeaf(key)
+	chunk, err := leaf.getChunk()
+	if err != nil {
+		return nil, nil
+	}
+	return leafEntry(leaf, position(chunk))
+}
+
+// leafEntry returns the i-th key in the leaf and its value. If i is past the end of the chunk,
+// the first key of the next leaf is returned, if i is negative the last key of the previous leaf is returned.
+// If there is no such key, or its leaf cannot be loaded, nil is returned for both.
+func leafEntry(leaf *Node, i int32) ([]byte, []byte) {
+	if i >= leaf.size {
+		leaf, i = leaf.nextLeaf, 0
+	} else if i < 0 {
+		leaf = leaf.prevLeaf
+		if leaf != nil {
+			i = leaf.size - 1
+		}
+	}
+	if leaf == nil {
+		return nil, nil
+	}
+	chunk, err := leaf.getChunk()
+	if err != nil {
+		return nil, nil
+	}
+	return chunk.GetKeyAt(i), copyBytes(chunk.GetValueAt(i))
+}
@@ -0,0 +1,77 @@
+package bplusavl
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNeighbours(t *testing.T) {
+	assert := assert.New(t)
+	tree := NewIAVL(int32(4), int32(4))
+
+	key, value := tree.First()
+	assert.Nil(key)
+	assert.Nil(value)
+	key, _ = tree.Floor([]byte{1, 2, 3, 4})
+	assert.Nil(key)
+
+	size := 1000
+	rand.Seed(time.Now().UnixNano())
+	for _, elem := range rand.Perm(size) {
+		num := make([]byte, 4)
+		binary.BigEndian.PutUint32(num, uint32(elem*10+10)) // keys 10, 20, ..., size*10
+		tree.Set(num, num)
+	}
+	toKey := func(i int) []byte { return binary.BigEndian.AppendUint32(nil, uint32(i)) }
+	toInt := func(key []byte) int {
+		if key == nil {
+			return -1
+		}
+		return int(binary.BigEndian.Uint32(key))
+	}
+
+	key, value = tree.First()
+	assert.Equal(10, toInt(key))
+	assert.Equal(key, value)
+	key, value = tree.Last()
+	assert.Equal(size*10, toInt(key))
+	assert.Equal(key, value)
+
+	for i := 0; i <= size*10+10; i++ {
+		expectedFloor, expectedLower := i/10*10, (i-1)/10*10
+		expectedCeiling, expectedHigher := (i+9)/10*10, (i+10)/10*10
+		if expectedFloor < 10 {
+			expectedFloor = -1
+		} else if expectedFloor > size*10 {
+			expectedFloor = size * 10
+		}
+		if i <= 10 {
+			expectedLower = -1
+		} else if expectedLower > size*10 {
+			expectedLower = size * 10
+		}
+		if expectedCeiling > size*10 {
+			expectedCeiling = -1
+		}
+		if expectedHigher > size*10 {
+			expectedHigher = -1
+		}
+		if i < 10 {
+			expectedCeiling, expectedHigher = 10, 10
+		}
+
+		key, value := tree.Floor(toKey(i))
+		assert.Equal(expectedFloor, toInt(key), "floor of %d", i)
+		assert.Equal(key, value)
+		key, _ = tree.Lower(toKey(i))
+		assert.Equal(expectedLower, toInt(key), "lower of %d", i)
+		key, _ = tree.Ceiling(toKey(i))
+		assert.Equal(expectedCeiling, toInt(key), "ceiling of %d", i)
+		key, _ = tree.Higher(toKey(i))
+		assert.Equal(expectedHigher, toInt(key), "higher of %d", i)
+	}
+}
@@ -0,0 +1,75 @@
+package bplusavl
+
+import "bytes"
+
+// Order-statistics queries. They descend the tree using the size of the inner nodes
+// and then index the keys inside the chunk, so they do not need to scan the leaves.
+// Note that the sizes are not part of the hashes, hence positions cannot be proven with a IAVLElementProof.
+
+// GetByIndex returns the i-th smallest key and its value, with i starting from 0.
+// If i is out of range, or the leaf of the key cannot be loaded (see IAVL.Err), nil is returned for both.
+func (tree *IAVL) GetByIndex(i int) (key, value []byte) {
+	if tree.root == nil || i < 0 || i >= int(tree.root.size) {
+		return nil, nil
+	}
+	index := int32(i)
+	node := tree.root
+	for !node.isLeaf() {
+		if index < node.leftNode.size {
+			node = node.leftNode
+		} else {
+			index -= node.leftNode.size
+			node = node.rightNode
+		}
+	}
+	chunk, err := node.getChunk()
+	if err != nil {
+		return nil, nil
+	}
+	return chunk.GetKeyAt(index), copyBytes(chunk.GetValueAt(index))
+}
+
+// IndexOf returns the number of keys in the tree that are smaller than key, which is the index of key
+// if it is found in the tree. The returned boolean is true if the key is found.
+// If the leaf of the key cannot be loaded (see IAVL.Err), the index of the first key of the leaf is returned.
+func (tree *IAVL) IndexOf(key []byte) (int, bool) {
+	if tree.root == nil {
+		return 0, false
+	}
+	index := int32(0)
+	node := tree.root
+	for !node.isLeaf() {
+		if bytes.Compare(key, node.key) == -1 {
+			node = node.leftNode
+		} else {
+			index += node.leftNode.size
+			node = node.rightNode
+		}
+	}
+	chunk, err := node.getChunk()
+	if err != nil {
+		return int(index), false
+	}
+	i := chunk.SearchKey(key)
+	found := i < chunk.GetCurrSize() && bytes.Equal(chunk.GetKeyAt(i), key)
+	return int(index + i), found
+}
+
+// CountRange returns the number of keys in the range [start, end).
+// A nil start or end means that the range is unbounded on that side.
+func (tree *IAVL) CountRange(start, end []byte) int {
+	if tree.root == nil {
+		return 0
+	}
+	first, last := 0, int(tree.root.size)
+	if start != nil {
+		first, _ = tree.IndexOf(start)
+	}
+	if end != nil {
+		last, _ = tree.IndexOf(end)
+	}
+	if last < first {
+		return 0
+	}
+	return last - first
+}
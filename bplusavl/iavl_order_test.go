@@ -0,0 +1,55 @@
+package bplusavl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderStatistics(t *testing.T) {
+	assert := assert.New(t)
+	tree := NewIAVL(int32(8), int32(4))
+
+	key, value := tree.GetByIndex(0)
+	assert.Nil(key)
+	assert.Nil(value)
+	assert.Equal(0, tree.CountRange(nil, nil))
+
+	size := 3000
+	rand.Seed(time.Now().UnixNano())
+	x := rand.Perm(size)
+	for _, elem := range x {
+		num := make([]byte, 4)
+		binary.BigEndian.PutUint32(num, uint32(elem*2)) // only even keys
+		tree.Set(num, num)
+	}
+
+	for i := 0; i < size; i++ {
+		key, value := tree.GetByIndex(i)
+		assert.Equal(uint32(i*2), binary.BigEndian.Uint32(key))
+		assert.True(bytes.Equal(key, value))
+
+		index, found := tree.IndexOf(key)
+		assert.True(found)
+		assert.Equal(i, index)
+
+		// odd keys are not found, but their rank is the index of the following key
+		index, found = tree.IndexOf(binary.BigEndian.AppendUint32(nil, uint32(i*2+1)))
+		assert.False(found)
+		assert.Equal(i+1, index)
+	}
+	key, _ = tree.GetByIndex(size)
+	assert.Nil(key)
+	key, _ = tree.GetByIndex(-1)
+	assert.Nil(key)
+
+	assert.Equal(size, tree.CountRange(nil, nil))
+	assert.Equal(50, tree.CountRange(binary.BigEndian.AppendUint32(nil, 100), binary.BigEndian.AppendUint32(nil, 200)))
+	assert.Equal(50, tree.CountRange(binary.BigEndian.AppendUint32(nil, 99), binary.BigEndian.AppendUint32(nil, 199)))
+	assert.Equal(size-50, tree.CountRange(binary.BigEndian.AppendUint32(nil, 100), nil))
+	assert.Equal(0, tree.CountRange(binary.BigEndian.AppendUint32(nil, 200), binary.BigEndian.AppendUint32(nil, 100)))
+}
@@ -0,0 +1,241 @@
+package bplusavl
+
+import (
+	hchunk "bplus/chunk"
+	"bytes"
+	"crypto/sha256"
+
+	"github.com/pkg/errors"
+)
+
+// IAVLPrefixProof proves the complete set of K-V pairs whose key starts with a given prefix.
+// It covers a run of consecutive leaves, each with its path to the root: the leaves holding the keys with the prefix,
+// plus the neighbouring leaves needed to show that no other key with the prefix exists. For every leaf, the proof
+// contains the K-V pairs with the prefix, the last K-V pair before them and the first K-V pair after them,
+// each with its heap proof in the chunk (see hchunk.HeapChunkProof). The first and the last K-V pairs of the chunk
+// are always included: their heap proofs show the number of K-V pairs in the chunk, hence which K-V pairs
+// are adjacent. No key with the prefix can be hidden before the first K-V pair of the proof (which is
+// not past the prefix, or the first key of the tree), between two K-V pairs that are not adjacent, or after
+// the last K-V pair (which is past the prefix, or the last key of the tree).
+// The proof for an empty tree contains no leaves and validates to EmptyRootHash.
+type IAVLPrefixProof struct {
+	leaves []*prefixProofLeaf
+}
+
+// prefixProofLeaf is a leaf in a IAVLPrefixProof: some of its K-V pairs and its path from the root.
+type prefixProofLeaf struct {
+	leafProof *IAVLLeafProof
+	keyHeight uint8
+	size      int32 // number of K-V pairs in the chunk
+	entries   []*prefixProofEntry
+}
+
+// prefixProofEntry is a K-V pair in a IAVLPrefixProof and its proof in the heap of the chunk.
+type prefixProofEntry struct {
+	key       []byte
+	value     []byte
+	heapProof *hchunk.HeapChunkProof
+}
+
+// GetLength returns the number of hashes and K-V pairs in the proof.
+func (proof *IAVLPrefixProof) GetLength() int {
+	length := 0
+	for _, leaf := range proof.leaves {
+		length += leaf.leafProof.GetLength()
+		for _, entry := range leaf.entries {
+			length += entry.heapProof.GetLength() + 1
+		}
+	}
+	return length
+}
+
+// GetPrefixProof returns a proof for all the K-V pairs whose key starts with prefix.
+// The proof can be validated by IAVLPrefixProof.ValidateProof.
+func (tree *IAVL) GetPrefixProof(prefix []byte) (*IAVLPrefixProof, error) {
+	if tree.root == nil {
+		return &IAVLPrefixProof{}, nil
+	}
+	end := prefixEnd(prefix)
+
+	// start from the leaf where the prefix is (or would be): its smallest key is not past the prefix
+	position := tree.chunkList.getInsertionIndex(prefix) - 1
+	if position < 0 {
+		position = 0
+	}
+
+	proof := &IAVLPrefixProof{}
+	for ; position < tree.chunkList.GetNumberOfChunks(); position++ {
+		leaf := tree.chunkList.GetChunk(position)
+		leafProof, _, err := tree.getLeafProof(leaf.getSmallestKey())
+		if err != nil {
+			return nil, err
+		}
+		chunk, err := leaf.getChunk()
+		if err != nil {
+			return nil, err
+		}
+		size := chunk.GetCurrSize()
+		proofLeaf := &prefixProofLeaf{leafProof: leafProof, keyHeight: leaf.keyHeight, size: size}
+
+		// the keys with the prefix, with the last key before and the first key after them
+		from, to := chunk.SearchKey(prefix)-1, size-1
+		if end != nil && chunk.SearchKey(end) < to {
+			to = chunk.SearchKey(end)
+		}
+		for i := int32(0); i < size; i++ {
+			if i != 0 && i != size-1 && (i < from || i > to) {
+				continue
+			}
+			key := chunk.GetKeyAt(i)
+			heapProof, err := chunk.GetProof(key)
+			if err != nil {
+				return nil, err
+			}
+			proofLeaf.entries = append(proofLeaf.entries,
+				&prefixProofEntry{key: key, value: copyBytes(chunk.GetValueAt(i)), heapProof: heapProof})
+		}
+		proof.leaves = append(proof.leaves, proofLeaf)
+
+		// stop once a key past the prefix is found
+		if end != nil && bytes.Compare(chunk.GetKeyAt(size-1), end) != -1 {
+			break
+		}
+	}
+	return proof, nil
+}
+
+// ValidateProof validates the proof for the given prefix. If the proof is consistent, the returned hash
+// should match the root hash of the tree that generated the proof, and the K-V pairs returned by
+// IAVLPrefixProof.GetEntries are exactly the ones in the tree whose key starts with prefix.
+func (proof *IAVLPrefixProof) ValidateProof(prefix []byte) ([]byte, error) {
+	if len(proof.leaves) == 0 {
+		return EmptyRootHash(), nil
+	}
+	end := prefixEnd(prefix)
+	// hidden returns true if keys with the prefix may lie strictly between the keys a and b
+	hidden := func(a, b []byte) bool {
+		return bytes.Compare(b, prefix) == 1 && (end == nil || bytes.Compare(a, end) == -1)
+	}
+
+	var rootHash []byte
+	var previousPath []bool
+	var previous *prefixProofEntry
+	for i, leaf := range proof.leaves {
+		if len(leaf.entries) == 0 {
+			return nil, errors.Errorf("leaf %d in the proof has no K-V pairs", i)
+		}
+		var chunkHash []byte
+		previousIndex := int32(-1)
+		for j, entry := range leaf.entries {
+			index, ok := entry.heapProof.GetIndex(leaf.size)
+			if !ok || index <= previousIndex || (j == 0 && index != 0) {
+				return nil, errors.Errorf("K-V pair %d of leaf %d in the proof has an invalid position", j, i)
+			}
+			if previous != nil && bytes.Compare(previous.key, entry.key) != -1 {
+				return nil, errors.Errorf("K-V pair %d of leaf %d in the proof is not sorted", j, i)
+			}
+			if j > 0 && index > previousIndex+1 && hidden(previous.key, entry.key) {
+				return nil, errors.Errorf("the proof does not cover the keys before K-V pair %d of leaf %d", j, i)
+			}
+			hash := entry.heapProof.ValidateProof(entry.key, entry.value)
+			if j == 0 {
+				chunkHash = hash
+			} else if !bytes.Equal(chunkHash, hash) {
+				return nil, errors.Errorf("K-V pair %d of leaf %d in the proof belongs to a different chunk", j, i)
+			}
+			previousIndex, previous = index, entry
+		}
+		if previousIndex != leaf.size-1 {
+			return nil, errors.Errorf("leaf %d in the proof does not end with the last K-V pair of its chunk", i)
+		}
+
+		h := sha256.New()
+		h.Write([]byte{leaf.keyHeight})
+		h.Write(chunkHash)
+		hash := leaf.leafProof.ValidateProof(h.Sum(nil))
+		if i == 0 {
+			rootHash = hash
+		} else if !bytes.Equal(rootHash, hash) {
+			return nil, errors.Errorf("leaf %d in the proof belongs to a different tree", i)
+		}
+
+		path := leaf.leafProof.path()
+		if i > 0 && !isNextPath(previousPath, path) {
+			return nil, errors.Errorf("leaves %d and %d in the proof are not adjacent", i-1, i)
+		}
+		previousPath = path
+	}
+
+	first := proof.leaves[0]
+	if !isEdgePath(first.leafProof.path(), false) && bytes.Compare(first.entries[0].key, prefix) == 1 {
+		return nil, errors.New("the proof does not cover the keys before the prefix")
+	}
+	if !isEdgePath(previousPath, true) && (end == nil || bytes.Compare(previous.key, end) == -1) {
+		return nil, errors.New("the proof does not cover the keys after the prefix")
+	}
+	return rootHash, nil
+}
+
+// GetAbsenceProof returns a proof that the given key is not in the tree. It is a IAVLPrefixProof for the key:
+// it validates like any prefix proof, and IAVLPrefixProof.GetEntries returns no entries for the key.
+// An error is returned if the key is in the tree: use GetElementProof instead.
+func (tree *IAVL) GetAbsenceProof(key []byte) (*IAVLPrefixProof, error) {
+	if tree.root != nil {
+		value, err := tree.root.get(key)
+		if err != nil {
+			return nil, err
+		}
+		if value != nil {
+			return nil, errors.New("Error by creating a proof: the key is in the tree")
+		}
+	}
+	return tree.GetPrefixProof(key)
+}
+
+// GetEntries returns the keys and values in the proof that start with prefix, sorted by key.
+// The entries should only be trusted after a successful validation with IAVLPrefixProof.ValidateProof.
+func (proof *IAVLPrefixProof) GetEntries(prefix []byte) (keys, values [][]byte) {
+	for _, leaf := range proof.leaves {
+		for _, entry := range leaf.entries {
+			if bytes.HasPrefix(entry.key, prefix) {
+				keys = append(keys, entry.key)
+				values = append(values, entry.value)
+			}
+		}
+	}
+	return keys, values
+}
+
+// path returns the path from the root to the leaf, where true means that the path goes to the right child.
+func (proof *IAVLLeafProof) path() []bool {
+	// hashes and directions are ordered from the leaf up to the root.
+	// A sibling on the left means that the path goes to the right.
+	path := make([]bool, len(proof.directions))
+	for i, fromLeft := range proof.directions {
+		path[len(path)-1-i] = fromLeft
+	}
+	return path
+}
+
+// isNextPath returns true if the leaf at path b immediately follows the leaf at path a (in-order).
+// This is the case when, after a common part, a goes left and then always right while b goes right and then always left.
+func isNextPath(a, b []bool) bool {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	if i == len(a) || i == len(b) || a[i] || !b[i] {
+		return false
+	}
+	return isEdgePath(a[i+1:], true) && isEdgePath(b[i+1:], false)
+}
+
+// isEdgePath returns true if the path only goes right (if right is set) or only left.
+func isEdgePath(path []bool, right bool) bool {
+	for _, p := range path {
+		if p != right {
+			return false
+		}
+	}
+	return true
+}
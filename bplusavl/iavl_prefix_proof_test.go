@@ -0,0 +1,92 @@
+package bplusavl
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefixProof(t *testing.T) {
+	assert := assert.New(t)
+	tree := NewIAVL(int32(8), int32(6))
+
+	var keys []string
+	for _, namespace := range []string{"acc/", "con/", "val/"} {
+		for i := 0; i < 50; i++ {
+			keys = append(keys, fmt.Sprintf("%s%02d", namespace, i))
+		}
+	}
+	for _, i := range rand.Perm(len(keys)) {
+		tree.Set([]byte(keys[i]), []byte("value of "+keys[i]))
+	}
+	rootHash := tree.GetRootHash()
+
+	for _, prefix := range []string{"acc/", "con/", "val/", "con/1", "con/49", "", "a", "abc", "con/5", "zzz", "0"} {
+		proof, err := tree.GetPrefixProof([]byte(prefix))
+		assert.Nil(err)
+
+		hash, err := proof.ValidateProof([]byte(prefix))
+		assert.Nil(err, prefix)
+		assert.True(bytes.Equal(rootHash, hash), prefix)
+
+		var expected [][]byte
+		for it := tree.IteratePrefix([]byte(prefix)); it.Valid(); it.Next() {
+			expected = append(expected, it.Key())
+		}
+		provenKeys, provenValues := proof.GetEntries([]byte(prefix))
+		assert.Equal(expected, provenKeys, prefix)
+		for i, key := range provenKeys {
+			assert.Equal("value of "+string(key), string(provenValues[i]))
+		}
+	}
+
+	// the proof for a prefix does not validate for another prefix
+	proof, err := tree.GetPrefixProof([]byte("con/"))
+	assert.Nil(err)
+	_, err = proof.ValidateProof([]byte("acc/"))
+	assert.NotNil(err)
+
+	// dropping a leaf from the proof is detected
+	proof.leaves = append(proof.leaves[:1], proof.leaves[2:]...)
+	_, err = proof.ValidateProof([]byte("con/"))
+	assert.NotNil(err)
+
+	// tampering with a value is detected
+	proof, _ = tree.GetPrefixProof([]byte("val/"))
+	proof.leaves[1].entries[0].value = []byte("forged")
+	_, err = proof.ValidateProof([]byte("val/"))
+	assert.NotNil(err)
+
+	// hiding a key with the prefix is detected, in the middle or at the end of a chunk
+	for _, hide := range []func(leaf *prefixProofLeaf){
+		func(leaf *prefixProofLeaf) {
+			leaf.entries = append(leaf.entries[:1], leaf.entries[2:]...)
+		},
+		func(leaf *prefixProofLeaf) {
+			leaf.entries = leaf.entries[:len(leaf.entries)-1]
+			leaf.size--
+		},
+	} {
+		proof, _ = tree.GetPrefixProof([]byte("con/"))
+		leaf := proof.leaves[1]
+		assert.Greater(len(leaf.entries), 2)
+		assert.True(bytes.HasPrefix(leaf.entries[1].key, []byte("con/")))
+		assert.True(bytes.HasPrefix(leaf.entries[len(leaf.entries)-1].key, []byte("con/")))
+		hide(leaf)
+		_, err = proof.ValidateProof([]byte("con/"))
+		assert.NotNil(err)
+	}
+}
+
+func TestIsNextPath(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(isNextPath([]bool{false}, []bool{true}))
+	assert.True(isNextPath([]bool{false, true, true}, []bool{true, false}))
+	assert.True(isNextPath([]bool{true, false, true}, []bool{true, true, false, false}))
+	assert.False(isNextPath([]bool{false, false}, []bool{true}))
+	assert.False(isNextPath([]bool{false}, []bool{true, true}))
+	assert.False(isNextPath([]bool{true}, []bool{false}))
+}
@@ -5,15 +5,20 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"io"
+	"math"
 
 	"github.com/pkg/errors"
 	"github.com/tendermint/go-amino"
 )
 
 // IAVLLeafProof is a proof composed of a path from the root node of the tree, down to a leaf node.
+// Since the inner nodes commit to their number of leaves and their key, the proof also proves the position
+// of the leaf (see IAVLLeafProof.Position) and its key range (see IAVLLeafProof.Bounds).
 type IAVLLeafProof struct {
 	hashes     [][]byte
 	directions []bool
+	leafCounts []uint32 // number of leaves under each sibling
+	keys       [][]byte // key of each inner node on the path
 }
 
 // IAVLElementProof is a proof composed of a path from the root node of the tree, down to a single K-V pair
@@ -36,10 +41,19 @@ func (proof *IAVLElementProof) GetLength() int {
 // The proof can be validated by IAVLElementProof.ValidateProof, which returns a hash value that should match
 // the hash value found at the root node of the tree, if the key is found in the tree.
 func (tree *IAVL) GetElementProof(key []byte) (*IAVLElementProof, error) {
-	leafProof, leaf, err1 := tree.getLeafProof(key)
-	chunkProof, err2 := leaf.chunk.GetProof(key)
-
-	if err1 != nil || err2 != nil {
+	if tree.root == nil {
+		return nil, errors.New("Error by creating a proof: empty tree. Use GetAbsenceProof instead")
+	}
+	leafProof, leaf, err := tree.getLeafProof(key)
+	if err != nil {
+		return nil, errors.New("Error by creating a proof")
+	}
+	chunk, err := leaf.getChunk()
+	if err != nil {
+		return nil, err
+	}
+	chunkProof, err := chunk.GetProof(key)
+	if err != nil {
 		return nil, errors.New("Error by creating a proof")
 	}
 	return &IAVLElementProof{
@@ -67,39 +81,49 @@ func (proof *IAVLElementProof) ValidateProof(key, value []byte) []byte {
 	return rootHash
 }
 
-// getChunkProof returns the proof for the chunk (=leaf containing a chunk) at a certain position in the tree,
+// GetChunkProof returns the proof for the chunk (=leaf containing a chunk) at a certain position in the tree,
 // where 0 is the left-most chunk and C = nextLeafID - 1 is the right-most chunk.
 // Remember that IDs are given incrementally and due to splits, chunks are not sorted by ID.
+// The proof proves the position of the chunk and its key range: use IAVLLeafProof.ValidateChunk to check them.
 func (tree *IAVL) GetChunkProof(chunkPosition int) (*IAVLLeafProof, *Node, error) {
 	leaf := tree.chunkList.GetChunk(chunkPosition)
 	if leaf == nil {
 		return nil, nil, errors.New("Chunk not found in the chunkList")
 	}
-	k := leaf.chunk.GetSmallestKey()
-	return tree.getLeafProof(k)
+	return tree.getLeafProof(leaf.getSmallestKey())
 }
 
 func (tree *IAVL) getLeafProof(key []byte) (*IAVLLeafProof, *Node, error) {
-	var hashes [][]byte
+	var hashes, keys [][]byte
 	var directions []bool
+	var leafCounts []uint32
+
+	if tree.root == nil {
+		return nil, nil, errors.New("empty tree")
+	}
 
 	currNode := tree.root
 	for !currNode.isLeaf() {
+		keys = append([][]byte{currNode.key}, keys...)
 		if bytes.Compare(key, currNode.key) == -1 {
 			// path goes on the left, add RIGHT sibling to proof
 			hashes = append([][]byte{currNode.rightNode.hash}, hashes...)
 			directions = append([]bool{false}, directions...)
+			leafCounts = append([]uint32{currNode.rightNode.getLeafCount()}, leafCounts...)
 			currNode = currNode.leftNode
 		} else {
 			// path goes on the right, add LEFT sibling to proof
 			hashes = append([][]byte{currNode.leftNode.hash}, hashes...)
 			directions = append([]bool{true}, directions...)
+			leafCounts = append([]uint32{currNode.leftNode.getLeafCount()}, leafCounts...)
 			currNode = currNode.rightNode
 		}
 	}
 	return &IAVLLeafProof{
 		hashes:     hashes,
 		directions: directions,
+		leafCounts: leafCounts,
+		keys:       copyKeys(keys),
 	}, currNode, nil
 }
 
@@ -107,22 +131,87 @@ func (tree *IAVL) getLeafProof(key []byte) (*IAVLLeafProof, *Node, error) {
 // returns the hash that should match the root hash. In case of match, the chunk can be
 // considered valid.
 func (proof *IAVLLeafProof) ValidateProof(leafHash []byte) []byte {
-	h := sha256.New()
+	if len(proof.directions) != len(proof.hashes) || len(proof.leafCounts) != len(proof.hashes) ||
+		len(proof.keys) != len(proof.hashes) {
+		return nil
+	}
 	currHash := leafHash
+	var leafCount uint32 = 1
 	for i := 0; i < len(proof.hashes); i++ {
+		leafCount += proof.leafCounts[i]
 		if proof.directions[i] {
-			h.Write(proof.hashes[i])
-			h.Write(currHash)
+			currHash = innerHash(proof.hashes[i], currHash, leafCount, proof.keys[i])
 		} else {
-			h.Write(currHash)
-			h.Write(proof.hashes[i])
+			currHash = innerHash(currHash, proof.hashes[i], leafCount, proof.keys[i])
 		}
-		currHash = h.Sum(nil)
-		h.Reset()
 	}
 	return currHash
 }
 
+// Position returns the position of the leaf, where 0 is the left-most leaf, and the number of leaves of the tree.
+// They are proven once the proof is validated.
+func (proof *IAVLLeafProof) Position() (position, leaves int) {
+	leaves = 1
+	for i, count := range proof.leafCounts {
+		if proof.directions[i] {
+			position += int(count)
+		}
+		leaves += int(count)
+	}
+	return position, leaves
+}
+
+// Bounds returns the range [lower, upper) of the keys of the leaf, bounded by the keys of the inner nodes
+// on the path: lower is the smallest key of the leaf, upper is the smallest key of the next leaf.
+// A nil bound means that the range is unbounded on that side: the leaf is the first or the last one.
+// The bounds are proven once the proof is validated.
+func (proof *IAVLLeafProof) Bounds() (lower, upper []byte) {
+	for i, key := range proof.keys {
+		if proof.directions[i] && lower == nil {
+			lower = key
+		}
+		if !proof.directions[i] && upper == nil {
+			upper = key
+		}
+	}
+	return lower, upper
+}
+
+// ValidateChunk checks that leaf is the chunk at the given position of the tree whose root hash is rootHash:
+// the proof must lead from the hash of the leaf to rootHash, prove the position, and the keys of the leaf
+// must fill the bounds of the proof. Checking every chunk of a tree this way shows that the chunks cover
+// the whole key space without overlapping. ErrInvalidProof is returned otherwise.
+func (proof *IAVLLeafProof) ValidateChunk(leaf *Node, position int, rootHash []byte) error {
+	if !leaf.isLeaf() || leaf.size == 0 {
+		return errors.Wrap(ErrInvalidProof, "not a leaf")
+	}
+	if !bytes.Equal(proof.ValidateProof(leaf.hash), rootHash) {
+		return errors.Wrapf(ErrInvalidProof, "leaf %d does not match the root hash", leaf.leafID)
+	}
+	if proven, _ := proof.Position(); proven != position {
+		return errors.Wrapf(ErrInvalidProof, "leaf %d is at position %d, expected %d", leaf.leafID, proven, position)
+	}
+	chunk, err := leaf.getChunk()
+	if err != nil {
+		return err
+	}
+	lower, upper := proof.Bounds()
+	if (lower != nil && !bytes.Equal(chunk.GetSmallestKeyUnsafe(), lower)) ||
+		(upper != nil && bytes.Compare(chunk.GetKeyAt(chunk.GetCurrSize()-1), upper) != -1) {
+		return errors.Wrapf(ErrInvalidProof, "leaf %d is out of its key range", leaf.leafID)
+	}
+	return nil
+}
+
+// copyKeys returns copies of the keys.
+func copyKeys(keys [][]byte) [][]byte {
+	copies := make([][]byte, len(keys))
+	for i, key := range keys {
+		copies[i] = copyBytes(key)
+	}
+	return copies
+}
+
 // SerializeProof serializes a proof into a buffer.
 func (proof *IAVLLeafProof) SerializeProof(buffer io.Writer) error {
 	err := amino.EncodeInt32(buffer, int32(len(proof.hashes)))
@@ -143,6 +232,20 @@ func (proof *IAVLLeafProof) SerializeProof(buffer io.Writer) error {
 			return errors.Wrap(err, "while encoding direction")
 		}
 	}
+
+	for _, count := range proof.leafCounts {
+		err = amino.EncodeUvarint(buffer, uint64(count))
+		if err != nil {
+			return errors.Wrap(err, "while encoding leaf count")
+		}
+	}
+
+	for _, key := range proof.keys {
+		err = amino.EncodeByteSlice(buffer, key)
+		if err != nil {
+			return errors.Wrap(err, "while encoding key")
+		}
+	}
 	return nil
 }
 
@@ -154,10 +257,15 @@ func DeserializeProof(buffer []byte) (*IAVLLeafProof, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "while decoding proof size")
 	}
+	if proofSize < 0 || int(proofSize) > len(buffer) {
+		return nil, errors.New("invalid proof size")
+	}
 	buffer = buffer[j:]
 
 	hashes := make([][]byte, proofSize)
 	directions := make([]bool, proofSize)
+	leafCounts := make([]uint32, proofSize)
+	keys := make([][]byte, proofSize)
 
 	for i := 0; i < int(proofSize); i++ {
 		h, j, err := amino.DecodeByteSlice(buffer)
@@ -177,5 +285,90 @@ func DeserializeProof(buffer []byte) (*IAVLLeafProof, error) {
 		directions[i] = d
 	}
 
-	return &IAVLLeafProof{hashes: hashes, directions: directions}, nil
+	for i := 0; i < int(proofSize); i++ {
+		count, j, err := amino.DecodeUvarint(buffer)
+		if err != nil {
+			return nil, errors.Wrap(err, "while decoding leaf count")
+		}
+		if count > math.MaxUint32 {
+			return nil, errors.New("invalid leaf count")
+		}
+		buffer = buffer[j:]
+		leafCounts[i] = uint32(count)
+	}
+
+	for i := 0; i < int(proofSize); i++ {
+		key, j, err := amino.DecodeByteSlice(buffer)
+		if err != nil {
+			return nil, errors.Wrap(err, "while decoding key")
+		}
+		buffer = buffer[j:]
+		keys[i] = key
+	}
+
+	return &IAVLLeafProof{hashes: hashes, directions: directions, leafCounts: leafCounts, keys: keys}, nil
+}
+
+// SerializeProof serializes an element proof into a buffer.
+// The leaf proof and the chunk proof are encoded as byte slices, preceded by the keyHeight of the leaf.
+func (proof *IAVLElementProof) SerializeProof(buffer io.Writer) error {
+	err := amino.EncodeUint8(buffer, proof.keyHeight)
+	if err != nil {
+		return errors.Wrap(err, "while encoding key height")
+	}
+
+	var leafProofBuffer bytes.Buffer
+	err = proof.iavlProof.SerializeProof(&leafProofBuffer)
+	if err != nil {
+		return err
+	}
+	err = amino.EncodeByteSlice(buffer, leafProofBuffer.Bytes())
+	if err != nil {
+		return errors.Wrap(err, "while encoding leaf proof")
+	}
+
+	var chunkProofBuffer bytes.Buffer
+	err = proof.chunkProof.SerializeProof(&chunkProofBuffer)
+	if err != nil {
+		return err
+	}
+	err = amino.EncodeByteSlice(buffer, chunkProofBuffer.Bytes())
+	if err != nil {
+		return errors.Wrap(err, "while encoding chunk proof")
+	}
+	return nil
+}
+
+// DeserializeElementProof takes a buffer containing a serialized element proof and rebuilds the proof.
+func DeserializeElementProof(buffer []byte) (*IAVLElementProof, error) {
+	keyHeight, j, err := amino.DecodeUint8(buffer)
+	if err != nil {
+		return nil, errors.Wrap(err, "while decoding key height")
+	}
+	buffer = buffer[j:]
+
+	leafProofBytes, j, err := amino.DecodeByteSlice(buffer)
+	if err != nil {
+		return nil, errors.Wrap(err, "while decoding leaf proof")
+	}
+	buffer = buffer[j:]
+	leafProof, err := DeserializeProof(leafProofBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	chunkProofBytes, _, err := amino.DecodeByteSlice(buffer)
+	if err != nil {
+		return nil, errors.Wrap(err, "while decoding chunk proof")
+	}
+	chunkProof, err := hchunk.DeserializeProof(chunkProofBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &IAVLElementProof{
+		iavlProof:  leafProof,
+		chunkProof: chunkProof,
+		keyHeight:  keyHeight,
+	}, nil
 }
@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -103,3 +104,85 @@ func TestSerializeProof(t *testing.T) {
 		// fmt.Println(numberOfChunks)
 	}
 }
+
+func TestSerializeElementProof(t *testing.T) {
+	assert := assert.New(t)
+	tree := NewIAVL(int32(16), int32(4))
+	size := 2000
+
+	x := rand.Perm(size)
+	for _, elem := range x {
+		num := make([]byte, 4)
+		binary.LittleEndian.PutUint32(num, uint32(elem))
+		tree.Set(num, num)
+	}
+
+	for i := 0; i < size; i += 7 {
+		num := make([]byte, 4)
+		binary.LittleEndian.PutUint32(num, uint32(i))
+		proof, err := tree.GetElementProof(num)
+		assert.Nil(err)
+
+		var buffer bytes.Buffer
+		err = proof.SerializeProof(&buffer)
+		assert.Nil(err)
+
+		rebuiltProof, err := DeserializeElementProof(buffer.Bytes())
+		assert.Nil(err)
+		assert.Equal(proof.GetLength(), rebuiltProof.GetLength())
+		assert.True(bytes.Equal(tree.GetRootHash(), rebuiltProof.ValidateProof(num, num)))
+	}
+}
+
+func TestChunkProofPosition(t *testing.T) {
+	assert := assert.New(t)
+	tree := NewIAVL(int32(8), int32(4))
+	for _, elem := range rand.Perm(3000) {
+		num := make([]byte, 4)
+		binary.BigEndian.PutUint32(num, uint32(elem))
+		tree.Set(num, num)
+		if elem%3 == 0 {
+			tree.Remove(num)
+		}
+	}
+
+	numberOfChunks := tree.GetNumberOfChunks()
+	for i := 0; i < numberOfChunks; i++ {
+		proof, leaf, err := tree.GetChunkProof(i)
+		assert.NoError(err)
+		var buffer bytes.Buffer
+		assert.NoError(proof.SerializeProof(&buffer))
+		proof, err = DeserializeProof(buffer.Bytes())
+		assert.NoError(err)
+
+		assert.NoError(proof.ValidateChunk(leaf, i, tree.GetRootHash()))
+		position, leaves := proof.Position()
+		assert.Equal(i, position)
+		assert.Equal(numberOfChunks, leaves)
+		lower, upper := proof.Bounds()
+		if i == 0 {
+			assert.Nil(lower)
+		} else {
+			assert.Equal(leaf.GetSmallestKey(), lower)
+		}
+		if i == numberOfChunks-1 {
+			assert.Nil(upper)
+		} else {
+			assert.Equal(tree.GetChunk(i+1).GetSmallestKey(), upper)
+		}
+
+		// a chunk in the wrong slot
+		assert.Equal(ErrInvalidProof, errors.Cause(proof.ValidateChunk(leaf, i+1, tree.GetRootHash())))
+		other := tree.GetChunk((i + 1) % numberOfChunks)
+		assert.Equal(ErrInvalidProof, errors.Cause(proof.ValidateChunk(other, i, tree.GetRootHash())))
+	}
+
+	// the leaf counts and the keys are part of the hashes
+	proof, leaf, err := tree.GetChunkProof(numberOfChunks / 2)
+	assert.NoError(err)
+	proof.leafCounts[0]++
+	assert.NotEqual(tree.GetRootHash(), proof.ValidateProof(leaf.hash))
+	proof.leafCounts[0]--
+	proof.keys[0] = leaf.GetSmallestKey()[:2]
+	assert.NotEqual(tree.GetRootHash(), proof.ValidateProof(leaf.hash))
+}
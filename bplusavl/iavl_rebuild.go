@@ -3,10 +3,28 @@ package bplusavl
 import (
 	"bytes"
 	"sort"
+
+	"github.com/pkg/errors"
 )
 
-func RebuildTree(list []*Node) *IAVL {
+// RebuildTree reconstructs the inner nodes of a tree given its leaves, sorted by their smallest key.
+// The leaves are linked together and the chunk list of the returned tree is populated,
+// so that the tree can be used as a tree built by insertions.
+// Hashes of the inner nodes are not computed: call IAVL.CompleteRehash on the returned tree.
+// An empty list produces an empty tree. Since the chunk size and key size cannot be inferred from it,
+// such a tree can be read but not written: use NewIAVL to start an empty tree that accepts insertions.
+// The options are applied to the returned tree as in NewIAVL.
+// ErrInvalidTree is returned if the leaves are not sorted, have inconsistent parameters or
+// their key heights do not describe a balanced tree (any binary tree with the canonical shape option,
+// see WithCanonicalShape).
+func RebuildTree(list []*Node, options ...TreeOption) (*IAVL, error) {
 	n := len(list)
+	if n == 0 {
+		return NewIAVL(0, 0, options...), nil
+	}
+	if err := checkLeafList(list); err != nil {
+		return nil, err
+	}
 
 	activeNodes := make([]*Node, n) // fix the size
 
@@ -17,7 +35,7 @@ func RebuildTree(list []*Node) *IAVL {
 		var newNode *Node = nil
 		if h != 0 {
 			newNode = &Node{
-				key:         node.chunk.GetSmallestKey(),
+				key:         node.chunk.GetSmallestKeyUnsafe(),
 				height:      node.keyHeight,
 				hashIsValid: false,
 				leafPointer: node,
@@ -30,6 +48,9 @@ func RebuildTree(list []*Node) *IAVL {
 		// This way the sizes can be computed.
 		for i, j := 0, 1; j <= int(h) && i < int(h); i++ {
 			if activeNodes[i] != nil {
+				if j <= i {
+					return nil, errors.Wrapf(ErrInvalidTree, "unexpected key height of leaf %d", node.leafID)
+				}
 				for activeNodes[j] == nil {
 					j += 1
 
@@ -63,6 +84,9 @@ func RebuildTree(list []*Node) *IAVL {
 	for i, j := 0, 1; j <= int(maxH); {
 		for activeNodes[j] == nil {
 			j += 1
+			if j > int(maxH) {
+				return nil, errors.Wrap(ErrInvalidTree, "unconnected nodes")
+			}
 		}
 		activeNodes[j].rightNode = activeNodes[i]
 		activeNodes[j].size += activeNodes[i].size
@@ -70,15 +94,95 @@ func RebuildTree(list []*Node) *IAVL {
 		j += 1
 	}
 
-	return &IAVL{
-		root:      root,
-		firstLeaf: list[0],
+	first := list[0].chunk
+	tree := NewIAVL(first.GetMaxSize(), first.GetKeySize(), options...)
+	if _, leaves, err := checkStructure(root, !tree.canonical); err != nil {
+		return nil, err
+	} else if leaves != n {
+		return nil, errors.Wrapf(ErrInvalidTree, "%d leaves reachable from the root, expected %d", leaves, n)
+	}
+	tree.root = root
+	tree.firstLeaf = list[0]
+	tree.chunkList = NewChunkList(n)
+	for i, leaf := range list {
+		tree.chunkList.chunks[i] = leaf
+		leaf.nextLeaf, leaf.prevLeaf = nil, nil
+		if i+1 < n {
+			leaf.nextLeaf = list[i+1]
+		}
+		if i > 0 {
+			leaf.prevLeaf = list[i-1]
+		}
+		if leaf.leafID >= tree.nextLeafID {
+			tree.nextLeafID = leaf.leafID + 1
+		}
+		if tree.chunkBytes > 0 {
+			leaf.chunk.SetTargetBytes(tree.chunkBytes)
+		}
+		tree.cache.add(leaf)
+	}
+	tree.cache.shrink()
+	return tree, nil
+}
+
+// checkLeafList returns an error if the leaves cannot be part of the same tree.
+func checkLeafList(list []*Node) error {
+	for i, leaf := range list {
+		// the leaves are not managed by a leaf cache yet: their chunks are in memory
+		if leaf == nil || !leaf.isLeaf() || leaf.chunk == nil || leaf.chunk.GetCurrSize() == 0 {
+			return errors.Wrapf(ErrInvalidTree, "leaf %d is nil, empty or not a leaf", i)
+		}
+		if (i == 0) != (leaf.keyHeight == 0) || int(leaf.keyHeight) >= len(list) {
+			return errors.Wrapf(ErrInvalidTree, "invalid key height %d of leaf %d", leaf.keyHeight, leaf.leafID)
+		}
+		leaf.leftNode, leaf.rightNode, leaf.size = nil, nil, leaf.chunk.GetCurrSize()
+		if i == 0 {
+			continue
+		}
+		previous := list[i-1].chunk
+		if leaf.chunk.GetKeySize() != previous.GetKeySize() || leaf.chunk.GetMaxSize() != previous.GetMaxSize() {
+			return errors.Wrapf(ErrInvalidTree, "leaf %d has a different key size or chunk size", leaf.leafID)
+		}
+		lastKey := previous.GetKeyAt(previous.GetCurrSize() - 1)
+		if bytes.Compare(lastKey, leaf.chunk.GetSmallestKeyUnsafe()) != -1 {
+			return errors.Wrapf(ErrInvalidTree, "leaf %d is not sorted", leaf.leafID)
+		}
+	}
+	return nil
+}
+
+// checkStructure returns the height and the number of leaves of the subtree rooted at node,
+// or an error if the subtree is not a binary tree with consistent heights, balanced if balanced is set.
+func checkStructure(node *Node, balanced bool) (height uint8, leaves int, err error) {
+	if node.isLeaf() {
+		return 0, 1, nil
+	}
+	if node.leftNode == nil || node.rightNode == nil {
+		return 0, 0, errors.Wrap(ErrInvalidTree, "inner node with a missing child")
+	}
+	// children must be lower than their parent: this also rules out cycles
+	if node.leftNode.height >= node.height || node.rightNode.height >= node.height {
+		return 0, 0, errors.Wrap(ErrInvalidTree, "inner node lower than its children")
+	}
+	leftHeight, leftLeaves, err := checkStructure(node.leftNode, balanced)
+	if err != nil {
+		return 0, 0, err
+	}
+	rightHeight, rightLeaves, err := checkStructure(node.rightNode, balanced)
+	if err != nil {
+		return 0, 0, err
+	}
+	if leftHeight != node.leftNode.height || rightHeight != node.rightNode.height ||
+		node.height != maxInt8(leftHeight, rightHeight)+1 ||
+		balanced && (int(leftHeight)-int(rightHeight) > 1 || int(rightHeight)-int(leftHeight) > 1) {
+		return 0, 0, errors.Wrap(ErrInvalidTree, "inconsistent or unbalanced heights")
 	}
+	return node.height, leftLeaves + rightLeaves, nil
 }
 
 func SortNodeList(nodes []*Node) {
 	// sort.Slice(people, func(i, j int) bool { return people[i].Name < people[j].Name })
 	sort.Slice(nodes, func(i, j int) bool {
-		return bytes.Compare(nodes[i].chunk.GetSmallestKey(), nodes[j].chunk.GetSmallestKey()) == -1
+		return bytes.Compare(nodes[i].getSmallestKey(), nodes[j].getSmallestKey()) == -1
 	})
 }
@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -28,7 +29,8 @@ func TestRebuildSmallTree(t *testing.T) {
 		currLeaf = currLeaf.nextLeaf
 	}
 
-	rebuiltTree := RebuildTree(leafList)
+	rebuiltTree, err := RebuildTree(leafList)
+	assert.NoError(err)
 	rebuiltTree.root.completeReHash()
 	assert.NotNil(rebuiltTree)
 	assert.True(bytes.Equal(tree.root.hash, rebuiltTree.root.hash))
@@ -54,8 +56,59 @@ func TestRebuildRandomTree(t *testing.T) {
 		currLeaf = currLeaf.nextLeaf
 	}
 
-	rebuiltTree := RebuildTree(leafList)
+	rebuiltTree, err := RebuildTree(leafList)
+	assert.NoError(err)
 	rebuiltTree.root.completeReHash()
 	assert.NotNil(rebuiltTree)
 	assert.True(bytes.Equal(tree.root.hash, rebuiltTree.root.hash))
 }
+
+func TestRebuildInvalidTree(t *testing.T) {
+	assert := assert.New(t)
+	tree := NewIAVL(int32(4), int32(1))
+	for i := byte(0); i < 40; i++ {
+		tree.Set([]byte{i}, []byte{i})
+	}
+	leaves := func() []*Node {
+		var leafList []*Node
+		for currLeaf := tree.firstLeaf; currLeaf != nil; currLeaf = currLeaf.nextLeaf {
+			leafList = append(leafList, currLeaf)
+		}
+		return leafList
+	}
+
+	leafList := leaves()
+	leafList[1], leafList[2] = leafList[2], leafList[1]
+	_, err := RebuildTree(leafList)
+	assert.True(errors.Is(err, ErrInvalidTree))
+
+	leafList = leaves()
+	_, err = RebuildTree(append(leafList, leafList[len(leafList)-1]))
+	assert.True(errors.Is(err, ErrInvalidTree))
+
+	_, err = RebuildTree(append(leaves(), nil))
+	assert.True(errors.Is(err, ErrInvalidTree))
+
+	_, err = RebuildTree([]*Node{tree.root})
+	assert.True(errors.Is(err, ErrInvalidTree))
+
+	// corrupted key heights do not describe a balanced tree
+	for i := range leaves() {
+		for _, keyHeight := range []uint8{0, 1, 2, 3, 5, 255} {
+			leafList = leaves()
+			original := leafList[i].keyHeight
+			if keyHeight == original {
+				continue
+			}
+			leafList[i].keyHeight = keyHeight
+			_, err = RebuildTree(leafList)
+			assert.True(errors.Is(err, ErrInvalidTree), "leaf %d with key height %d", i, keyHeight)
+			leafList[i].keyHeight = original
+		}
+	}
+
+	rebuiltTree, err := RebuildTree(leaves())
+	assert.NoError(err)
+	rebuiltTree.CompleteRehash()
+	assert.Equal(tree.GetRootHash(), rebuiltTree.GetRootHash())
+}
@@ -0,0 +1,378 @@
+package bplusavl
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+)
+
+// Anti-entropy reconciliation. A replica walks the tree of a peer top-down, asking for the hashes of its nodes
+// level by level. A subtree whose hash is found in the local tree is already known: its leaves are copied from
+// the local tree. Otherwise the children of an inner node are asked for, and a leaf whose chunk is not found
+// in the local tree is fetched, serialized with Node.Serialize, together with its proof (see IAVL.GetChunkProof).
+// The tree of the peer is then rebuilt from the local and the fetched leaves.
+// Every hash sent by the peer is checked: the children against their parent, the fetched leaves against
+// their announced hash and their proof, and the rebuilt tree against the root hash.
+
+// ReconcileRequest asks a peer for the hashes of some of its nodes, for some of its chunks, or both.
+type ReconcileRequest struct {
+	Paths     [][]bool // the nodes, as paths from the root (true for the right child)
+	Positions []int32  // the chunks, by position (0 is the left-most chunk)
+}
+
+// ReconcileResponse is the answer of a peer to a ReconcileRequest, with the nodes and the chunks in the requested order.
+type ReconcileResponse struct {
+	RootHash  []byte
+	ChunkSize int32
+	KeySize   int32
+	Nodes     []ReconcileNode
+	Chunks    []ReconcileChunk
+}
+
+// ReconcileNode describes a node of the tree of a peer. Unless stated otherwise, the fields after Height
+// are only set for leaves.
+type ReconcileNode struct {
+	Hash        []byte
+	Height      uint8 // 0 for a leaf
+	LeafID      uint32
+	KeyHeight   uint8
+	LeafCount   uint32 // inner nodes only: number of leaves of the subtree
+	Key         []byte // inner nodes only: smallest key of the right subtree
+	ChunkHash   []byte // root hash of the heap of the chunk
+	SmallestKey []byte // start of the key range of the leaf, which ends at the smallest key of the next leaf
+	Position    int32  // position of the chunk, used to fetch it
+}
+
+// ReconcileChunk is a leaf of a peer with its proof.
+type ReconcileChunk struct {
+	Leaf  []byte // serialized with Node.Serialize
+	Proof []byte // serialized with IAVLLeafProof.SerializeProof
+}
+
+// ReconcileTransport sends a request to a peer and returns its response.
+type ReconcileTransport interface {
+	Exchange(request *ReconcileRequest) (*ReconcileResponse, error)
+}
+
+// MemoryTransport is a ReconcileTransport to a tree in the same process, for tests and local replicas.
+type MemoryTransport struct {
+	tree *IAVL
+}
+
+// NewMemoryTransport returns a transport whose requests are answered by ServeReconcile on tree.
+func NewMemoryTransport(tree *IAVL) *MemoryTransport {
+	return &MemoryTransport{tree: tree}
+}
+
+// Exchange answers the request with the tree of the transport.
+func (transport *MemoryTransport) Exchange(request *ReconcileRequest) (*ReconcileResponse, error) {
+	return ServeReconcile(transport.tree, request)
+}
+
+// ReconcileStats reports the work done by Reconcile.
+type ReconcileStats struct {
+	Rounds         int // number of exchanges with the peer
+	Nodes          int // number of nodes received
+	SharedSubtrees int // subtrees found in the local tree
+	SharedChunks   int // leaves of the peer whose chunk was found in the local tree
+	FetchedChunks  int // leaves fetched from the peer
+}
+
+// ServeReconcile answers a request of a peer reconciling with tree. The hashes of tree must be up-to-date.
+// ErrIndexOutOfRange is returned if a path or a position is not in the tree.
+func ServeReconcile(tree *IAVL, request *ReconcileRequest) (*ReconcileResponse, error) {
+	response := &ReconcileResponse{RootHash: tree.GetRootHash(), ChunkSize: tree.chunkSize, KeySize: tree.keySize}
+	for _, path := range request.Paths {
+		node := tree.root
+		for _, right := range path {
+			if node == nil || node.isLeaf() {
+				return nil, errors.Wrapf(ErrIndexOutOfRange, "no node at path %v", path)
+			}
+			if right {
+				node = node.rightNode
+			} else {
+				node = node.leftNode
+			}
+		}
+		if node == nil {
+			return nil, errors.Wrap(ErrIndexOutOfRange, "empty tree")
+		}
+		info := ReconcileNode{Hash: node.hash, Height: node.height}
+		if !node.isLeaf() {
+			info.LeafCount = node.leafCount
+			info.Key = node.key
+		} else {
+			info.LeafID = node.leafID
+			info.KeyHeight = node.keyHeight
+			info.ChunkHash = node.getChunkHash()
+			info.SmallestKey = node.GetSmallestKey()
+			info.Position = int32(tree.chunkList.getInsertionIndex(info.SmallestKey) - 1)
+		}
+		response.Nodes = append(response.Nodes, info)
+	}
+
+	for _, position := range request.Positions {
+		proof, leaf, err := tree.GetChunkProof(int(position))
+		if err != nil {
+			return nil, errors.Wrapf(ErrIndexOutOfRange, "chunk %d", position)
+		}
+		var leafBuffer, proofBuffer bytes.Buffer
+		if err = leaf.Serialize(&leafBuffer); err != nil {
+			return nil, err
+		}
+		if err = proof.SerializeProof(&proofBuffer); err != nil {
+			return nil, err
+		}
+		response.Chunks = append(response.Chunks, ReconcileChunk{Leaf: leafBuffer.Bytes(), Proof: proofBuffer.Bytes()})
+	}
+	return response, nil
+}
+
+// reconciler holds the state of a reconciliation with a peer.
+type reconciler struct {
+	transport   ReconcileTransport
+	stats       *ReconcileStats
+	localNodes  map[string]*Node // nodes of the local tree by hash
+	localChunks map[string]*Node // leaves of the local tree by the root hash of their heap
+	rootHash    []byte
+	chunkSize   int32
+	keySize     int32
+	remote      []*Node // leaves of the peer, with the leafID of the peer
+	local       []*Node // leaves copied from shared subtrees, with a local leafID
+	missing     []ReconcileNode
+}
+
+// Reconcile returns a copy of the tree of the peer reached through transport, fetching only the chunks
+// that are not found in the local tree. The local tree is not modified, and must not be modified during the call.
+// The leaves copied from the local tree keep their leafID, unless it is used by another leaf of the peer.
+// The options are applied to the returned tree as in NewIAVL.
+// ErrRootHashMismatch, ErrLeafHashMismatch or ErrInvalidProof is returned if the peer sends inconsistent hashes,
+// chunks or proofs, eg. because its tree was modified during the reconciliation.
+func Reconcile(local *IAVL, transport ReconcileTransport, options ...TreeOption) (tree *IAVL, stats *ReconcileStats, err error) {
+	r := &reconciler{
+		transport:   transport,
+		stats:       &ReconcileStats{},
+		localNodes:  make(map[string]*Node),
+		localChunks: make(map[string]*Node),
+	}
+	var index func(node *Node)
+	index = func(node *Node) {
+		r.localNodes[string(node.hash)] = node
+		if node.isLeaf() {
+			r.localChunks[string(node.getChunkHash())] = node
+			return
+		}
+		index(node.leftNode)
+		index(node.rightNode)
+	}
+	if local.root != nil {
+		index(local.root)
+	}
+
+	response, err := r.exchange(&ReconcileRequest{})
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(response.RootHash, EmptyRootHash()) {
+		return NewIAVL(r.chunkSize, r.keySize, options...), r.stats, nil
+	}
+	if err = r.walk(); err != nil {
+		return nil, nil, err
+	}
+	if err = r.fetch(); err != nil {
+		return nil, nil, err
+	}
+
+	tree, err = r.rebuild(options...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tree, r.stats, nil
+}
+
+// exchange sends a request to the peer and checks that the response matches it.
+func (r *reconciler) exchange(request *ReconcileRequest) (*ReconcileResponse, error) {
+	r.stats.Rounds++
+	response, err := r.transport.Exchange(request)
+	if err != nil {
+		return nil, err
+	}
+	if r.rootHash == nil {
+		r.rootHash, r.chunkSize, r.keySize = response.RootHash, response.ChunkSize, response.KeySize
+	} else if !bytes.Equal(r.rootHash, response.RootHash) {
+		return nil, errors.Wrap(ErrRootHashMismatch, "the tree of the peer changed")
+	}
+	if len(response.Nodes) != len(request.Paths) || len(response.Chunks) != len(request.Positions) {
+		return nil, errors.New("the response does not match the request")
+	}
+	return response, nil
+}
+
+// walk goes down the tree of the peer level by level, skipping the subtrees and the chunks found in the local tree
+// and collecting the leaves to fetch.
+func (r *reconciler) walk() error {
+	paths := [][]bool{{}}
+	var parents []ReconcileNode // parent of each pair of nodes in paths
+	for len(paths) > 0 {
+		response, err := r.exchange(&ReconcileRequest{Paths: paths})
+		if err != nil {
+			return err
+		}
+		if len(paths[0]) == 0 && !bytes.Equal(response.Nodes[0].Hash, r.rootHash) {
+			return errors.Wrap(ErrRootHashMismatch, "root node")
+		}
+		for i, parent := range parents {
+			left, right := response.Nodes[2*i], response.Nodes[2*i+1]
+			if !bytes.Equal(innerHash(left.Hash, right.Hash, parent.LeafCount, parent.Key), parent.Hash) ||
+				parent.LeafCount != left.leafCount()+right.leafCount() {
+				return errors.Wrapf(ErrRootHashMismatch, "children of the node at path %v", paths[2*i][:len(paths[2*i])-1])
+			}
+		}
+
+		var nextPaths [][]bool
+		var nextParents []ReconcileNode
+		for i, node := range response.Nodes {
+			r.stats.Nodes++
+			if shared, ok := r.localNodes[string(node.Hash)]; ok {
+				r.stats.SharedSubtrees++
+				leaves, err := copyLeaves(shared, r.chunkSize)
+				if err != nil {
+					return err
+				}
+				r.local = append(r.local, leaves...)
+				continue
+			}
+			if node.Height > 0 {
+				nextPaths = append(nextPaths, childPath(paths[i], false), childPath(paths[i], true))
+				nextParents = append(nextParents, node)
+				continue
+			}
+			if shared, ok := r.localChunks[string(node.ChunkHash)]; ok {
+				leaves, err := copyLeaves(shared, r.chunkSize)
+				if err != nil {
+					return err
+				}
+				leaf := leaves[0]
+				leaf.leafID, leaf.keyHeight = node.LeafID, node.KeyHeight
+				leaf.calcHash()
+				if bytes.Equal(leaf.hash, node.Hash) {
+					r.stats.SharedChunks++
+					r.remote = append(r.remote, leaf)
+					continue
+				}
+			}
+			r.missing = append(r.missing, node)
+		}
+		paths, parents = nextPaths, nextParents
+	}
+	return nil
+}
+
+// leafCount returns the number of leaves of the subtree rooted at the node.
+func (node *ReconcileNode) leafCount() uint32 {
+	if node.Height == 0 {
+		return 1
+	}
+	return node.LeafCount
+}
+
+// fetch fetches the missing leaves from the peer and checks them against their hash and their proof,
+// which must prove their position.
+func (r *reconciler) fetch() error {
+	if len(r.missing) == 0 {
+		return nil
+	}
+	request := &ReconcileRequest{}
+	for _, node := range r.missing {
+		request.Positions = append(request.Positions, node.Position)
+	}
+	response, err := r.exchange(request)
+	if err != nil {
+		return err
+	}
+	for i, chunk := range response.Chunks {
+		leaf, err := DeserializeAndVerify(chunk.Leaf, r.chunkSize, r.missing[i].Hash)
+		if err != nil {
+			return err
+		}
+		proof, err := DeserializeProof(chunk.Proof)
+		if err != nil {
+			return err
+		}
+		if err = proof.ValidateChunk(leaf, int(r.missing[i].Position), r.rootHash); err != nil {
+			return err
+		}
+		r.stats.FetchedChunks++
+		r.remote = append(r.remote, leaf)
+	}
+	return nil
+}
+
+// rebuild builds the tree of the peer from the collected leaves and checks its root hash.
+func (r *reconciler) rebuild(options ...TreeOption) (*IAVL, error) {
+	// the leafIDs of the peer are kept, the local leaves are renumbered if needed
+	used := make(map[uint32]bool)
+	var nextLeafID uint32
+	for _, leaf := range r.remote {
+		used[leaf.leafID] = true
+		if leaf.leafID >= nextLeafID {
+			nextLeafID = leaf.leafID + 1
+		}
+	}
+	for _, leaf := range r.local {
+		if used[leaf.leafID] {
+			for used[nextLeafID] {
+				nextLeafID++
+			}
+			leaf.leafID = nextLeafID
+		}
+		used[leaf.leafID] = true
+	}
+
+	list := append(r.remote, r.local...)
+	SortNodeList(list)
+	tree, err := RebuildTree(list, options...)
+	if err != nil {
+		return nil, err
+	}
+	tree.CompleteRehash()
+	if !bytes.Equal(tree.GetRootHash(), r.rootHash) {
+		return nil, errors.Wrap(ErrRootHashMismatch, "reconciled tree")
+	}
+	return tree, nil
+}
+
+// childPath returns the path to a child of the node at path.
+func childPath(path []bool, right bool) []bool {
+	child := make([]bool, len(path)+1)
+	copy(child, path)
+	child[len(path)] = right
+	return child
+}
+
+// copyLeaves returns copies of the leaves of the subtree rooted at node, sorted by key,
+// with chunks of the given size.
+func copyLeaves(node *Node, chunkSize int32) ([]*Node, error) {
+	var leaves []*Node
+	var buffer bytes.Buffer
+	var visit func(node *Node) error
+	visit = func(node *Node) error {
+		if !node.isLeaf() {
+			if err := visit(node.leftNode); err != nil {
+				return err
+			}
+			return visit(node.rightNode)
+		}
+		buffer.Reset()
+		if err := node.Serialize(&buffer); err != nil {
+			return err
+		}
+		leaf, err := Deserialize(buffer.Bytes(), chunkSize)
+		if err != nil {
+			return err
+		}
+		leaves = append(leaves, leaf)
+		return nil
+	}
+	return leaves, visit(node)
+}
@@ -0,0 +1,131 @@
+package bplusavl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// tamperTransport lets a test modify the responses of a peer.
+type tamperTransport struct {
+	*MemoryTransport
+	tamper func(request *ReconcileRequest, response *ReconcileResponse)
+}
+
+func (transport *tamperTransport) Exchange(request *ReconcileRequest) (*ReconcileResponse, error) {
+	response, err := transport.MemoryTransport.Exchange(request)
+	if err == nil {
+		transport.tamper(request, response)
+	}
+	return response, err
+}
+
+func TestReconcile(t *testing.T) {
+	assert := assert.New(t)
+	key := func(k int) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(k))
+		return b
+	}
+	a := NewIAVL(16, 4)
+	for _, k := range rand.Perm(5000) {
+		a.Set(key(2*k), key(k))
+	}
+	var buffer bytes.Buffer
+	assert.NoError(a.ExportSnapshot(&buffer))
+	b, err := ImportSnapshot(buffer.Bytes())
+	assert.NoError(err)
+
+	reconciled, stats, err := Reconcile(a, NewMemoryTransport(b))
+	assert.NoError(err)
+	assert.Equal(b.GetRootHash(), reconciled.GetRootHash())
+	assert.Equal(0, stats.FetchedChunks)
+	assert.Equal(1, stats.SharedSubtrees)
+
+	b.Set(key(2*100), []byte("changed"))
+	b.Set(key(2*3000+1), []byte("added"))
+	b.Remove(key(2 * 4000))
+	reconciled, stats, err = Reconcile(a, NewMemoryTransport(b))
+	assert.NoError(err)
+	assert.Equal(b.GetRootHash(), reconciled.GetRootHash())
+	assert.NoError(reconciled.Verify())
+	assert.LessOrEqual(stats.FetchedChunks+stats.SharedChunks, 6)
+	assert.Less(stats.Nodes, b.GetNumberOfChunks())
+	keys, values := treeEntries(b)
+	reconciledKeys, reconciledValues := treeEntries(reconciled)
+	assert.Equal(keys, reconciledKeys)
+	assert.Equal(values, reconciledValues)
+	// the local tree is not modified, the reconciled tree can be modified
+	assert.Equal(key(100), a.Get(key(2*100)))
+	_, err = reconciled.Set(key(1), []byte("new"))
+	assert.NoError(err)
+
+	// from an empty tree, every chunk is fetched
+	reconciled, stats, err = Reconcile(NewIAVL(16, 4), NewMemoryTransport(b))
+	assert.NoError(err)
+	assert.Equal(b.GetRootHash(), reconciled.GetRootHash())
+	assert.Equal(b.GetNumberOfChunks(), stats.FetchedChunks)
+
+	// to an empty tree
+	reconciled, _, err = Reconcile(a, NewMemoryTransport(NewIAVL(16, 4)))
+	assert.NoError(err)
+	assert.Equal(EmptyRootHash(), reconciled.GetRootHash())
+	_, err = reconciled.Set(key(1), key(1))
+	assert.NoError(err)
+}
+
+func TestReconcileTampered(t *testing.T) {
+	assert := assert.New(t)
+	a := NewIAVL(4, 1)
+	for k := 0; k < 200; k++ {
+		a.Set([]byte{byte(k)}, []byte{byte(k)})
+	}
+	b := NewIAVL(4, 1)
+	for k := 0; k < 200; k++ {
+		b.Set([]byte{byte(k)}, []byte{byte(k + k%3)})
+	}
+
+	// a node hash that does not match its parent
+	transport := &tamperTransport{NewMemoryTransport(b), func(request *ReconcileRequest, response *ReconcileResponse) {
+		if len(response.Nodes) > 1 {
+			response.Nodes[1].Hash = append([]byte{}, response.Nodes[1].Hash...)
+			response.Nodes[1].Hash[0]++
+		}
+	}}
+	_, _, err := Reconcile(a, transport)
+	assert.Equal(ErrRootHashMismatch, errors.Cause(err))
+
+	// a chunk that does not match its hash
+	transport.tamper = func(request *ReconcileRequest, response *ReconcileResponse) {
+		if len(response.Chunks) > 1 {
+			response.Chunks[0] = response.Chunks[1]
+		}
+	}
+	_, _, err = Reconcile(a, transport)
+	assert.Equal(ErrLeafHashMismatch, errors.Cause(err))
+
+	// a proof that does not lead to the root hash
+	transport.tamper = func(request *ReconcileRequest, response *ReconcileResponse) {
+		if len(response.Chunks) > 1 {
+			response.Chunks[0].Proof = response.Chunks[1].Proof
+		}
+	}
+	_, _, err = Reconcile(a, transport)
+	assert.Equal(ErrInvalidProof, errors.Cause(err))
+
+	// a peer modified during the reconciliation
+	transport.tamper = func(request *ReconcileRequest, response *ReconcileResponse) {
+		b.Set([]byte{0}, []byte("changed"))
+	}
+	_, _, err = Reconcile(a, transport)
+	assert.Equal(ErrRootHashMismatch, errors.Cause(err))
+
+	_, err = ServeReconcile(b, &ReconcileRequest{Paths: [][]bool{make([]bool, 100)}})
+	assert.Equal(ErrIndexOutOfRange, errors.Cause(err))
+	_, err = ServeReconcile(b, &ReconcileRequest{Positions: []int32{1000}})
+	assert.Equal(ErrIndexOutOfRange, errors.Cause(err))
+}
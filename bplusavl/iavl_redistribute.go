@@ -0,0 +1,73 @@
+package bplusavl
+
+import "bytes"
+
+// WithRedistribution makes the tree move K-V pairs from a full leaf to an adjacent leaf before splitting it,
+// like a B*-tree. A full leaf is only split when both neighbours are full (have less than two free slots).
+// This improves the fill factor of the chunks and reduces the height of the tree.
+// Redistribution is not applied to chunks sized by bytes (see WithChunkBytes).
+func WithRedistribution() TreeOption {
+	return func(tree *IAVL) {
+		tree.redistribution = true
+	}
+}
+
+// redistribute makes room in the full leaf by moving K-V pairs to the neighbour with the fewest keys,
+// so that both leaves have room for a new key. The separator key of the two leaves is the smallest key
+// of the right one: the inner node pointing to it shares the chunk memory, hence it is updated by the move.
+// The sizes and hashes on the paths to both leaves are updated.
+// Nothing is moved if both neighbours are full. An error is returned if a chunk cannot be loaded.
+func (tree *IAVL) redistribute(leaf *Node) error {
+	var neighbour *Node
+	for _, candidate := range []*Node{leaf.nextLeaf, leaf.prevLeaf} {
+		// after the move, both leaves must have room for the new key
+		if candidate == nil || candidate.size > tree.chunkSize-2 {
+			continue
+		}
+		if neighbour == nil || candidate.size < neighbour.size {
+			neighbour = candidate
+		}
+	}
+	if neighbour == nil {
+		return nil
+	}
+	chunk, err := leaf.getChunk()
+	if err != nil {
+		return err
+	}
+	neighbourChunk, err := neighbour.getChunk()
+	if err != nil {
+		return err
+	}
+
+	count := (chunk.GetCurrSize() - neighbourChunk.GetCurrSize()) / 2
+	if neighbour == leaf.nextLeaf {
+		err = chunk.MoveLastTo(neighbourChunk, count)
+	} else {
+		err = chunk.MoveFirstTo(neighbourChunk, count)
+	}
+	if err != nil {
+		// the chunks are left unchanged: the leaf is split instead
+		return nil
+	}
+	leaf.size = chunk.GetCurrSize()
+	neighbour.size = neighbourChunk.GetCurrSize()
+	tree.root.refreshDownTo(chunk.GetSmallestKeyUnsafe())
+	tree.root.refreshDownTo(neighbourChunk.GetSmallestKeyUnsafe())
+	return nil
+}
+
+// refreshDownTo invalidates the hashes and recomputes the sizes on the path from n to the leaf
+// whose smallest key is targetLeafSmallestKey.
+func (n *Node) refreshDownTo(targetLeafSmallestKey []byte) {
+	n.hashIsValid = false
+	if n.isLeaf() {
+		return
+	}
+	if bytes.Compare(targetLeafSmallestKey, n.key) == -1 {
+		n.leftNode.refreshDownTo(targetLeafSmallestKey)
+	} else {
+		n.rightNode.refreshDownTo(targetLeafSmallestKey)
+	}
+	n.size = n.leftNode.size + n.rightNode.size
+}
@@ -0,0 +1,69 @@
+package bplusavl
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedistribution(t *testing.T) {
+	assert := assert.New(t)
+	for _, sequential := range []bool{true, false} {
+		tree := NewIAVL(16, 4, WithRedistribution())
+		splitTree := NewIAVL(16, 4)
+		fillTree(tree, 3000, sequential)
+		fillTree(splitTree, 3000, sequential)
+		assert.Nil(tree.Verify())
+
+		for i := 0; i < 3000; i++ {
+			key := make([]byte, 4)
+			binary.BigEndian.PutUint32(key, uint32(i))
+			assert.Equal(key, tree.Get(key))
+			indexKey, _ := tree.GetByIndex(i)
+			assert.Equal(key, indexKey)
+		}
+		if !sequential {
+			// random insertions find neighbours with space
+			assert.True(fillFactor(tree) > fillFactor(splitTree)+0.1)
+			assert.True(tree.GetNumberOfChunks() < splitTree.GetNumberOfChunks())
+		}
+
+		// the leaves describe the same tree
+		var leafList []*Node
+		for leaf := tree.firstLeaf; leaf != nil; leaf = leaf.nextLeaf {
+			leafList = append(leafList, leaf)
+		}
+		rebuiltTree, err := RebuildTree(leafList)
+		assert.NoError(err)
+		rebuiltTree.CompleteRehash()
+		assert.Equal(tree.GetRootHash(), rebuiltTree.GetRootHash())
+	}
+}
+
+func TestRedistributionMovesSeparator(t *testing.T) {
+	assert := assert.New(t)
+	tree := NewIAVL(4, 1, WithRedistribution())
+	for _, k := range []byte{10, 20, 30, 40, 50} {
+		tree.Set([]byte{k}, []byte{k})
+	}
+	// leaves: [10 20] [30 40 50]
+	tree.Set([]byte{31}, []byte{31})
+	// the right leaf is full: a key is moved to the left leaf instead of splitting
+	_, err := tree.Set([]byte{32}, []byte{32})
+	assert.NoError(err)
+	assert.Equal(2, tree.GetNumberOfChunks())
+	assert.Equal([]byte{31}, tree.root.key)
+	assert.Equal(3, tree.GetLeaf(0).Len())
+	assert.Equal(4, tree.GetLeaf(1).Len())
+	assert.Nil(tree.Verify())
+
+	proof, err := tree.GetElementProof([]byte{30})
+	assert.NoError(err)
+	assert.Equal(tree.GetRootHash(), proof.ValidateProof([]byte{30}, []byte{30}))
+
+	// both leaves are full now: the next insertion splits
+	tree.Set([]byte{33}, []byte{33})
+	assert.Equal(3, tree.GetNumberOfChunks())
+	assert.Nil(tree.Verify())
+}
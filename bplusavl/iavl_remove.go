@@ -0,0 +1,124 @@
+package bplusavl
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+)
+
+// Remove removes a key from the tree and returns its value. It returns false if the key is not in the tree.
+// A leaf whose last key is removed is removed from the tree. Leaves are not merged otherwise,
+// unless the tree has a canonical shape (see WithCanonicalShape).
+// An error is returned, and the tree is left unchanged, if the key does not have the key size of the tree
+// or the tree is read-only (see OpenMappedSnapshot).
+func (tree *IAVL) Remove(key []byte) (value []byte, removed bool, err error) {
+	if int32(len(key)) != tree.keySize {
+		return nil, false, errors.Wrapf(ErrInvalidKeySize, "key %x of %d bytes, expected %d", key, len(key), tree.keySize)
+	}
+	if tree.root == nil {
+		return nil, false, nil
+	}
+	tree.cache.hold()
+	defer tree.cache.release()
+	chunk, err := tree.root.getLeaf(key).getChunk()
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "at key %x", key)
+	}
+	value = copyBytes(chunk.Get(key))
+	if value == nil {
+		return nil, false, nil
+	}
+	if chunk.IsReadOnly() {
+		return nil, false, errors.Wrapf(ErrReadOnly, "at key %x", key)
+	}
+	if tree.canonical {
+		if _, err = tree.canonicalUpdate(key, nil); err != nil {
+			return nil, false, err
+		}
+		tree.recursiveHash()
+		return value, true, nil
+	}
+
+	var newLeftmost *Node
+	tree.root, newLeftmost = tree.recursiveRemove(tree.root, key)
+	if tree.root == nil {
+		tree.firstLeaf = nil
+		return value, true, nil
+	}
+	if newLeftmost != nil {
+		// the left-most leaf was removed: the following leaf does not provide a key any more
+		newLeftmost.keyHeight = 0
+		tree.root.setHashInvalidDownTo(newLeftmost.getSmallestKey())
+		tree.firstLeaf = newLeftmost
+	}
+	tree.recursiveHash()
+	return value, true, nil
+}
+
+// recursiveRemove removes the key, which must be in the tree and whose leaf must be loaded, from the subtree
+// rooted at node.
+// It returns the new root of the subtree, nil if the subtree was a leaf that has been removed.
+// If the left-most leaf of the subtree has been removed, the new left-most leaf is returned as newLeftmost:
+// its smallest key must become the key of the first ancestor that has the subtree on its right.
+func (tree *IAVL) recursiveRemove(node *Node, key []byte) (newSelf *Node, newLeftmost *Node) {
+	if node.isLeaf() {
+		if node.size > 1 {
+			// the smallest key may change: the inner node pointing to the leaf shares the chunk memory
+			node.chunk.Remove(key)
+			node.size -= 1
+			node.hashIsValid = false
+			return node, nil
+		}
+		tree.removeLeaf(node)
+		return nil, node.nextLeaf
+	}
+
+	if bytes.Compare(key, node.key) < 0 {
+		var newLeft *Node
+		newLeft, newLeftmost = tree.recursiveRemove(node.getLeftNode(), key)
+		if newLeft == nil {
+			// the left leaf is removed: the right subtree takes the place of the node,
+			// and the node no longer provides the key of the right subtree's left-most leaf
+			return node.rightNode, newLeftmost
+		}
+		node.leftNode = newLeft
+		node.leftHash = nil
+	} else {
+		var newRight *Node
+		newRight, newLeftmost = tree.recursiveRemove(node.getRightNode(), key)
+		if newRight == nil {
+			// the right leaf is removed together with the node, whose key it provided
+			return node.leftNode, nil
+		}
+		node.rightNode = newRight
+		node.rightHash = nil
+		if newLeftmost != nil {
+			// the smallest key of the right subtree changed. The following leaf is not loaded if it is evicted
+			node.key = newLeftmost.getSmallestKey()
+			node.leafPointer = newLeftmost
+			newLeftmost = nil
+		}
+	}
+	node.hashIsValid = false
+	node.calcHeightAndSize()
+	return tree.balance(node), newLeftmost
+}
+
+// removeLeaf removes the leaf from the leaf chain and the chunk list, and from the leaves to commit.
+func (tree *IAVL) removeLeaf(leaf *Node) {
+	tree.unlinkLeaf(leaf)
+	delete(tree.dirtyLeaves, leaf.leafID)
+	tree.removedLeaves[leaf.leafID] = true
+}
+
+// unlinkLeaf removes the leaf from the leaf chain, the chunk list and the cache.
+func (tree *IAVL) unlinkLeaf(leaf *Node) {
+	tree.chunkList.remove(leaf)
+	tree.cache.remove(leaf)
+	if leaf.prevLeaf != nil {
+		leaf.prevLeaf.nextLeaf = leaf.nextLeaf
+	}
+	if leaf.nextLeaf != nil {
+		leaf.nextLeaf.prevLeaf = leaf.prevLeaf
+	}
+}
@@ -0,0 +1,83 @@
+package bplusavl
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoveSmallTree(t *testing.T) {
+	assert := assert.New(t)
+	tree := NewIAVL(4, 1)
+	for k := byte(10); k <= 100; k += 10 {
+		tree.Set([]byte{k}, []byte{k})
+	}
+
+	value, removed, err := tree.Remove([]byte{15})
+	assert.NoError(err)
+	assert.False(removed)
+	assert.Nil(value)
+	_, _, err = tree.Remove([]byte{1, 2})
+	assert.True(errors.Is(err, ErrInvalidKeySize))
+
+	for k := byte(10); k <= 100; k += 10 {
+		value, removed, err = tree.Remove([]byte{k})
+		assert.NoError(err)
+		assert.True(removed)
+		assert.Equal([]byte{k}, value)
+		assert.Nil(tree.Get([]byte{k}))
+		assert.Nil(tree.Verify(), "after removing %d", k)
+	}
+	assert.Equal(EmptyRootHash(), tree.GetRootHash())
+	assert.Equal(0, tree.GetNumberOfChunks())
+
+	_, err = tree.Set([]byte{1}, []byte{1})
+	assert.NoError(err)
+	assert.Equal([]byte{1}, tree.Get([]byte{1}))
+	assert.Nil(tree.Verify())
+}
+
+func TestRemoveRandom(t *testing.T) {
+	assert := assert.New(t)
+	tree := NewIAVL(8, 2)
+	content := make(map[uint16][]byte)
+	for i := 0; i < 5000; i++ {
+		k := uint16(rand.Intn(1000))
+		key := make([]byte, 2)
+		binary.BigEndian.PutUint16(key, k)
+		if rand.Intn(3) == 0 {
+			value, removed, err := tree.Remove(key)
+			assert.NoError(err)
+			assert.Equal(content[k] != nil, removed)
+			assert.Equal(content[k], value)
+			delete(content, k)
+		} else {
+			value := []byte{byte(i), byte(i >> 8)}
+			tree.Set(key, value)
+			content[k] = value
+		}
+		if i%250 == 0 {
+			assert.Nil(tree.Verify())
+		}
+	}
+	assert.Nil(tree.Verify())
+	assert.Equal(len(content), tree.Stats().Keys)
+	for k, value := range content {
+		key := make([]byte, 2)
+		binary.BigEndian.PutUint16(key, k)
+		assert.Equal(value, tree.Get(key))
+	}
+
+	// the leaves describe the same tree
+	var leafList []*Node
+	for leaf := tree.firstLeaf; leaf != nil; leaf = leaf.nextLeaf {
+		leafList = append(leafList, leaf)
+	}
+	rebuiltTree, err := RebuildTree(leafList)
+	assert.NoError(err)
+	rebuiltTree.CompleteRehash()
+	assert.Equal(tree.GetRootHash(), rebuiltTree.GetRootHash())
+}
@@ -0,0 +1,94 @@
+package bplusavl
+
+import (
+	"bytes"
+	"crypto/sha256"
+)
+
+// FillHistogramBuckets is the number of buckets in TreeStats.FillHistogram.
+const FillHistogramBuckets = 10
+
+// TreeStats contains statistics about the content and the memory usage of a tree.
+type TreeStats struct {
+	Keys       int // number of K-V pairs
+	Chunks     int // number of leaves (= chunks)
+	InnerNodes int // number of inner nodes
+	Height     int // height of the root node
+
+	// FillHistogram[i] counts the chunks whose fill factor (keys / chunk size) is in [i/10, (i+1)/10).
+	// If the chunks are sized by bytes (see WithChunkBytes), the fill factor is serialized size / target size.
+	// Full chunks are counted in the last bucket.
+	FillHistogram [FillHistogramBuckets]int
+
+	KeyBytes         int // bytes used by the keys, including their metadata
+	ValueBytes       int // bytes used by the values
+	WastedValueBytes int // bytes allocated for values no longer mapped to a key
+	HashBytes        int // bytes used by the hashes of inner nodes, leaves and heaps
+
+	AverageProofLength float64 // average length of an element proof (see IAVLElementProof.GetLength)
+	LargestValue       int     // size of the largest value
+}
+
+// Stats computes statistics about the tree by going through its chunk list once.
+// Empty statistics are returned if a leaf cannot be loaded (see IAVL.Err).
+func (tree *IAVL) Stats() TreeStats {
+	var stats TreeStats
+	if tree.root == nil {
+		return stats
+	}
+	stats.Height = int(tree.root.height)
+
+	proofLengthSum := 0
+	for i := 0; i < tree.chunkList.GetNumberOfChunks(); i++ {
+		leaf := tree.chunkList.GetChunk(i)
+		chunk, err := leaf.getChunk()
+		if err != nil {
+			return TreeStats{}
+		}
+		chunkStats := chunk.GetStats()
+
+		stats.Chunks++
+		stats.Keys += int(chunkStats.Keys)
+		stats.KeyBytes += chunkStats.KeyBytes
+		stats.ValueBytes += chunkStats.ValueBytes
+		stats.WastedValueBytes += chunkStats.WastedValueBytes
+		stats.HashBytes += chunkStats.HashBytes + len(leaf.hash)
+		if int(chunkStats.LargestValue) > stats.LargestValue {
+			stats.LargestValue = int(chunkStats.LargestValue)
+		}
+
+		bucket := int(chunkStats.Keys) * FillHistogramBuckets / int(tree.chunkSize)
+		if tree.chunkBytes > 0 {
+			bucket = chunk.SerializedSize() * FillHistogramBuckets / int(tree.chunkBytes)
+		}
+		if bucket >= FillHistogramBuckets {
+			bucket = FillHistogramBuckets - 1
+		}
+		stats.FillHistogram[bucket]++
+
+		// every key in the chunk shares the path from the root to the leaf
+		proofLengthSum += chunkStats.ProofLengthSum + int(chunkStats.Keys)*tree.leafDepth(leaf)
+	}
+
+	// inner nodes are binary: there is one less inner node than leaves
+	stats.InnerNodes = stats.Chunks - 1
+	stats.HashBytes += stats.InnerNodes * sha256.Size
+	if stats.Keys > 0 {
+		stats.AverageProofLength = float64(proofLengthSum) / float64(stats.Keys)
+	}
+	return stats
+}
+
+// leafDepth returns the number of inner nodes on the path from the root to the leaf.
+func (tree *IAVL) leafDepth(leaf *Node) int {
+	key := leaf.getSmallestKey()
+	depth := 0
+	for currNode := tree.root; !currNode.isLeaf(); depth++ {
+		if bytes.Compare(key, currNode.key) == -1 {
+			currNode = currNode.leftNode
+		} else {
+			currNode = currNode.rightNode
+		}
+	}
+	return depth
+}
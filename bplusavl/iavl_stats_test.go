@@ -0,0 +1,54 @@
+package bplusavl
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStats(t *testing.T) {
+	assert := assert.New(t)
+	tree := NewIAVL(int32(16), int32(4))
+	assert.Equal(TreeStats{}, tree.Stats())
+
+	size := 3000
+	rand.Seed(time.Now().UnixNano())
+	x := rand.Perm(size)
+	for _, elem := range x {
+		num := make([]byte, 4)
+		binary.BigEndian.PutUint32(num, uint32(elem))
+		tree.Set(num, num)
+	}
+	// make one value larger than the others, leaving its old value unused
+	largest := make([]byte, 100)
+	tree.Set(binary.BigEndian.AppendUint32(nil, uint32(x[0])), largest)
+
+	stats := tree.Stats()
+	assert.Equal(size, stats.Keys)
+	assert.Equal(tree.GetNumberOfChunks(), stats.Chunks)
+	assert.Equal(stats.Chunks-1, stats.InnerNodes)
+	assert.Equal(int(tree.root.height), stats.Height)
+	assert.Equal(100, stats.LargestValue)
+	assert.Equal((size-1)*4+100, stats.ValueBytes)
+	assert.Equal(4, stats.WastedValueBytes)
+
+	chunksInHistogram := 0
+	for _, count := range stats.FillHistogram {
+		chunksInHistogram += count
+	}
+	assert.Equal(stats.Chunks, chunksInHistogram)
+
+	// the average proof length must match the one of the actual proofs
+	proofLengthSum := 0
+	for _, elem := range x {
+		num := make([]byte, 4)
+		binary.BigEndian.PutUint32(num, uint32(elem))
+		proof, err := tree.GetElementProof(num)
+		assert.Nil(err)
+		proofLengthSum += proof.GetLength()
+	}
+	assert.InDelta(float64(proofLengthSum)/float64(size), stats.AverageProofLength, 1e-9)
+}
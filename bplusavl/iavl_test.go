@@ -1,12 +1,14 @@
 package bplusavl
 
 import (
+	hchunk "bplus/chunk"
 	"bytes"
 	"encoding/binary"
 	"math/rand"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -72,3 +74,324 @@ func TestRandomTreeTest(t *testing.T) {
 	assert.Equal(size, int(tree.root.size))
 	assert.True(tree.root.isBalancedRecursive())
 }
+
+func TestEmptyTree(t *testing.T) {
+	assert := assert.New(t)
+	tree := NewIAVL(int32(4), int32(1))
+
+	assert.Nil(tree.Get([]byte{1}))
+	assert.False(tree.ViewValue([]byte{1}, func(value []byte) {}))
+	assert.Equal(EmptyRootHash(), tree.GetRootHash())
+	assert.False(tree.isFull())
+	assert.True(tree.isBalanced())
+	tree.CompleteRehash()
+	assert.Nil(tree.Verify())
+
+	_, err := tree.GetElementProof([]byte{1})
+	assert.NotNil(err)
+	_, _, err = tree.GetChunkProof(0)
+	assert.NotNil(err)
+
+	// the absence proof of an empty tree validates to the empty root hash
+	proof, err := tree.GetAbsenceProof([]byte{1})
+	assert.Nil(err)
+	rootHash, err := proof.ValidateProof([]byte{1})
+	assert.Nil(err)
+	assert.True(bytes.Equal(tree.GetRootHash(), rootHash))
+	keys, _ := proof.GetEntries([]byte{1})
+	assert.Empty(keys)
+
+	// empty trees can be exported and imported
+	var buffer bytes.Buffer
+	assert.Nil(tree.ExportSnapshot(&buffer))
+	importedTree, err := ImportSnapshot(buffer.Bytes())
+	assert.Nil(err)
+	assert.Equal(EmptyRootHash(), importedTree.GetRootHash())
+	importedTree.Set([]byte{1}, []byte{1})
+	assert.Equal([]byte{1}, importedTree.Get([]byte{1}))
+
+	// the first key of an empty tree is a new key, then setting it again is an update
+	for _, options := range [][]TreeOption{nil, {WithCanonicalShape()}, {WithChunkBytes(256)}} {
+		empty := NewIAVL(4, 1, options...)
+		updated, err := empty.Set([]byte{1}, []byte{1})
+		assert.NoError(err)
+		assert.False(updated)
+		updated, err = empty.Set([]byte{1}, []byte{2})
+		assert.NoError(err)
+		assert.True(updated)
+	}
+
+	rebuiltTree, err := RebuildTree(nil)
+	assert.NoError(err)
+	assert.Equal(EmptyRootHash(), rebuiltTree.GetRootHash())
+	assert.Equal(0, rebuiltTree.GetNumberOfChunks())
+
+	// absence proofs in a non-empty tree
+	keys = [][]byte{{10}, {50}, {30}, {40}, {60}, {20}, {70}, {100}, {80}, {90}}
+	for _, key := range keys {
+		tree.Set(key, key)
+	}
+	_, err = tree.GetAbsenceProof([]byte{30})
+	assert.NotNil(err)
+	for _, absent := range []byte{0, 15, 35, 95, 200} {
+		proof, err = tree.GetAbsenceProof([]byte{absent})
+		assert.Nil(err)
+		rootHash, err = proof.ValidateProof([]byte{absent})
+		assert.Nil(err)
+		assert.True(bytes.Equal(tree.GetRootHash(), rootHash))
+		found, _ := proof.GetEntries([]byte{absent})
+		assert.Empty(found)
+	}
+}
+
+// TestInvalidInput checks that invalid inputs are reported as errors instead of panics,
+// and that a failed Set leaves the tree unchanged.
+func TestInvalidInput(t *testing.T) {
+	assert := assert.New(t)
+	tree := NewIAVL(4, 2)
+	for i := byte(0); i < 20; i++ {
+		_, err := tree.Set([]byte{i, i}, []byte{i})
+		assert.NoError(err)
+	}
+	rootHash := tree.GetRootHash()
+
+	_, err := tree.Set([]byte{1, 1}, nil)
+	assert.True(errors.Is(err, ErrNilValue))
+	_, err = tree.Set([]byte{1}, []byte{1})
+	assert.True(errors.Is(err, ErrInvalidKeySize))
+	_, err = tree.Set([]byte{50, 50}, make([]byte, 70000))
+	assert.True(errors.Is(err, ErrValueTooLarge))
+	_, err = tree.Set([]byte{1, 1}, make([]byte, 70000))
+	assert.True(errors.Is(err, ErrValueTooLarge))
+	assert.Equal(rootHash, tree.GetRootHash())
+	assert.Equal(int32(20), tree.root.size)
+	assert.Nil(tree.Verify())
+
+	var buffer bytes.Buffer
+	assert.Equal(ErrNotLeaf, tree.root.Serialize(&buffer))
+	_, err = tree.root.GetChunkSize()
+	assert.Equal(ErrNotLeaf, err)
+	assert.True(errors.Is(tree.SerializeLeafChunk(-1, &buffer), ErrIndexOutOfRange))
+	assert.True(errors.Is(tree.SerializeLeafChunkWithChecksum(tree.GetNumberOfChunks(), &buffer), ErrIndexOutOfRange))
+	assert.True(errors.Is(tree.SerializeChunk(100, &buffer), ErrIndexOutOfRange))
+	assert.Nil(tree.GetLeaf(-1))
+	assert.Equal(0, buffer.Len())
+
+	// a tree rebuilt from no leaves does not know its chunk size and key size
+	emptyTree, err := RebuildTree(nil)
+	assert.NoError(err)
+	_, err = emptyTree.Set([]byte{1, 1}, []byte{1})
+	assert.Equal(ErrInvalidParameters, errors.Cause(err))
+
+	// the heap of a chunk requires an even chunk size
+	oddTree := NewIAVL(7, 4)
+	_, err = oddTree.Set([]byte{1, 2, 3, 4}, []byte{1})
+	assert.Equal(ErrInvalidParameters, errors.Cause(err))
+	assert.Equal(0, oddTree.GetNumberOfChunks())
+}
+
+// fillTree inserts n keys, in increasing order if sequential is set, or in random order otherwise.
+func fillTree(tree *IAVL, n int, sequential bool) {
+	order := rand.Perm(n)
+	for i := 0; i < n; i++ {
+		key := make([]byte, 4)
+		if sequential {
+			binary.BigEndian.PutUint32(key, uint32(i))
+		} else {
+			binary.BigEndian.PutUint32(key, uint32(order[i]))
+		}
+		tree.Set(key, key)
+	}
+}
+
+// fillFactor returns the average fraction of used key slots in the chunks of the tree.
+func fillFactor(tree *IAVL) float64 {
+	stats := tree.Stats()
+	return float64(stats.Keys) / float64(stats.Chunks*int(tree.chunkSize))
+}
+
+func TestSplitPolicy(t *testing.T) {
+	assert := assert.New(t)
+	for _, policy := range []hchunk.SplitPolicy{hchunk.SplitMidpoint, hchunk.SplitAppend, hchunk.SplitBySize} {
+		for _, sequential := range []bool{true, false} {
+			tree := NewIAVL(32, 4, WithSplitPolicy(policy))
+			fillTree(tree, 5000, sequential)
+			assert.Nil(tree.Verify())
+			assert.Equal(5000, tree.Stats().Keys)
+			for i := uint32(0); i < 5000; i += 7 {
+				key := make([]byte, 4)
+				binary.BigEndian.PutUint32(key, i)
+				assert.Equal(key, tree.Get(key))
+			}
+			if policy == hchunk.SplitAppend && sequential {
+				assert.True(fillFactor(tree) > 0.85)
+			}
+		}
+	}
+
+	// sequential inserts leave the chunks half empty with midpoint splits
+	tree := NewIAVL(32, 4)
+	fillTree(tree, 5000, true)
+	assert.True(fillFactor(tree) < 0.55)
+}
+
+// BenchmarkSplitPolicy reports the fill factor of the chunks for each split policy,
+// with sequential and random insertions.
+func BenchmarkSplitPolicy(b *testing.B) {
+	for _, policy := range []hchunk.SplitPolicy{hchunk.SplitMidpoint, hchunk.SplitAppend, hchunk.SplitBySize} {
+		for _, sequential := range []bool{true, false} {
+			workload := "random"
+			if sequential {
+				workload = "sequential"
+			}
+			b.Run(policy.String()+"/"+workload, func(b *testing.B) {
+				var tree *IAVL
+				for i := 0; i < b.N; i++ {
+					tree = NewIAVL(64, 4, WithSplitPolicy(policy))
+					fillTree(tree, 10000, sequential)
+				}
+				b.ReportMetric(fillFactor(tree), "fill")
+			})
+		}
+	}
+}
+
+func TestChunkBytes(t *testing.T) {
+	assert := assert.New(t)
+	tree := NewIAVL(64, 4, WithChunkBytes(4096))
+	values := make(map[uint32][]byte)
+	for i := 0; i < 2000; i++ {
+		key := rand.Uint32()
+		value := make([]byte, 10+rand.Intn(1000))
+		rand.Read(value)
+		values[key] = value
+		keyBytes := make([]byte, 4)
+		binary.BigEndian.PutUint32(keyBytes, key)
+		_, err := tree.Set(keyBytes, value)
+		assert.NoError(err)
+	}
+	assert.Nil(tree.Verify())
+
+	for leaf := tree.GetLeaf(0); leaf != nil; leaf = leaf.Next() {
+		size := leaf.leaf.chunk.SerializedSize()
+		assert.True(size <= 4096, "chunk of %d bytes", size)
+	}
+	for key, value := range values {
+		keyBytes := make([]byte, 4)
+		binary.BigEndian.PutUint32(keyBytes, key)
+		assert.Equal(value, tree.Get(keyBytes))
+	}
+
+	// the target survives a snapshot if the option is given again
+	var buffer bytes.Buffer
+	assert.NoError(tree.ExportSnapshot(&buffer))
+	importedTree, err := ImportSnapshot(buffer.Bytes(), WithChunkBytes(4096))
+	assert.NoError(err)
+	assert.Equal(int32(4096), importedTree.GetLeaf(0).leaf.chunk.GetTargetBytes())
+	_, err = importedTree.Set([]byte{1, 2, 3, 4}, make([]byte, 1000))
+	assert.NoError(err)
+	assert.Nil(importedTree.Verify())
+}
+
+func TestChunkBytesUpdates(t *testing.T) {
+	assert := assert.New(t)
+	tree := NewIAVL(64, 4, WithChunkBytes(4096))
+	values := make(map[uint32][]byte)
+	for i := 0; i < 1000; i++ {
+		key := uint32(i)
+		values[key] = make([]byte, 10)
+		keyBytes := make([]byte, 4)
+		binary.BigEndian.PutUint32(keyBytes, key)
+		_, err := tree.Set(keyBytes, values[key])
+		assert.NoError(err)
+	}
+	chunks := tree.GetNumberOfChunks()
+
+	// growing and shrinking values split the chunks that exceed the target, without leaving holes
+	for i := 0; i < 5000; i++ {
+		key := uint32(rand.Intn(1000))
+		value := make([]byte, rand.Intn(1000))
+		rand.Read(value)
+		values[key] = value
+		keyBytes := make([]byte, 4)
+		binary.BigEndian.PutUint32(keyBytes, key)
+		updated, err := tree.Set(keyBytes, value)
+		assert.NoError(err)
+		assert.True(updated)
+	}
+	assert.Nil(tree.Verify())
+	assert.Greater(tree.GetNumberOfChunks(), chunks)
+	assert.Equal(int32(1000), tree.root.size)
+	for leaf := tree.GetLeaf(0); leaf != nil; leaf = leaf.Next() {
+		size := leaf.leaf.chunk.SerializedSize()
+		assert.True(size <= 4096 || leaf.Len() == 1, "chunk of %d bytes", size)
+	}
+	for key, value := range values {
+		keyBytes := make([]byte, 4)
+		binary.BigEndian.PutUint32(keyBytes, key)
+		assert.Equal(value, tree.Get(keyBytes))
+	}
+}
+
+// TestChunkBytesNearTarget sets values close to the target, which cannot always be split around the K-V pair.
+func TestChunkBytesNearTarget(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		target             int32
+		minValue, maxValue int
+		sets               int
+	}{
+		{300, 0, 200, 3000},
+		{4096, 2000, 4000, 2000},
+		{65536, 10, 60000, 300},
+	}
+	for _, test := range tests {
+		for _, policy := range []hchunk.SplitPolicy{hchunk.SplitMidpoint, hchunk.SplitAppend, hchunk.SplitBySize} {
+			tree := NewIAVL(8, 4, WithChunkBytes(test.target), WithSplitPolicy(policy))
+			values := make(map[uint32][]byte)
+			for i := 0; i < test.sets; i++ {
+				key := uint32(rand.Intn(test.sets))
+				value := make([]byte, test.minValue+rand.Intn(test.maxValue-test.minValue+1))
+				rand.Read(value)
+				values[key] = value
+				keyBytes := make([]byte, 4)
+				binary.BigEndian.PutUint32(keyBytes, key)
+				_, err := tree.Set(keyBytes, value)
+				assert.NoError(err, "target %d, %s policy", test.target, policy)
+			}
+			assert.Nil(tree.Verify(), "target %d, %s policy", test.target, policy)
+			assert.Equal(int32(len(values)), tree.root.size)
+			for leaf := tree.GetLeaf(0); leaf != nil; leaf = leaf.Next() {
+				size := leaf.leaf.chunk.SerializedSize()
+				assert.True(size <= int(test.target) || leaf.Len() == 1, "chunk of %d bytes", size)
+			}
+			for key, value := range values {
+				keyBytes := make([]byte, 4)
+				binary.BigEndian.PutUint32(keyBytes, key)
+				assert.Equal(value, tree.Get(keyBytes))
+			}
+		}
+	}
+}
+
+func TestChunkBytesProofs(t *testing.T) {
+	assert := assert.New(t)
+	// with 4-byte keys, a 512-byte target used to give an odd number of keys per chunk
+	tree := NewIAVL(64, 4, WithChunkBytes(512))
+	assert.Equal(int32(0), tree.chunkSize%2)
+	for _, k := range rand.Perm(2000) {
+		key := make([]byte, 4)
+		binary.BigEndian.PutUint32(key, uint32(k))
+		_, err := tree.Set(key, make([]byte, k%50))
+		assert.NoError(err)
+	}
+	assert.Nil(tree.Verify())
+	rootHash := tree.GetRootHash()
+	for k := 0; k < 2000; k++ {
+		key := make([]byte, 4)
+		binary.BigEndian.PutUint32(key, uint32(k))
+		proof, err := tree.GetElementProof(key)
+		assert.NoError(err)
+		assert.Equal(rootHash, proof.ValidateProof(key, make([]byte, k%50)), "key %d", k)
+	}
+}
@@ -0,0 +1,176 @@
+package bplusavl
+
+import (
+	"bytes"
+	"crypto/sha256"
+
+	"github.com/pkg/errors"
+)
+
+// Verify checks every structural invariant of the tree and returns an error describing the first violation found.
+// It checks the AVL balance (the crit-bit shape of a canonical tree, see WithCanonicalShape), the height and size
+// of every node, that the key of every inner node is the smallest key of its right subtree and that its leafPointer
+// points to the leaf providing that key with a matching keyHeight,
+// that the leaf chain (in both directions) and the chunk list list the leaves in the same order,
+// that every chunk is consistent (see HeapChunk.Verify) and that every cached hash matches the recomputed one.
+// It is meant for tests and debugging, since it traverses the whole tree.
+func (tree *IAVL) Verify() error {
+	if tree.root == nil {
+		if tree.chunkList.GetNumberOfChunks() != 0 || tree.firstLeaf != nil {
+			return errors.New("empty tree with leaves")
+		}
+		return nil
+	}
+
+	var leaves []*Node
+	_, _, err := tree.root.verify(nil, nil, &leaves, tree.canonical)
+	if err != nil {
+		return err
+	}
+
+	// every leaf apart from the first one provides the key of exactly one inner node
+	providers := make(map[*Node]int, len(leaves))
+	tree.root.countLeafPointers(providers)
+	for i, leaf := range leaves {
+		if i == 0 {
+			if providers[leaf] != 0 || leaf.keyHeight != 0 {
+				return errors.Errorf("first leaf %d must not provide a key", leaf.leafID)
+			}
+			continue
+		}
+		if providers[leaf] != 1 {
+			return errors.Errorf("leaf %d provides the key of %d inner nodes", leaf.leafID, providers[leaf])
+		}
+	}
+
+	if tree.firstLeaf != leaves[0] {
+		return errors.New("firstLeaf is not the left-most leaf")
+	}
+	if tree.chunkList.GetNumberOfChunks() != len(leaves) {
+		return errors.Errorf("chunk list has %d chunks, the tree has %d leaves",
+			tree.chunkList.GetNumberOfChunks(), len(leaves))
+	}
+	leaf := tree.firstLeaf
+	var prevLeaf *Node
+	for i := range leaves {
+		if leaf != leaves[i] {
+			return errors.Errorf("leaf chain differs from the tree at position %d", i)
+		}
+		if leaf.prevLeaf != prevLeaf {
+			return errors.Errorf("leaf %d does not point to the previous leaf", leaf.leafID)
+		}
+		prevLeaf = leaf
+		if tree.chunkList.GetChunk(i) != leaves[i] {
+			return errors.Errorf("chunk list differs from the tree at position %d", i)
+		}
+		leaf = leaf.nextLeaf
+	}
+	if leaf != nil {
+		return errors.New("leaf chain is longer than the number of leaves")
+	}
+	return nil
+}
+
+// verify checks the subtree rooted at node, whose keys must be in the range [lower, upper).
+// A nil bound means that the range is unbounded on that side.
+// The leaves are appended to leaves from left to right. It returns the recomputed hash
+// and the left-most leaf of the subtree. If canonical is set, the subtree must be a crit-bit trie
+// instead of being balanced.
+func (node *Node) verify(lower, upper []byte, leaves *[]*Node, canonical bool) ([]byte, *Node, error) {
+	if node.isLeaf() {
+		return node.verifyLeaf(lower, upper, leaves)
+	}
+	if node.leftNode == nil || node.rightNode == nil {
+		return nil, nil, errors.Errorf("inner node %x is missing a child", node.key)
+	}
+
+	before := len(*leaves)
+	leftHash, leftMostLeaf, err := node.leftNode.verify(lower, node.key, leaves, canonical)
+	if err != nil {
+		return nil, nil, err
+	}
+	middle := len(*leaves)
+	rightHash, rightLeftMostLeaf, err := node.rightNode.verify(node.key, upper, leaves, canonical)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if node.height != maxInt8(node.leftNode.height, node.rightNode.height)+1 {
+		return nil, nil, errors.Errorf("inner node %x has a wrong height", node.key)
+	}
+	if canonical {
+		// the leaves are split where their smallest keys start to differ
+		first, last := (*leaves)[before].getSmallestKey(), (*leaves)[len(*leaves)-1].getSmallestKey()
+		if firstDifferentBit(first, last) != firstDifferentBit((*leaves)[middle-1].getSmallestKey(), node.key) {
+			return nil, nil, errors.Errorf("inner node %x does not split its leaves at their crit bit", node.key)
+		}
+	} else if balance := node.calcBalance(); balance > 1 || balance < -1 {
+		return nil, nil, errors.Errorf("inner node %x is not balanced (balance %d)", node.key, balance)
+	}
+	if node.size != node.leftNode.size+node.rightNode.size {
+		return nil, nil, errors.Errorf("inner node %x has a wrong size", node.key)
+	}
+	if node.leafPointer != rightLeftMostLeaf {
+		return nil, nil, errors.Errorf("inner node %x does not point to the left-most leaf of its right subtree", node.key)
+	}
+	if !bytes.Equal(node.key, rightLeftMostLeaf.getSmallestKey()) {
+		return nil, nil, errors.Errorf("inner node %x is not the smallest key of its right subtree", node.key)
+	}
+	if node.leafPointer.keyHeight != node.height {
+		return nil, nil, errors.Errorf("leaf %d has keyHeight %d, its inner node has height %d",
+			node.leafPointer.leafID, node.leafPointer.keyHeight, node.height)
+	}
+
+	leafCount := uint32(len(*leaves) - before)
+	hash := innerHash(leftHash, rightHash, leafCount, node.key)
+	if node.hashIsValid && (!bytes.Equal(hash, node.hash) || node.leafCount != leafCount) {
+		return nil, nil, errors.Errorf("inner node %x has a wrong hash", node.key)
+	}
+	return hash, leftMostLeaf, nil
+}
+
+func (node *Node) verifyLeaf(lower, upper []byte, leaves *[]*Node) ([]byte, *Node, error) {
+	chunk, err := node.getChunk()
+	if err != nil {
+		return nil, nil, err
+	}
+	if chunk == nil {
+		return nil, nil, errors.New("leaf without a chunk")
+	}
+	if err := chunk.Verify(); err != nil {
+		return nil, nil, errors.Wrapf(err, "chunk of leaf %d", node.leafID)
+	}
+	size := chunk.GetCurrSize()
+	if size == 0 {
+		return nil, nil, errors.Errorf("leaf %d is empty", node.leafID)
+	}
+	if node.size != size {
+		return nil, nil, errors.Errorf("leaf %d has size %d, its chunk has %d keys", node.leafID, node.size, size)
+	}
+	if lower != nil && bytes.Compare(chunk.GetSmallestKeyUnsafe(), lower) == -1 {
+		return nil, nil, errors.Errorf("leaf %d contains keys smaller than its range", node.leafID)
+	}
+	if upper != nil && bytes.Compare(chunk.GetKeyAt(size-1), upper) != -1 {
+		return nil, nil, errors.Errorf("leaf %d contains keys larger than its range", node.leafID)
+	}
+
+	h := sha256.New()
+	h.Write([]byte{node.keyHeight})
+	h.Write(chunk.GetHash())
+	hash := h.Sum(nil)
+	if node.hashIsValid && !bytes.Equal(hash, node.hash) {
+		return nil, nil, errors.Errorf("leaf %d has a wrong hash", node.leafID)
+	}
+	*leaves = append(*leaves, node)
+	return hash, node, nil
+}
+
+// countLeafPointers counts, for every leaf, how many inner nodes point to it.
+func (node *Node) countLeafPointers(count map[*Node]int) {
+	if node.isLeaf() {
+		return
+	}
+	count[node.leafPointer]++
+	node.leftNode.countLeafPointers(count)
+	node.rightNode.countLeafPointers(count)
+}
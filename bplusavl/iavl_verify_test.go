@@ -0,0 +1,91 @@
+package bplusavl
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyRandomTree(t *testing.T) {
+	assert := assert.New(t)
+	tree := NewIAVL(int32(8), int32(4))
+	assert.Nil(tree.Verify())
+
+	size := 5000
+	rand.Seed(time.Now().UnixNano())
+	x := rand.Perm(size)
+	for i, elem := range x {
+		num := make([]byte, 4)
+		binary.BigEndian.PutUint32(num, uint32(elem))
+		// a new key is not an update, including the first one
+		assert.False(tree.Set(num, num))
+		if i%500 == 0 {
+			assert.Nil(tree.Verify())
+		}
+	}
+	assert.Nil(tree.Verify())
+
+	// updating existing keys must keep keys unique
+	for _, elem := range x[:1000] {
+		num := make([]byte, 4)
+		binary.BigEndian.PutUint32(num, uint32(elem))
+		updated, err := tree.Set(num, []byte("a longer value than before"))
+		assert.True(updated)
+		assert.NoError(err)
+	}
+	assert.Nil(tree.Verify())
+	assert.Equal(int32(size), tree.root.size)
+
+	var leafList []*Node
+	for currLeaf := tree.firstLeaf; currLeaf != nil; currLeaf = currLeaf.nextLeaf {
+		leafList = append(leafList, currLeaf)
+	}
+	rebuiltTree, err := RebuildTree(leafList)
+	assert.NoError(err)
+	rebuiltTree.CompleteRehash()
+	assert.Nil(rebuiltTree.Verify())
+}
+
+func TestVerifyDetectsViolations(t *testing.T) {
+	assert := assert.New(t)
+	newTree := func() *IAVL {
+		tree := NewIAVL(int32(4), int32(1))
+		keys := [][]byte{{10}, {50}, {30}, {40}, {60}, {20}, {70}, {100}, {80}, {90}}
+		for i := 0; i < len(keys); i++ {
+			tree.Set(keys[i], keys[i])
+		}
+		assert.Nil(tree.Verify())
+		return tree
+	}
+
+	tree := newTree()
+	tree.root.size++
+	assert.NotNil(tree.Verify())
+
+	tree = newTree()
+	tree.root.key = []byte{1}
+	assert.NotNil(tree.Verify())
+
+	tree = newTree()
+	tree.root.leafPointer.keyHeight++
+	assert.NotNil(tree.Verify())
+
+	tree = newTree()
+	tree.firstLeaf.nextLeaf = tree.firstLeaf.nextLeaf.nextLeaf
+	assert.NotNil(tree.Verify())
+
+	tree = newTree()
+	tree.chunkList.chunks[0], tree.chunkList.chunks[1] = tree.chunkList.chunks[1], tree.chunkList.chunks[0]
+	assert.NotNil(tree.Verify())
+
+	tree = newTree()
+	tree.CurruptChunkData(1)
+	assert.NotNil(tree.Verify())
+
+	tree = newTree()
+	tree.root.hash[0] ^= 0xFF
+	assert.NotNil(tree.Verify())
+}
@@ -0,0 +1,182 @@
+package bplusavl
+
+import (
+	hchunk "bplus/chunk"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// shortHashLength is the number of bytes of a hash shown in the DOT output.
+const shortHashLength = 4
+
+// JSONNode is the JSON representation of a node written by IAVL.WriteJSON.
+// Inner nodes have Left and Right set, leaves have LeafID, KeyHeight, Keys and HeapRoot set.
+// Byte slices (keys and hashes) are encoded as hexadecimal strings.
+type JSONNode struct {
+	Hash        string `json:"hash"`
+	HashIsValid bool   `json:"hashIsValid"`
+	Height      uint8  `json:"height"`
+	Size        int32  `json:"size"`
+
+	// inner nodes
+	Key   string    `json:"key,omitempty"`
+	Left  *JSONNode `json:"left,omitempty"`
+	Right *JSONNode `json:"right,omitempty"`
+
+	// leaf nodes
+	LeafID    *uint32  `json:"leafID,omitempty"`
+	KeyHeight *uint8   `json:"keyHeight,omitempty"`
+	Keys      []string `json:"keys,omitempty"`
+	HeapRoot  string   `json:"heapRoot,omitempty"`
+	Heap      []string `json:"heap,omitempty"`
+}
+
+// WriteJSON writes the structure of the tree as a JSON document (see JSONNode).
+// If withHeaps is set, the hash heap of each chunk is included as well.
+// An empty tree is written as null.
+func (tree *IAVL) WriteJSON(w io.Writer, withHeaps bool) error {
+	var root *JSONNode
+	if tree.root != nil {
+		var err error
+		if root, err = tree.root.toJSON(withHeaps); err != nil {
+			return err
+		}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return errors.Wrap(encoder.Encode(root), "while encoding tree")
+}
+
+// toJSON returns the subtree rooted at node. An error is returned if a leaf cannot be loaded.
+func (node *Node) toJSON(withHeaps bool) (*JSONNode, error) {
+	jsonNode := &JSONNode{
+		Hash:        hex.EncodeToString(node.hash),
+		HashIsValid: node.hashIsValid,
+		Height:      node.height,
+		Size:        node.size,
+	}
+	if !node.isLeaf() {
+		jsonNode.Key = hex.EncodeToString(node.key)
+		var err error
+		if jsonNode.Left, err = node.leftNode.toJSON(withHeaps); err != nil {
+			return nil, err
+		}
+		if jsonNode.Right, err = node.rightNode.toJSON(withHeaps); err != nil {
+			return nil, err
+		}
+		return jsonNode, nil
+	}
+
+	leafID, keyHeight := node.leafID, node.keyHeight
+	jsonNode.LeafID = &leafID
+	jsonNode.KeyHeight = &keyHeight
+	chunk, err := node.getChunk()
+	if err != nil {
+		return nil, err
+	}
+	jsonNode.HeapRoot = hex.EncodeToString(chunk.GetHash())
+	for i := int32(0); i < chunk.GetCurrSize(); i++ {
+		jsonNode.Keys = append(jsonNode.Keys, hex.EncodeToString(chunk.GetKeyAt(i)))
+	}
+	if withHeaps {
+		for _, h := range chunk.GetHeap() {
+			jsonNode.Heap = append(jsonNode.Heap, hex.EncodeToString(h))
+		}
+	}
+	return jsonNode, nil
+}
+
+// WriteDOT writes the structure of the tree in the DOT language, so that it can be rendered with Graphviz.
+// Inner nodes show their key, height, size and a short hash, leaves show their ID, keyHeight, keys and
+// the root of their heap. Leaves are connected by dashed edges following the leaf chain.
+// If withHeaps is set, the hash heap of each chunk is drawn below its leaf.
+func (tree *IAVL) WriteDOT(w io.Writer, withHeaps bool) error {
+	dw := &dotWriter{w: w}
+	dw.printf("digraph BplusAVL {\n")
+	dw.printf("\tnode [shape=box, fontname=\"monospace\"];\n")
+	if tree.root != nil {
+		tree.root.writeDOT(dw, withHeaps)
+		for leaf := tree.firstLeaf; leaf != nil && leaf.nextLeaf != nil; leaf = leaf.nextLeaf {
+			dw.printf("\tleaf%d -> leaf%d [style=dashed, constraint=false];\n", leaf.leafID, leaf.nextLeaf.leafID)
+		}
+	}
+	dw.printf("}\n")
+	return dw.err
+}
+
+// dotWriter remembers the first error that occurred while writing, or loading a leaf,
+// and assigns names to inner nodes.
+type dotWriter struct {
+	w         io.Writer
+	err       error
+	nextInner int
+}
+
+func (dw *dotWriter) printf(format string, args ...interface{}) {
+	if dw.err != nil {
+		return
+	}
+	_, dw.err = fmt.Fprintf(dw.w, format, args...)
+	if dw.err != nil {
+		dw.err = errors.Wrap(dw.err, "while writing DOT")
+	}
+}
+
+func shortHash(hash []byte) string {
+	if len(hash) > shortHashLength {
+		hash = hash[:shortHashLength]
+	}
+	return hex.EncodeToString(hash)
+}
+
+// writeDOT writes the subtree rooted at node and returns the name of node in the graph.
+func (node *Node) writeDOT(dw *dotWriter, withHeaps bool) string {
+	if node.isLeaf() {
+		name := fmt.Sprintf("leaf%d", node.leafID)
+		chunk, err := node.getChunk()
+		if err != nil {
+			if dw.err == nil {
+				dw.err = err
+			}
+			return name
+		}
+		keys := ""
+		for i := int32(0); i < chunk.GetCurrSize(); i++ {
+			keys += fmt.Sprintf("%x\\l", chunk.GetKeyAt(i))
+		}
+		dw.printf("\t%s [shape=record, label=\"{leaf %d | keyHeight %d | size %d | hash %s valid %t | heap %s | %s}\"];\n",
+			name, node.leafID, node.keyHeight, node.size, shortHash(node.hash), node.hashIsValid,
+			shortHash(chunk.GetHash()), keys)
+		if withHeaps {
+			writeHeapDOT(dw, name, chunk)
+		}
+		return name
+	}
+
+	name := fmt.Sprintf("inner%d", dw.nextInner)
+	dw.nextInner++
+	dw.printf("\t%s [label=\"key %x\\nheight %d size %d\\nhash %s valid %t\"];\n",
+		name, node.key, node.height, node.size, shortHash(node.hash), node.hashIsValid)
+	left := node.leftNode.writeDOT(dw, withHeaps)
+	right := node.rightNode.writeDOT(dw, withHeaps)
+	dw.printf("\t%s -> %s [label=\"L\"];\n", name, left)
+	dw.printf("\t%s -> %s [label=\"R\"];\n", name, right)
+	return name
+}
+
+// writeHeapDOT draws the hash heap of the chunk of a leaf, connecting its root to the leaf.
+func writeHeapDOT(dw *dotWriter, leafName string, chunk *hchunk.HeapChunk) {
+	heap := chunk.GetHeap()
+	for i, h := range heap {
+		dw.printf("\t%s_h%d [shape=ellipse, fontsize=8, label=\"%s\"];\n", leafName, i, shortHash(h))
+		if i == 0 {
+			dw.printf("\t%s -> %s_h%d [style=dotted];\n", leafName, leafName, i)
+		} else {
+			dw.printf("\t%s_h%d -> %s_h%d [style=dotted];\n", leafName, (i-1)/2, leafName, i)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package bplusavl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteDOT(t *testing.T) {
+	assert := assert.New(t)
+	tree := NewIAVL(int32(4), int32(1))
+
+	keys := [][]byte{{10}, {50}, {30}, {40}, {60}, {20}, {70}, {100}, {80}, {90}}
+	for i := 0; i < len(keys); i++ {
+		tree.Set(keys[i], keys[i])
+	}
+
+	var buffer bytes.Buffer
+	err := tree.WriteDOT(&buffer, true)
+	assert.Nil(err)
+
+	dot := buffer.String()
+	assert.True(strings.HasPrefix(dot, "digraph BplusAVL {"))
+	assert.True(strings.HasSuffix(dot, "}\n"))
+	for i := 0; i < tree.GetNumberOfChunks(); i++ {
+		leaf := tree.GetChunk(i)
+		assert.Contains(dot, fmt.Sprintf("leaf%d [", leaf.leafID))
+		assert.Contains(dot, fmt.Sprintf("leaf%d -> leaf%d_h0", leaf.leafID, leaf.leafID))
+		if leaf.nextLeaf != nil {
+			assert.Contains(dot, fmt.Sprintf("leaf%d -> leaf%d [style=dashed", leaf.leafID, leaf.nextLeaf.leafID))
+		}
+	}
+
+	// an empty tree is an empty graph
+	buffer.Reset()
+	err = NewIAVL(4, 1).WriteDOT(&buffer, false)
+	assert.Nil(err)
+	assert.Equal("digraph BplusAVL {\n\tnode [shape=box, fontname=\"monospace\"];\n}\n", buffer.String())
+}
+
+func TestWriteJSONMatchesRebuiltTree(t *testing.T) {
+	assert := assert.New(t)
+	tree := NewIAVL(int32(8), int32(4))
+	size := 1000
+
+	x := rand.Perm(size)
+	for _, elem := range x {
+		num := make([]byte, 4)
+		binary.BigEndian.PutUint32(num, uint32(elem))
+		tree.Set(num, num)
+	}
+
+	var buffer bytes.Buffer
+	err := tree.WriteJSON(&buffer, true)
+	assert.Nil(err)
+
+	var root JSONNode
+	err = json.Unmarshal(buffer.Bytes(), &root)
+	assert.Nil(err)
+	assert.Equal(tree.root.size, root.Size)
+	assert.Equal(fmt.Sprintf("%x", tree.GetRootHash()), root.Hash)
+
+	var leafList []*Node
+	for currLeaf := tree.firstLeaf; currLeaf != nil; currLeaf = currLeaf.nextLeaf {
+		leafList = append(leafList, currLeaf)
+	}
+	rebuiltTree, err := RebuildTree(leafList)
+	assert.NoError(err)
+	rebuiltTree.CompleteRehash()
+
+	var rebuiltBuffer bytes.Buffer
+	err = rebuiltTree.WriteJSON(&rebuiltBuffer, true)
+	assert.Nil(err)
+	assert.Equal(buffer.String(), rebuiltBuffer.String())
+}
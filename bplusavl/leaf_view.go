@@ -0,0 +1,94 @@
+package bplusavl
+
+// LeafView is a read-only view of a leaf and its chunk. It allows external packages to inspect chunks
+// (eg. to synchronize or export them) without access to the internals of Node and HeapChunk.
+// A view must not be used after the tree is modified. If the chunk of the leaf cannot be loaded (see WithLeafStore),
+// KeyAt and ValueAt return nil and Range calls nothing: the error is reported by IAVL.Err.
+type LeafView struct {
+	leaf *Node
+}
+
+// GetLeaf returns a view of the i-th leaf, sorted by the smallest key, or nil if there is no such leaf.
+func (tree *IAVL) GetLeaf(i int) *LeafView {
+	return newLeafView(tree.chunkList.GetChunk(i))
+}
+
+func newLeafView(leaf *Node) *LeafView {
+	if leaf == nil {
+		return nil
+	}
+	return &LeafView{leaf: leaf}
+}
+
+// ID returns the ID of the leaf.
+func (view *LeafView) ID() uint32 {
+	return view.leaf.leafID
+}
+
+// KeyHeight returns the height of the inner node whose key is the smallest key of the leaf.
+func (view *LeafView) KeyHeight() uint8 {
+	return view.leaf.keyHeight
+}
+
+// Len returns the number of K-V pairs in the leaf.
+func (view *LeafView) Len() int {
+	return int(view.leaf.size)
+}
+
+// KeyAt returns a copy of the i-th smallest key in the leaf, or nil if i is out of range.
+func (view *LeafView) KeyAt(i int) []byte {
+	if !view.inRange(i) {
+		return nil
+	}
+	chunk, err := view.leaf.getChunk()
+	if err != nil {
+		return nil
+	}
+	return chunk.GetKeyAt(int32(i))
+}
+
+// ValueAt returns a copy of the value of the i-th smallest key in the leaf, or nil if i is out of range.
+func (view *LeafView) ValueAt(i int) []byte {
+	if !view.inRange(i) {
+		return nil
+	}
+	chunk, err := view.leaf.getChunk()
+	if err != nil {
+		return nil
+	}
+	return copyBytes(chunk.GetValueAt(int32(i)))
+}
+
+// Range calls fn for every K-V pair in the leaf in ascending key order, until fn returns false.
+// The slices passed to fn are NOT copies: they must not be modified nor retained after fn returns.
+func (view *LeafView) Range(fn func(key, value []byte) bool) {
+	chunk, err := view.leaf.getChunk()
+	if err != nil {
+		return
+	}
+	chunk.Range(fn)
+}
+
+// Hash returns a copy of the hash of the leaf, as used in the proofs.
+func (view *LeafView) Hash() []byte {
+	return view.leaf.GetLeafHash()
+}
+
+// SmallestKey returns a copy of the smallest key in the leaf.
+func (view *LeafView) SmallestKey() []byte {
+	return view.leaf.GetSmallestKey()
+}
+
+// Next returns a view of the following leaf, or nil if this is the right-most leaf.
+func (view *LeafView) Next() *LeafView {
+	return newLeafView(view.leaf.nextLeaf)
+}
+
+// Prev returns a view of the preceding leaf, or nil if this is the left-most leaf.
+func (view *LeafView) Prev() *LeafView {
+	return newLeafView(view.leaf.prevLeaf)
+}
+
+func (view *LeafView) inRange(i int) bool {
+	return i >= 0 && i < view.Len()
+}
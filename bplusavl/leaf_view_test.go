@@ -0,0 +1,71 @@
+package bplusavl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLeafView(t *testing.T) {
+	assert := assert.New(t)
+	tree := NewIAVL(int32(8), int32(4))
+	assert.Nil(tree.GetLeaf(0))
+
+	size := 1000
+	for _, elem := range rand.Perm(size) {
+		num := make([]byte, 4)
+		binary.BigEndian.PutUint32(num, uint32(elem))
+		tree.Set(num, append([]byte("v"), num...))
+	}
+
+	count := 0
+	var previous *LeafView
+	for view := tree.GetLeaf(0); view != nil; view = view.Next() {
+		leaf := tree.GetChunk(count)
+		assert.Equal(leaf.leafID, view.ID())
+		assert.Equal(leaf.keyHeight, view.KeyHeight())
+		size, err := leaf.GetChunkSize()
+		assert.NoError(err)
+		assert.Equal(int(size), view.Len())
+		assert.True(bytes.Equal(leaf.hash, view.Hash()))
+		assert.True(bytes.Equal(view.KeyAt(0), view.SmallestKey()))
+		if previous != nil {
+			assert.Equal(previous.ID(), view.Prev().ID())
+		} else {
+			assert.Nil(view.Prev())
+		}
+
+		i := 0
+		view.Range(func(key, value []byte) bool {
+			assert.True(bytes.Equal(key, view.KeyAt(i)))
+			assert.True(bytes.Equal(value, view.ValueAt(i)))
+			assert.True(bytes.Equal(append([]byte("v"), key...), value))
+			i++
+			return true
+		})
+		assert.Equal(view.Len(), i)
+
+		// copies do not alias the chunk
+		view.ValueAt(0)[0] = 'x'
+		view.KeyAt(0)[0] = 0xFF
+		assert.Equal(byte('v'), view.ValueAt(0)[0])
+		assert.True(bytes.Equal(leaf.chunk.GetSmallestKey(), view.KeyAt(0)))
+
+		assert.Nil(view.KeyAt(view.Len()))
+		assert.Nil(view.ValueAt(-1))
+		previous = view
+		count++
+	}
+	assert.Equal(tree.GetNumberOfChunks(), count)
+
+	// Range stops when fn returns false
+	calls := 0
+	tree.GetLeaf(0).Range(func(key, value []byte) bool {
+		calls++
+		return false
+	})
+	assert.Equal(1, calls)
+}
@@ -0,0 +1,28 @@
+//go:build !unix
+
+package bplusavl
+
+import (
+	"io"
+	"os"
+)
+
+// mappedFile holds the content of a file. Where memory mapping is not available, the file is read in memory.
+type mappedFile struct {
+	data []byte
+}
+
+// mapFile reads the whole file in memory.
+func mapFile(file *os.File) (*mappedFile, error) {
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return &mappedFile{data: data}, nil
+}
+
+// Close releases the content of the file.
+func (file *mappedFile) Close() error {
+	file.data = nil
+	return nil
+}
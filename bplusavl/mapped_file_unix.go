@@ -0,0 +1,39 @@
+//go:build unix
+
+package bplusavl
+
+import (
+	"os"
+	"syscall"
+)
+
+// mappedFile is a file mapped in memory, read-only.
+type mappedFile struct {
+	data []byte
+}
+
+// mapFile maps the whole file in memory.
+func mapFile(file *os.File) (*mappedFile, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return &mappedFile{}, nil
+	}
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return &mappedFile{data: data}, nil
+}
+
+// Close unmaps the file.
+func (file *mappedFile) Close() error {
+	if file.data == nil {
+		return nil
+	}
+	data := file.data
+	file.data = nil
+	return syscall.Munmap(data)
+}
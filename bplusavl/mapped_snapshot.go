@@ -0,0 +1,161 @@
+package bplusavl
+
+import (
+	hchunk "bplus/chunk"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// mappedMagic starts every memory-mapped snapshot.
+var mappedMagic = []byte("BPAVLMAP")
+
+// Layout of a memory-mapped snapshot. The header contains mappedMagic, then, as little-endian integers,
+// the page size (32 bits), the chunk size (32 bits), the key size (32 bits), the number of chunks (32 bits),
+// the root hash (32 bytes) and, for every leaf from the left-most to the right-most, a mappedEntrySize-byte entry:
+// the offset of its chunk in the file (64 bits), the size of its chunk (64 bits), its leaf ID (32 bits)
+// and its keyHeight (8 bits). The header is padded to the page size and followed by the chunks,
+// written by HeapChunk.WriteMapped: each chunk, and the keys and values in it, start at a page boundary.
+const (
+	mappedFixedHeaderSize = 8 + 4*4 + 32
+	mappedEntrySize       = 8 + 8 + 4 + 1
+)
+
+// ExportMappedSnapshot writes the whole tree in a format that can be memory-mapped by OpenMappedSnapshot,
+// aligning the keys and the values of every chunk to pageSize (usually os.Getpagesize()).
+func (tree *IAVL) ExportMappedSnapshot(buffer io.Writer, pageSize int) error {
+	if pageSize <= 0 {
+		return errors.Errorf("invalid page size %d", pageSize)
+	}
+	numberOfChunks := tree.GetNumberOfChunks()
+	headerSize := alignToPage(mappedFixedHeaderSize+numberOfChunks*mappedEntrySize, pageSize)
+	header := make([]byte, headerSize)
+	copy(header, mappedMagic)
+	binary.LittleEndian.PutUint32(header[8:], uint32(pageSize))
+	binary.LittleEndian.PutUint32(header[12:], uint32(tree.chunkSize))
+	binary.LittleEndian.PutUint32(header[16:], uint32(tree.keySize))
+	binary.LittleEndian.PutUint32(header[20:], uint32(numberOfChunks))
+	copy(header[24:56], tree.GetRootHash())
+
+	offset := uint64(headerSize)
+	for i := 0; i < numberOfChunks; i++ {
+		leaf := tree.chunkList.GetChunk(i)
+		chunk, err := leaf.getChunk()
+		if err != nil {
+			return err
+		}
+		size := uint64(chunk.MappedSize(pageSize))
+		entry := header[mappedFixedHeaderSize+i*mappedEntrySize:]
+		binary.LittleEndian.PutUint64(entry, offset)
+		binary.LittleEndian.PutUint64(entry[8:], size)
+		binary.LittleEndian.PutUint32(entry[16:], leaf.leafID)
+		entry[20] = leaf.keyHeight
+		offset += size
+	}
+	_, err := buffer.Write(header)
+	if err != nil {
+		return errors.Wrap(err, "while writing header")
+	}
+
+	for i := 0; i < numberOfChunks; i++ {
+		chunk, err := tree.chunkList.GetChunk(i).getChunk()
+		if err != nil {
+			return err
+		}
+		err = chunk.WriteMapped(buffer, pageSize)
+		if err != nil {
+			return errors.Wrapf(err, "while writing chunk %d", i)
+		}
+	}
+	return nil
+}
+
+// ImportMappedSnapshot rebuilds a read-only tree from a buffer produced by IAVL.ExportMappedSnapshot.
+// The chunks of the tree wrap the buffer without copying it (see hchunk.NewMappedHeapChunk): the buffer must not
+// be modified while the tree is in use. The content of the chunks is not hashed: the hashes stored with
+// the chunks are trusted, and the root hash of the rebuilt tree is compared to the one in the header.
+// Use IAVL.Verify to check every chunk against its hashes.
+// The options are applied to the returned tree as in NewIAVL.
+func ImportMappedSnapshot(buffer []byte, options ...TreeOption) (*IAVL, error) {
+	if len(buffer) < mappedFixedHeaderSize || !bytes.Equal(buffer[:8], mappedMagic) {
+		return nil, errors.New("not a mapped snapshot")
+	}
+	chunkSize := int32(binary.LittleEndian.Uint32(buffer[12:]))
+	keySize := int32(binary.LittleEndian.Uint32(buffer[16:]))
+	numberOfChunks := int(binary.LittleEndian.Uint32(buffer[20:]))
+	rootHash := buffer[24:56]
+	if numberOfChunks > (len(buffer)-mappedFixedHeaderSize)/mappedEntrySize {
+		return nil, errors.New("invalid number of chunks")
+	}
+	if numberOfChunks == 0 {
+		if !bytes.Equal(rootHash, EmptyRootHash()) {
+			return nil, ErrRootHashMismatch
+		}
+		return NewIAVL(chunkSize, keySize, options...), nil
+	}
+
+	leaves := make([]*Node, numberOfChunks)
+	for i := range leaves {
+		entry := buffer[mappedFixedHeaderSize+i*mappedEntrySize:]
+		offset, size := binary.LittleEndian.Uint64(entry), binary.LittleEndian.Uint64(entry[8:])
+		if offset > uint64(len(buffer)) || size > uint64(len(buffer))-offset {
+			return nil, errors.Errorf("chunk %d out of bounds", i)
+		}
+		chunk, err := hchunk.NewMappedHeapChunk(buffer[offset : offset+size])
+		if err != nil {
+			return nil, errors.Wrapf(err, "while mapping chunk %d", i)
+		}
+		if chunk.GetMaxSize() != chunkSize || chunk.GetKeySize() != keySize || chunk.GetCurrSize() == 0 {
+			return nil, errors.Errorf("chunk %d has invalid parameters", i)
+		}
+		leaves[i] = &Node{
+			size:      chunk.GetCurrSize(),
+			chunk:     chunk,
+			leafID:    binary.LittleEndian.Uint32(entry[16:]),
+			keyHeight: entry[20],
+		}
+		leaves[i].calcHash()
+		leaves[i].hashIsValid = true
+	}
+
+	tree, err := RebuildTree(leaves, options...)
+	if err != nil {
+		return nil, err
+	}
+	tree.CompleteRehash()
+	if !bytes.Equal(tree.GetRootHash(), rootHash) {
+		return nil, ErrRootHashMismatch
+	}
+	return tree, nil
+}
+
+// OpenMappedSnapshot memory-maps the file at path, written by IAVL.ExportMappedSnapshot, and returns a read-only
+// tree serving Get, iteration and proofs directly from the mapped pages (see ImportMappedSnapshot).
+// Only the header, the hashes and the smallest key of every chunk are read when opening the file.
+// Set and Remove fail with ErrReadOnly.
+// The returned Closer unmaps the file: the tree, and every slice returned without a copy, must not be used after.
+func OpenMappedSnapshot(path string, options ...TreeOption) (*IAVL, io.Closer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	data, err := mapFile(file)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "while mapping the snapshot")
+	}
+	tree, err := ImportMappedSnapshot(data.data, options...)
+	if err != nil {
+		data.Close()
+		return nil, nil, err
+	}
+	return tree, data, nil
+}
+
+// alignToPage rounds n up to a multiple of pageSize.
+func alignToPage(n, pageSize int) int {
+	return (n + pageSize - 1) / pageSize * pageSize
+}
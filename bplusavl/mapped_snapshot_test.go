@@ -0,0 +1,84 @@
+package bplusavl
+
+import (
+	helperfunctions "bplus/helper_functions"
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMappedSnapshot(t *testing.T) {
+	assert := assert.New(t)
+	tree := NewIAVL(int32(32), int32(4))
+	x := rand.Perm(3000)
+	for _, elem := range x {
+		num := make([]byte, 4)
+		binary.BigEndian.PutUint32(num, uint32(elem))
+		tree.Set(num, helperfunctions.GetRandomString(rand.Intn(64)+1))
+	}
+	tree.Remove([]byte{0, 0, 0, 7})
+
+	var buffer bytes.Buffer
+	assert.NoError(tree.ExportMappedSnapshot(&buffer, os.Getpagesize()))
+	path := filepath.Join(t.TempDir(), "tree.map")
+	assert.NoError(os.WriteFile(path, buffer.Bytes(), 0644))
+
+	mapped, closer, err := OpenMappedSnapshot(path)
+	assert.NoError(err)
+	defer closer.Close()
+	assert.Equal(tree.GetRootHash(), mapped.GetRootHash())
+	assert.Equal(tree.GetNumberOfChunks(), mapped.GetNumberOfChunks())
+	assert.NoError(mapped.Verify())
+
+	for _, elem := range x {
+		num := make([]byte, 4)
+		binary.BigEndian.PutUint32(num, uint32(elem))
+		assert.Equal(tree.Get(num), mapped.Get(num))
+	}
+	it, expected := mapped.Iterate(nil, nil), tree.Iterate(nil, nil)
+	for ; expected.Valid(); expected.Next() {
+		assert.Equal(expected.Key(), it.Key())
+		assert.Equal(expected.Value(), it.Value())
+		it.Next()
+	}
+	assert.False(it.Valid())
+
+	key := []byte{0, 0, 0, 42}
+	proof, err := mapped.GetElementProof(key)
+	assert.NoError(err)
+	assert.Equal(tree.GetRootHash(), proof.ValidateProof(key, tree.Get(key)))
+
+	// the tree is read-only
+	_, err = mapped.Set(key, []byte("value"))
+	assert.True(errors.Is(err, ErrReadOnly))
+	_, _, err = mapped.Remove(key)
+	assert.True(errors.Is(err, ErrReadOnly))
+	_, err = mapped.Set([]byte{0, 0, 0, 7}, []byte("value"))
+	assert.True(errors.Is(err, ErrReadOnly))
+	assert.Equal(tree.GetRootHash(), mapped.GetRootHash())
+	assert.NoError(mapped.Verify())
+
+	// a different root hash in the header is detected
+	data := buffer.Bytes()
+	data[30] ^= 1
+	_, err = ImportMappedSnapshot(data)
+	assert.Equal(ErrRootHashMismatch, err)
+	_, err = ImportMappedSnapshot(data[:20])
+	assert.Error(err)
+}
+
+func TestMappedSnapshotEmpty(t *testing.T) {
+	assert := assert.New(t)
+	var buffer bytes.Buffer
+	assert.NoError(NewIAVL(8, 4).ExportMappedSnapshot(&buffer, 512))
+	assert.Equal(512, buffer.Len())
+	tree, err := ImportMappedSnapshot(buffer.Bytes())
+	assert.NoError(err)
+	assert.Equal(EmptyRootHash(), tree.GetRootHash())
+}
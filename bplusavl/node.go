@@ -3,7 +3,9 @@ package bplusavl
 import (
 	hchunk "bplus/chunk"
 	"bytes"
+	"container/list"
 	"crypto/sha256"
+	"encoding/binary"
 )
 
 type Node struct {
@@ -21,11 +23,19 @@ type Node struct {
 	hashIsValid bool
 	// inner nodes
 	leafPointer *Node
+	leafCount   uint32 // number of leaves of the subtree, computed with the hash
 	// leaf nodes
 	chunk     *hchunk.HeapChunk
 	keyHeight uint8 // assumption: this tree will be kept relatively small (8bit integer)
 	leafID    uint32
 	nextLeaf  *Node
+	prevLeaf  *Node
+	// leaf nodes of a memory-bounded tree (see WithLeafStore)
+	cache        *leafCache
+	cacheElement *list.Element // nil if the chunk is evicted
+	// copies of the smallest key and of the hash of the chunk while it is evicted
+	smallestKey []byte
+	chunkHash   []byte
 }
 
 // NewNode returns a new node from a key, value and version.
@@ -44,12 +54,45 @@ func NewNode(key []byte, value []byte) *Node {
 // public getters
 
 // GetChunkSize returns the size of the underlying chunk contained in this leaf node.
-// If node is not a leaf, the function panics.
-func (node *Node) GetChunkSize() int32 {
+// If node is not a leaf, ErrNotLeaf is returned.
+func (node *Node) GetChunkSize() (size int32, err error) {
+	if !node.isLeaf() {
+		return 0, ErrNotLeaf
+	}
+	chunk, err := node.getChunk()
+	if err != nil {
+		return 0, err
+	}
+	return chunk.GetCurrSize(), nil
+}
+
+// GetLeafID returns the ID of the leaf. IDs are given incrementally when leaves are created.
+func (node *Node) GetLeafID() uint32 {
+	return node.leafID
+}
+
+// GetKeyHeight returns the height of the inner node whose key is the smallest key of this leaf.
+func (node *Node) GetKeyHeight() uint8 {
+	return node.keyHeight
+}
+
+// GetSmallestKey returns a copy of the smallest key in the leaf's chunk.
+// If node is not a leaf, nil is returned.
+func (node *Node) GetSmallestKey() []byte {
 	if node.isLeaf() {
-		return node.chunk.GetCurrSize()
+		return copyBytes(node.getSmallestKey())
 	}
-	panic("Not a leaf")
+	return nil
+}
+
+// Next returns the leaf following this one in key order, or nil if this is the right-most leaf.
+func (node *Node) Next() *Node {
+	return node.nextLeaf
+}
+
+// Prev returns the leaf preceding this one in key order, or nil if this is the left-most leaf.
+func (node *Node) Prev() *Node {
+	return node.prevLeaf
 }
 
 // GetLeafHash returns a copy of the leaf's hash.
@@ -64,6 +107,34 @@ func (node *Node) GetLeafHash() []byte {
 	return nil
 }
 
+// getChunk returns the chunk of the leaf. In a memory-bounded tree, an evicted chunk is loaded from the leaf store:
+// an error is returned if it cannot be loaded.
+func (node *Node) getChunk() (*hchunk.HeapChunk, error) {
+	if node.cache != nil {
+		if err := node.cache.access(node); err != nil {
+			return nil, err
+		}
+	}
+	return node.chunk, nil
+}
+
+// getSmallestKey returns the smallest key of the chunk of a leaf without loading the chunk if it is evicted.
+// The returned slice must not be modified.
+func (node *Node) getSmallestKey() []byte {
+	if node.chunk == nil {
+		return node.smallestKey
+	}
+	return node.chunk.GetSmallestKeyUnsafe()
+}
+
+// getChunkHash returns the hash of the chunk of a leaf without loading the chunk if it is evicted.
+func (node *Node) getChunkHash() []byte {
+	if node.chunk == nil {
+		return node.chunkHash
+	}
+	return node.chunk.GetHash()
+}
+
 func (node *Node) isLeaf() bool {
 	return node.height == 0
 }
@@ -82,16 +153,35 @@ func (node *Node) calcHash() {
 	if node.isLeaf() {
 		//h.Write(node.value)
 		h.Write([]byte{node.keyHeight}) // add keyHeight to the hash
-		h.Write(node.chunk.GetHash())   // add the root hash of the heap to the hash (represents the whole chunk's content)
+		h.Write(node.getChunkHash())    // add the root hash of the heap to the hash (represents the whole chunk's content)
 		node.hash = h.Sum(nil)
 		return
 	}
-	var values []byte
-	values = append(values, node.leftNode.hash...)
-	values = append(values, node.rightNode.hash...)
+	node.leafCount = node.leftNode.getLeafCount() + node.rightNode.getLeafCount()
+	node.hash = innerHash(node.leftNode.hash, node.rightNode.hash, node.leafCount, node.key)
+}
 
-	h.Write(values)
-	node.hash = h.Sum(nil)
+// innerHash returns the hash of an inner node given the hashes of its children, the number of leaves
+// of its subtree and its key. The number of leaves and the key are part of the hash so that a leaf proof
+// also proves the position and the key range of the leaf (see IAVLLeafProof.Position and IAVLLeafProof.Bounds).
+func innerHash(leftHash, rightHash []byte, leafCount uint32, key []byte) []byte {
+	h := sha256.New()
+	h.Write(leftHash)
+	h.Write(rightHash)
+	var count [4]byte
+	binary.BigEndian.PutUint32(count[:], leafCount)
+	h.Write(count[:])
+	h.Write(key)
+	return h.Sum(nil)
+}
+
+// getLeafCount returns the number of leaves of the subtree rooted at the node.
+// For an inner node, it is up-to-date only if its hash is valid.
+func (node *Node) getLeafCount() uint32 {
+	if node.isLeaf() {
+		return 1
+	}
+	return node.leafCount
 }
 
 // calcHeightAndSize will set the height of the calling node and update the keyHeight of its leaf node.
@@ -99,7 +189,7 @@ func (node *Node) calcHash() {
 func (node *Node) calcHeightAndSize() {
 	node.height = maxInt8(node.getLeftNode().height, node.getRightNode().height) + 1
 	node.leafPointer.keyHeight = node.height
-	node.setHashInvalidDownTo(node.leafPointer.chunk.GetSmallestKey())
+	node.setHashInvalidDownTo(node.key)
 	node.size = node.getLeftNode().size + node.getRightNode().size
 }
 
@@ -130,34 +220,29 @@ func (node *Node) clone() *Node {
 		rightNode:   node.rightNode,
 		hashIsValid: node.hashIsValid,
 		leafPointer: node.leafPointer,
+		leafCount:   node.leafCount,
 		//persisted: false,
 	}
 }
 
 // recursiveHash recursively computes the hash value of a node if hashIsValid is set to false.
 // Otherwise the hash is simply returned.
-func (node *Node) recursiveHash() []byte {
+// Leaves whose hash is recomputed have changed: they are added to dirty.
+func (node *Node) recursiveHash(dirty map[uint32]*Node) []byte {
 	if node.hashIsValid {
 		return node.hash
 	}
 	if node.isLeaf() {
 		node.calcHash()
 		node.hashIsValid = true
+		dirty[node.leafID] = node
 		return node.hash
 	}
 
-	h := sha256.New()
-	leftH := node.leftNode.recursiveHash()
-	rightH := node.rightNode.recursiveHash()
-
-	//var values []byte
-	//values = append(values, leftH...)
-	//values = append(values, rightH...)
-	//
-	//h.Write(values)
-	h.Write(leftH)
-	h.Write(rightH)
-	node.hash = h.Sum(nil)
+	leftH := node.leftNode.recursiveHash(dirty)
+	rightH := node.rightNode.recursiveHash(dirty)
+	node.leafCount = node.leftNode.getLeafCount() + node.rightNode.getLeafCount()
+	node.hash = innerHash(leftH, rightH, node.leafCount, node.key)
 	node.hashIsValid = true
 	return node.hash
 }
@@ -171,17 +256,10 @@ func (node *Node) completeReHash() []byte {
 		return node.hash
 	}
 
-	h := sha256.New()
 	leftH := node.leftNode.completeReHash()
 	rightH := node.rightNode.completeReHash()
-
-	//var values []byte
-	//values = append(values, leftH...)
-	//values = append(values, rightH...)
-	//h.Write(values)
-	h.Write(leftH)
-	h.Write(rightH)
-	node.hash = h.Sum(nil)
+	node.leafCount = node.leftNode.getLeafCount() + node.rightNode.getLeafCount()
+	node.hash = innerHash(leftH, rightH, node.leafCount, node.key)
 	node.hashIsValid = true
 	return node.hash
 }
@@ -231,9 +309,15 @@ func (n *Node) isBalancedRecursive() bool {
 	return n.leftNode.isBalancedRecursive() && n.rightNode.isBalancedRecursive()
 }
 
-func (n *Node) get(key []byte) []byte {
+// get returns the value mapped to the key in the subtree, or nil if the key is not found.
+// An error is returned if the leaf of the key cannot be loaded.
+func (n *Node) get(key []byte) ([]byte, error) {
 	if n.isLeaf() {
-		return n.chunk.Get(key)
+		chunk, err := n.getChunk()
+		if err != nil {
+			return nil, err
+		}
+		return chunk.Get(key), nil
 	}
 	if bytes.Compare(key, n.key) == -1 {
 		return n.leftNode.get(key)
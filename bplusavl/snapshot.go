@@ -0,0 +1,175 @@
+package bplusavl
+
+import (
+	hchunk "bplus/chunk"
+	"bytes"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/tendermint/go-amino"
+)
+
+// Flags of the modes of the tree stored in the header of a snapshot.
+const (
+	snapshotCanonical      uint8 = 1 << 0 // see WithCanonicalShape
+	snapshotRedistribution uint8 = 1 << 1 // see WithRedistribution
+)
+
+// ExportSnapshot writes the whole tree into a buffer.
+// A snapshot contains a header (chunk size, key size, modes of the tree, number of chunks and root hash) followed by
+// every leaf, from the left-most to the right-most, serialized with a checksum. The modes are the flags of the
+// canonical shape and redistribution options, the split policy and the target size of the chunks in bytes.
+// Inner nodes are not exported since they are rebuilt from the leaves by ImportSnapshot.
+func (tree *IAVL) ExportSnapshot(buffer io.Writer) error {
+	err := amino.EncodeInt32(buffer, tree.chunkSize)
+	if err != nil {
+		return errors.Wrap(err, "while encoding chunk size")
+	}
+	err = amino.EncodeInt32(buffer, tree.keySize)
+	if err != nil {
+		return errors.Wrap(err, "while encoding key size")
+	}
+	var flags uint8
+	if tree.canonical {
+		flags |= snapshotCanonical
+	}
+	if tree.redistribution {
+		flags |= snapshotRedistribution
+	}
+	err = amino.EncodeUint8(buffer, flags)
+	if err != nil {
+		return errors.Wrap(err, "while encoding flags")
+	}
+	err = amino.EncodeUint8(buffer, uint8(tree.splitPolicy))
+	if err != nil {
+		return errors.Wrap(err, "while encoding split policy")
+	}
+	err = amino.EncodeInt32(buffer, tree.chunkBytes)
+	if err != nil {
+		return errors.Wrap(err, "while encoding chunk bytes")
+	}
+	numberOfChunks := tree.GetNumberOfChunks()
+	err = amino.EncodeInt32(buffer, int32(numberOfChunks))
+	if err != nil {
+		return errors.Wrap(err, "while encoding number of chunks")
+	}
+	err = amino.EncodeByteSlice(buffer, tree.GetRootHash())
+	if err != nil {
+		return errors.Wrap(err, "while encoding root hash")
+	}
+
+	var leafBuffer bytes.Buffer
+	for i := 0; i < numberOfChunks; i++ {
+		leafBuffer.Reset()
+		err = tree.SerializeLeafChunkWithChecksum(i, &leafBuffer)
+		if err != nil {
+			return err
+		}
+		err = amino.EncodeByteSlice(buffer, leafBuffer.Bytes())
+		if err != nil {
+			return errors.Wrapf(err, "while encoding chunk %d", i)
+		}
+	}
+	return nil
+}
+
+// ImportSnapshot rebuilds a tree from a buffer produced by IAVL.ExportSnapshot.
+// Every leaf is checked against its checksum and the root hash of the rebuilt tree
+// is compared to the one stored in the snapshot.
+// The returned tree has the modes of the exported tree. The options are applied to it
+// after the modes, as in NewIAVL.
+func ImportSnapshot(buffer []byte, options ...TreeOption) (*IAVL, error) {
+	chunkSize, j, err := amino.DecodeInt32(buffer)
+	if err != nil {
+		return nil, errors.Wrap(err, "while decoding chunk size")
+	}
+	buffer = buffer[j:]
+
+	keySize, j, err := amino.DecodeInt32(buffer)
+	if err != nil {
+		return nil, errors.Wrap(err, "while decoding key size")
+	}
+	buffer = buffer[j:]
+
+	flags, j, err := amino.DecodeUint8(buffer)
+	if err != nil {
+		return nil, errors.Wrap(err, "while decoding flags")
+	}
+	if flags&^(snapshotCanonical|snapshotRedistribution) != 0 {
+		return nil, errors.Errorf("unknown flags %x", flags)
+	}
+	buffer = buffer[j:]
+
+	splitPolicy, j, err := amino.DecodeUint8(buffer)
+	if err != nil {
+		return nil, errors.Wrap(err, "while decoding split policy")
+	}
+	if hchunk.SplitPolicy(splitPolicy) > hchunk.SplitBySize {
+		return nil, errors.Errorf("unknown split policy %d", splitPolicy)
+	}
+	buffer = buffer[j:]
+
+	chunkBytes, j, err := amino.DecodeInt32(buffer)
+	if err != nil {
+		return nil, errors.Wrap(err, "while decoding chunk bytes")
+	}
+	buffer = buffer[j:]
+
+	modes := func(tree *IAVL) {
+		tree.canonical = flags&snapshotCanonical != 0
+		tree.redistribution = flags&snapshotRedistribution != 0
+		tree.splitPolicy = hchunk.SplitPolicy(splitPolicy)
+		tree.chunkBytes = chunkBytes
+	}
+	options = append([]TreeOption{modes}, options...)
+
+	numberOfChunks, j, err := amino.DecodeInt32(buffer)
+	if err != nil {
+		return nil, errors.Wrap(err, "while decoding number of chunks")
+	}
+	if numberOfChunks < 0 || int(numberOfChunks) > len(buffer) {
+		return nil, errors.New("invalid number of chunks")
+	}
+	buffer = buffer[j:]
+
+	rootHash, j, err := amino.DecodeByteSlice(buffer)
+	if err != nil {
+		return nil, errors.Wrap(err, "while decoding root hash")
+	}
+	buffer = buffer[j:]
+
+	if numberOfChunks == 0 {
+		if !bytes.Equal(rootHash, EmptyRootHash()) {
+			return nil, ErrRootHashMismatch
+		}
+		return NewIAVL(chunkSize, keySize, options...), nil
+	}
+
+	leaves := make([]*Node, numberOfChunks)
+	for i := range leaves {
+		var leafBytes []byte
+		leafBytes, j, err = amino.DecodeByteSlice(buffer)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while decoding chunk %d", i)
+		}
+		buffer = buffer[j:]
+
+		leaves[i], err = Deserialize(leafBytes, chunkSize)
+		if err != nil {
+			return nil, err
+		}
+		if leaves[i].chunk.GetKeySize() != keySize {
+			return nil, errors.Errorf("leaf %d has an invalid key size", leaves[i].leafID)
+		}
+	}
+
+	tree, err := RebuildTree(leaves, options...)
+	if err != nil {
+		return nil, err
+	}
+	tree.CompleteRehash()
+	if !bytes.Equal(tree.GetRootHash(), rootHash) {
+		return nil, ErrRootHashMismatch
+	}
+	return tree, nil
+}
@@ -0,0 +1,105 @@
+package bplusavl
+
+import (
+	hchunk "bplus/chunk"
+	helperfunctions "bplus/helper_functions"
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportImportSnapshot(t *testing.T) {
+	assert := assert.New(t)
+	tree := NewIAVL(int32(32), int32(4))
+	size := 5000
+
+	rand.Seed(time.Now().UnixNano())
+	x := rand.Perm(size)
+	for _, elem := range x {
+		num := make([]byte, 4)
+		binary.LittleEndian.PutUint32(num, uint32(elem))
+		tree.Set(num, helperfunctions.GetRandomString(rand.Intn(64)+1))
+	}
+
+	var buffer bytes.Buffer
+	err := tree.ExportSnapshot(&buffer)
+	assert.Nil(err)
+
+	importedTree, err := ImportSnapshot(buffer.Bytes())
+	assert.Nil(err)
+	assert.True(bytes.Equal(tree.GetRootHash(), importedTree.GetRootHash()))
+	assert.Equal(tree.GetNumberOfChunks(), importedTree.GetNumberOfChunks())
+	assert.Equal(tree.root.size, importedTree.root.size)
+
+	for _, elem := range x {
+		num := make([]byte, 4)
+		binary.LittleEndian.PutUint32(num, uint32(elem))
+		assert.True(bytes.Equal(tree.Get(num), importedTree.Get(num)))
+	}
+
+	// the imported tree must accept new insertions just like the original one
+	for i := size; i < size+500; i++ {
+		num := make([]byte, 4)
+		binary.LittleEndian.PutUint32(num, uint32(i))
+		tree.Set(num, num)
+		importedTree.Set(num, num)
+	}
+	assert.True(bytes.Equal(tree.GetRootHash(), importedTree.GetRootHash()))
+	assert.True(importedTree.isBalanced())
+
+	// a corrupted snapshot must be rejected
+	corrupted := buffer.Bytes()
+	corrupted[len(corrupted)/2] ^= 0xFF
+	_, err = ImportSnapshot(corrupted)
+	assert.NotNil(err)
+}
+
+func TestSnapshotModes(t *testing.T) {
+	assert := assert.New(t)
+	for _, options := range [][]TreeOption{
+		{WithChunkBytes(512), WithSplitPolicy(hchunk.SplitAppend)},
+		{WithRedistribution()},
+		{WithCanonicalShape()},
+	} {
+		for _, n := range []int{0, 300} {
+			tree := NewIAVL(8, 2, options...)
+			for k := 0; k < n; k++ {
+				tree.Set([]byte{byte(k >> 8), byte(k)}, []byte{byte(k)})
+			}
+			var buffer bytes.Buffer
+			assert.NoError(tree.ExportSnapshot(&buffer))
+			imported, err := ImportSnapshot(buffer.Bytes())
+			assert.NoError(err)
+			assert.Equal(tree.canonical, imported.canonical)
+			assert.Equal(tree.redistribution, imported.redistribution)
+			assert.Equal(tree.splitPolicy, imported.splitPolicy)
+			assert.Equal(tree.chunkBytes, imported.chunkBytes)
+			assert.Equal(tree.chunkSize, imported.chunkSize)
+
+			// the imported tree keeps being written like the exported one
+			for k := n; k < n+200; k++ {
+				tree.Set([]byte{byte(k >> 8), byte(k)}, []byte{byte(k), byte(k)})
+				imported.Set([]byte{byte(k >> 8), byte(k)}, []byte{byte(k), byte(k)})
+			}
+			assert.Equal(tree.GetRootHash(), imported.GetRootHash())
+			assert.NoError(imported.Verify())
+		}
+	}
+
+	// the options override the modes of the snapshot
+	var buffer bytes.Buffer
+	assert.NoError(NewIAVL(8, 2).ExportSnapshot(&buffer))
+	imported, err := ImportSnapshot(buffer.Bytes(), WithRedistribution())
+	assert.NoError(err)
+	assert.True(imported.redistribution)
+
+	// unknown modes are rejected
+	header := buffer.Bytes()
+	header[8] = 0xFF // flags, after the chunk size and the key size
+	_, err = ImportSnapshot(header)
+	assert.ErrorContains(err, "unknown flags")
+}
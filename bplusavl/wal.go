@@ -0,0 +1,302 @@
+package bplusavl
+
+import (
+	"bufio"
+	"bytes"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/tendermint/go-amino"
+)
+
+// Types of the records in a write-ahead log.
+const (
+	walSet    uint8 = 1
+	walRemove uint8 = 2
+	walCommit uint8 = 3
+)
+
+// ErrWALCorrupted is returned when a write-ahead log contains an invalid record followed by other records.
+var ErrWALCorrupted = errors.New("write-ahead log corrupted")
+
+// WAL is a write-ahead log for the mutations of a tree. Every Set and Remove is recorded with a sequence number
+// once it is applied to the tree, and Commit records the root hash of the tree and syncs the log to disk.
+// After a crash, RecoverWAL replays the committed mutations on top of the last persisted snapshot.
+//
+// Each record is a length-prefixed payload followed by its CRC-32 checksum. The payload contains the sequence
+// number, the type of the record, the key and the value (for a commit, no key and the root hash).
+// Records after the last commit were never acknowledged: they are discarded by RecoverWAL and OpenWAL.
+type WAL struct {
+	file     *os.File
+	writer   *bufio.Writer
+	tree     *IAVL
+	sequence uint64 // sequence number of the last record
+}
+
+// walRecord is a decoded record of a write-ahead log.
+type walRecord struct {
+	sequence   uint64
+	recordType uint8
+	key        []byte
+	value      []byte // the root hash for a commit
+	end        int64  // offset of the end of the record in the log
+}
+
+// OpenWAL opens the write-ahead log at path, creating it if needed, to record the mutations of tree.
+// The tree must be in the state of the last commit in the log (eg. as returned by RecoverWAL),
+// otherwise ErrRootHashMismatch is returned. Records after the last commit are discarded.
+func OpenWAL(path string, tree *IAVL) (*WAL, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	records, err := readWAL(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	wal := &WAL{file: file, tree: tree}
+	rootHash := EmptyRootHash()
+	end := int64(0)
+	for _, record := range records {
+		if record.recordType == walCommit {
+			wal.sequence, rootHash, end = record.sequence, record.value, record.end
+		}
+	}
+	if !bytes.Equal(rootHash, tree.GetRootHash()) {
+		file.Close()
+		return nil, errors.Wrap(ErrRootHashMismatch, "the tree is not in the state of the last commit")
+	}
+	if err = file.Truncate(end); err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "while discarding uncommitted records")
+	}
+	if _, err = file.Seek(end, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	wal.writer = bufio.NewWriter(file)
+	return wal, nil
+}
+
+// Set applies the mutation to the tree (see IAVL.Set) and records it. A mutation that fails is not recorded.
+// If the record cannot be written, the tree is mutated but the log is broken: Commit fails and the tree
+// must be recovered from the last commit.
+func (wal *WAL) Set(key, value []byte) (updated bool, err error) {
+	if value == nil {
+		// a nil value cannot be told apart from an empty one in the log
+		return false, errors.Wrapf(ErrNilValue, "at key %x", key)
+	}
+	if updated, err = wal.tree.Set(key, value); err != nil {
+		return false, err
+	}
+	if err = wal.append(walSet, key, value); err != nil {
+		return false, err
+	}
+	return updated, nil
+}
+
+// Remove applies the removal to the tree (see IAVL.Remove) and records it if the key was removed.
+// As for Set, a record that cannot be written breaks the log.
+func (wal *WAL) Remove(key []byte) (value []byte, removed bool, err error) {
+	if value, removed, err = wal.tree.Remove(key); err != nil || !removed {
+		return value, removed, err
+	}
+	if err = wal.append(walRemove, key, nil); err != nil {
+		return nil, false, err
+	}
+	return value, removed, nil
+}
+
+// Commit records the root hash of the tree and syncs the log to disk. Once it returns, the mutations
+// recorded so far survive a crash. It returns the sequence number of the commit and the root hash.
+func (wal *WAL) Commit() (sequence uint64, rootHash []byte, err error) {
+	rootHash = wal.tree.GetRootHash()
+	if err = wal.append(walCommit, nil, rootHash); err != nil {
+		return 0, nil, err
+	}
+	if err = wal.writer.Flush(); err != nil {
+		return 0, nil, errors.Wrap(err, "while flushing the log")
+	}
+	if err = wal.file.Sync(); err != nil {
+		return 0, nil, errors.Wrap(err, "while syncing the log")
+	}
+	return wal.sequence, rootHash, nil
+}
+
+// Sequence returns the sequence number of the last record.
+func (wal *WAL) Sequence() uint64 {
+	return wal.sequence
+}
+
+// Close closes the log. Mutations recorded after the last commit are lost.
+func (wal *WAL) Close() error {
+	return wal.file.Close()
+}
+
+// append writes a record with the next sequence number.
+func (wal *WAL) append(recordType uint8, key, value []byte) error {
+	var payload bytes.Buffer
+	err := amino.EncodeUvarint(&payload, wal.sequence+1)
+	if err != nil {
+		return errors.Wrap(err, "while encoding sequence number")
+	}
+	err = amino.EncodeUint8(&payload, recordType)
+	if err != nil {
+		return errors.Wrap(err, "while encoding record type")
+	}
+	err = amino.EncodeByteSlice(&payload, key)
+	if err != nil {
+		return errors.Wrap(err, "while encoding key")
+	}
+	err = amino.EncodeByteSlice(&payload, value)
+	if err != nil {
+		return errors.Wrap(err, "while encoding value")
+	}
+
+	err = amino.EncodeByteSlice(wal.writer, payload.Bytes())
+	if err != nil {
+		return errors.Wrap(err, "while writing record")
+	}
+	err = amino.EncodeUint32(wal.writer, crc32.Checksum(payload.Bytes(), checksumTable))
+	if err != nil {
+		return errors.Wrap(err, "while writing checksum")
+	}
+	wal.sequence++
+	return nil
+}
+
+// RecoverWAL replays the mutations committed in the write-ahead log at path on top of tree, which is usually
+// rebuilt from the last persisted snapshot (see ImportSnapshot and RebuildTree). Replay starts after the last
+// commit whose root hash is the root hash of the tree, or from the beginning of the log if the tree is empty.
+// After each replayed commit, the root hash of the tree is compared to the logged one. Only mutations that were
+// applied are recorded, hence a mutation that fails to replay is returned as an error.
+// It returns the sequence number of the last commit. A missing log is treated as an empty one.
+func RecoverWAL(path string, tree *IAVL) (sequence uint64, err error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	records, err := readWAL(file)
+	if err != nil {
+		return 0, err
+	}
+
+	// find the commit matching the tree and the last commit: records after it are discarded
+	start, end := -1, 0
+	if tree.root == nil {
+		start = 0
+	}
+	rootHash := tree.GetRootHash()
+	for i, record := range records {
+		if record.recordType != walCommit {
+			continue
+		}
+		if bytes.Equal(record.value, rootHash) {
+			start, sequence = i+1, record.sequence
+		}
+		end = i + 1
+	}
+	if start == -1 {
+		return 0, errors.Wrap(ErrRootHashMismatch, "no commit in the log matches the tree")
+	}
+
+	for _, record := range records[start:end] {
+		switch record.recordType {
+		case walSet:
+			if _, err = tree.Set(record.key, record.value); err != nil {
+				return sequence, errors.Wrapf(err, "while replaying record %d", record.sequence)
+			}
+		case walRemove:
+			if _, _, err = tree.Remove(record.key); err != nil {
+				return sequence, errors.Wrapf(err, "while replaying record %d", record.sequence)
+			}
+		case walCommit:
+			if !bytes.Equal(record.value, tree.GetRootHash()) {
+				return sequence, errors.Wrapf(ErrRootHashMismatch, "at commit %d", record.sequence)
+			}
+			sequence = record.sequence
+		}
+	}
+	return sequence, nil
+}
+
+// readWAL decodes the records of a log. An incomplete or invalid last record is the trace of a crash
+// while writing: it is ignored. An invalid record followed by other records means that the log is corrupted.
+func readWAL(reader io.Reader) ([]walRecord, error) {
+	buffer, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []walRecord
+	offset := 0
+	for offset < len(buffer) {
+		record, n, err := decodeWALRecord(buffer[offset:])
+		if err == nil && len(records) > 0 && record.sequence != records[len(records)-1].sequence+1 {
+			err = errors.Errorf("sequence number %d after %d", record.sequence, records[len(records)-1].sequence)
+		}
+		if err != nil {
+			if n > 0 && offset+n < len(buffer) {
+				return nil, errors.Wrapf(ErrWALCorrupted, "at offset %d: %v", offset, err)
+			}
+			break
+		}
+		offset += n
+		record.end = int64(offset)
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// decodeWALRecord decodes the record at the beginning of buffer and returns its length in the log.
+// If the record is invalid but complete, its length is returned with the error.
+func decodeWALRecord(buffer []byte) (record walRecord, n int, err error) {
+	payload, j, err := amino.DecodeByteSlice(buffer)
+	if err != nil {
+		return record, 0, errors.Wrap(err, "while decoding record")
+	}
+	checksum, k, err := amino.DecodeUint32(buffer[j:])
+	if err != nil {
+		return record, 0, errors.Wrap(err, "while decoding checksum")
+	}
+	n = j + k
+	if checksum != crc32.Checksum(payload, checksumTable) {
+		return record, n, errors.New("checksum mismatch")
+	}
+
+	record.sequence, j, err = amino.DecodeUvarint(payload)
+	if err != nil {
+		return record, n, errors.Wrap(err, "while decoding sequence number")
+	}
+	payload = payload[j:]
+	record.recordType, j, err = amino.DecodeUint8(payload)
+	if err != nil {
+		return record, n, errors.Wrap(err, "while decoding record type")
+	}
+	payload = payload[j:]
+	if record.recordType < walSet || record.recordType > walCommit {
+		return record, n, errors.Errorf("unknown record type %d", record.recordType)
+	}
+	record.key, j, err = amino.DecodeByteSlice(payload)
+	if err != nil {
+		return record, n, errors.Wrap(err, "while decoding key")
+	}
+	payload = payload[j:]
+	record.value, _, err = amino.DecodeByteSlice(payload)
+	if err != nil {
+		return record, n, errors.Wrap(err, "while decoding value")
+	}
+	if record.recordType == walSet && record.value == nil {
+		// amino decodes empty slices as nil: an empty value was recorded
+		record.value = []byte{}
+	}
+	return record, n, nil
+}
@@ -0,0 +1,161 @@
+package bplusavl
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeWAL records some mutations of a tree with chunks of 4 keys in a new log: two commits,
+// with a snapshot of the tree taken at the first one, followed by uncommitted mutations.
+func writeWAL(t *testing.T, path string) (snapshot, rootHash []byte) {
+	assert := assert.New(t)
+	tree := NewIAVL(4, 1)
+	wal, err := OpenWAL(path, tree)
+	assert.NoError(err)
+
+	for k := byte(0); k < 50; k++ {
+		_, err = wal.Set([]byte{k}, []byte{k, k})
+		assert.NoError(err)
+	}
+	// mutations that fail or change nothing are not recorded
+	_, err = wal.Set([]byte{1, 2}, []byte{1})
+	assert.True(errors.Is(err, ErrInvalidKeySize))
+	_, err = wal.Set([]byte{1}, nil)
+	assert.True(errors.Is(err, ErrNilValue))
+	_, _, err = wal.Remove([]byte{1, 2})
+	assert.True(errors.Is(err, ErrInvalidKeySize))
+	_, removed, err := wal.Remove([]byte{200})
+	assert.NoError(err)
+	assert.False(removed)
+	assert.Equal(uint64(50), wal.Sequence())
+	sequence, _, err := wal.Commit()
+	assert.NoError(err)
+	assert.Equal(uint64(51), sequence)
+
+	var buffer bytes.Buffer
+	assert.NoError(tree.ExportSnapshot(&buffer))
+
+	for k := byte(0); k < 50; k += 3 {
+		_, removed, err := wal.Remove([]byte{k})
+		assert.NoError(err)
+		assert.True(removed)
+	}
+	_, err = wal.Set([]byte{7}, []byte{})
+	assert.NoError(err)
+	_, rootHash, err = wal.Commit()
+	assert.NoError(err)
+
+	_, err = wal.Set([]byte{100}, []byte{100})
+	assert.NoError(err)
+	assert.NoError(wal.writer.Flush())
+	assert.NoError(wal.Close())
+	return buffer.Bytes(), rootHash
+}
+
+func TestRecoverWAL(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "tree.wal")
+	snapshot, rootHash := writeWAL(t, path)
+
+	// from the beginning of the log
+	tree := NewIAVL(4, 1)
+	sequence, err := RecoverWAL(path, tree)
+	assert.NoError(err)
+	assert.Equal(uint64(70), sequence)
+	assert.Equal(rootHash, tree.GetRootHash())
+	assert.Nil(tree.Get([]byte{100}))
+	assert.Equal([]byte{}, tree.Get([]byte{7}))
+	assert.Nil(tree.Verify())
+
+	// on top of the snapshot
+	tree, err = ImportSnapshot(snapshot)
+	assert.NoError(err)
+	sequence, err = RecoverWAL(path, tree)
+	assert.NoError(err)
+	assert.Equal(uint64(70), sequence)
+	assert.Equal(rootHash, tree.GetRootHash())
+
+	// a different tree shape is detected at the first commit
+	_, err = RecoverWAL(path, NewIAVL(8, 1))
+	assert.True(errors.Is(err, ErrRootHashMismatch))
+
+	// the log continues after the last commit: uncommitted records are discarded
+	wal, err := OpenWAL(path, tree)
+	assert.NoError(err)
+	assert.Equal(uint64(70), wal.Sequence())
+	_, err = wal.Set([]byte{200}, []byte{200})
+	assert.NoError(err)
+	_, rootHash, err = wal.Commit()
+	assert.NoError(err)
+	assert.NoError(wal.Close())
+
+	tree = NewIAVL(4, 1)
+	_, err = RecoverWAL(path, tree)
+	assert.NoError(err)
+	assert.Equal(rootHash, tree.GetRootHash())
+	assert.Nil(tree.Get([]byte{100}))
+	assert.Equal([]byte{200}, tree.Get([]byte{200}))
+
+	// the tree must be in the state of the last commit
+	_, err = OpenWAL(path, NewIAVL(4, 1))
+	assert.True(errors.Is(err, ErrRootHashMismatch))
+}
+
+func TestRecoverTornWAL(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "tree.wal")
+	_, rootHash := writeWAL(t, path)
+	log, err := os.ReadFile(path)
+	assert.NoError(err)
+
+	// a crash while writing the last record
+	for _, torn := range [][]byte{log[:len(log)-3], append(log, 0xFF, 0x01)} {
+		assert.NoError(os.WriteFile(path, torn, 0644))
+		tree := NewIAVL(4, 1)
+		_, err = RecoverWAL(path, tree)
+		assert.NoError(err)
+		assert.Equal(rootHash, tree.GetRootHash())
+	}
+
+	// a corrupted record followed by other records
+	corrupted := append([]byte(nil), log...)
+	corrupted[20] ^= 0xFF
+	assert.NoError(os.WriteFile(path, corrupted, 0644))
+	_, err = RecoverWAL(path, NewIAVL(4, 1))
+	assert.True(errors.Is(err, ErrWALCorrupted))
+	_, err = OpenWAL(path, NewIAVL(4, 1))
+	assert.True(errors.Is(err, ErrWALCorrupted))
+
+	// a missing log is empty
+	tree := NewIAVL(4, 1)
+	sequence, err := RecoverWAL(filepath.Join(t.TempDir(), "missing.wal"), tree)
+	assert.NoError(err)
+	assert.Equal(uint64(0), sequence)
+}
+
+func TestRecoverWALReplayError(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "tree.wal")
+	wal, err := OpenWAL(path, NewIAVL(4, 1))
+	assert.NoError(err)
+	_, err = wal.Set([]byte{1}, []byte{1})
+	assert.NoError(err)
+	_, _, err = wal.Commit()
+	assert.NoError(err)
+	// a record that cannot be applied, as written by a log of a tree with another key size
+	assert.NoError(wal.append(walSet, []byte{1, 2}, []byte{2}))
+	_, _, err = wal.Commit()
+	assert.NoError(err)
+	assert.NoError(wal.Close())
+
+	tree := NewIAVL(4, 1)
+	sequence, err := RecoverWAL(path, tree)
+	assert.True(errors.Is(err, ErrInvalidKeySize))
+	assert.Equal(uint64(2), sequence)
+	assert.Equal([]byte{1}, tree.Get([]byte{1}))
+}
@@ -4,6 +4,28 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"math"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrChunkFull is returned when inserting in a full chunk. Use HeapChunk.InsertAndSplit instead.
+	ErrChunkFull = errors.New("chunk is full")
+	// ErrChunkNotFull is returned when splitting a chunk that is not full. Use HeapChunk.Insert instead.
+	ErrChunkNotFull = errors.New("chunk is not full")
+	// ErrKeyExists is returned when inserting a key that is already in the chunk. Use HeapChunk.Update instead.
+	ErrKeyExists = errors.New("key already exists")
+	// ErrInvalidKeySize is returned when a key does not have the key size of the chunk.
+	ErrInvalidKeySize = errors.New("invalid key size")
+	// ErrValueTooLarge is returned when a value is too large to be addressed by the metadata of the keys.
+	ErrValueTooLarge = errors.New("value too large")
+	// ErrCapacityExceeded is returned when the values of a chunk would exceed its maximal capacity.
+	ErrCapacityExceeded = errors.New("chunk capacity exceeded")
+	// ErrKeyNotFound is returned when splitting a chunk to update a key that is not in the chunk.
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrSplitNotFound is returned when a chunk with a target cannot be split into two chunks that fit the target.
+	// Use HeapChunk.SplitAt to split the chunk next to the key first.
+	ErrSplitNotFound = errors.New("no split fits the target")
 )
 
 // "encoding/binary"
@@ -37,6 +59,10 @@ type HeapChunk struct {
 
 	indexBytes int32 // how many bytes are appended to the key to state the position of the data
 	sizeBytes  int32 // how many bytes are appended to the key to state the length of the data
+
+	targetBytes int32 // if positive, the chunk is full when its serialized size would exceed it
+
+	readOnly bool // set if the chunk wraps a memory-mapped region
 }
 
 // return the number of bytes that can represent an integer able to address every
@@ -54,21 +80,101 @@ func (chunk *HeapChunk) GetCurrSize() int32 {
 	return chunk.currKeysNumber
 }
 
+// GetMaxSize returns the maximal number of keys that the chunk can contain.
+func (chunk *HeapChunk) GetMaxSize() int32 {
+	return chunk.maxSize
+}
+
+// GetKeySize returns the size in bytes of a single key.
+func (chunk *HeapChunk) GetKeySize() int32 {
+	return chunk.keySize
+}
+
+// GetKeyAt returns a copy of the i-th smallest key in the chunk.
+// The caller must ensure that 0 <= i < HeapChunk.GetCurrSize().
+func (chunk *HeapChunk) GetKeyAt(i int32) []byte {
+	key := chunk.getKey(i)
+	keyCopy := make([]byte, len(key))
+	copy(keyCopy, key)
+	return keyCopy
+}
+
+// GetValueAt returns the value mapped to the i-th smallest key in the chunk.
+// The caller must ensure that 0 <= i < HeapChunk.GetCurrSize().
+// Note that this is NOT A COPIED slice: like HeapChunk.Get, it points into the values of the chunk.
+func (chunk *HeapChunk) GetValueAt(i int32) []byte {
+	start := chunk.getValueStartIndex(i)
+	return chunk.values[start : start+chunk.getValueLength(i)]
+}
+
+// Range calls fn for every K-V pair in the chunk in ascending key order, until fn returns false.
+// The slices passed to fn are NOT copies: they must not be modified nor retained after fn returns.
+func (chunk *HeapChunk) Range(fn func(key, value []byte) bool) {
+	for i := int32(0); i < chunk.currKeysNumber; i++ {
+		if !fn(chunk.getKey(i), chunk.GetValueAt(i)) {
+			return
+		}
+	}
+}
+
+// SearchKey returns the index of the smallest key in the chunk that is greater or equal to the given key.
+// If all keys are smaller, HeapChunk.GetCurrSize() is returned.
+func (chunk *HeapChunk) SearchKey(key []byte) int32 {
+	l, r := int32(0), chunk.currKeysNumber
+	for l < r {
+		m := (l + r) / 2
+		if bytes.Compare(chunk.getKey(m), key) == -1 {
+			l = m + 1
+		} else {
+			r = m
+		}
+	}
+	return l
+}
+
+// SearchKeyAfter returns the index of the smallest key in the chunk that is strictly greater than the given key.
+// If all keys are smaller or equal, HeapChunk.GetCurrSize() is returned.
+func (chunk *HeapChunk) SearchKeyAfter(key []byte) int32 {
+	return chunk.getInsertionIndex(key)
+}
+
+// GetHeap returns the hashes of the heap currently in use, starting from its root.
+// The returned slice is laid out as a standard heap: the children of the i-th hash are found at 2i+1 and 2i+2,
+// and the hashes following the inner ones are the direct hashes of the K-V pairs.
+// When the chunk contains an odd number of keys, the last direct hash is nil.
+// The hashes themselves are not copied and must not be modified.
+func (chunk *HeapChunk) GetHeap() [][]byte {
+	if chunk.currKeysNumber == 0 {
+		return nil
+	}
+	heap := make([][]byte, 2*(chunk.getOffset()-chunk.root)+1)
+	copy(heap, chunk.hashes[chunk.root:])
+	return heap
+}
+
 func (chunk *HeapChunk) GetHash() []byte {
 	return chunk.hashes[chunk.root] // return the root of the heap
 }
 
-// GetSmallestKey returns the slice where the smallest key is found.
+// GetSmallestKey returns a copy of the smallest key in the chunk.
+func (chunk *HeapChunk) GetSmallestKey() []byte {
+	return chunk.GetKeyAt(0)
+}
+
+// GetSmallestKeyUnsafe returns the slice where the smallest key is found.
 // Note that this is NOT A COPIED slice. If the content of HeapChunk.keys
 // in the first HeapChunk.keySize bytes changes, that change is reflected in the returned value.
-func (chunk *HeapChunk) GetSmallestKey() []byte {
+// The tree relies on this to use the smallest key of a leaf as key of an inner node without copying it.
+func (chunk *HeapChunk) GetSmallestKeyUnsafe() []byte {
 	return chunk.keys[0:chunk.keySize]
 }
 
+// NewHeapChunk returns an empty chunk that can contain up to maxSize keys of keySize bytes,
+// values of less than maxValueSize bytes and up to maxCapacity bytes of values in total.
+// It panics if the parameters are inconsistent: this is a programming error, not an invalid input.
 func NewHeapChunk(maxCapacity, maxValueSize, keySize, maxSize int32) *HeapChunk {
 
-	indexBytes := math.Ceil(math.Log2(float64(maxCapacity)) / 8)
-	sizeBytes := math.Ceil(math.Log2(float64(maxValueSize)) / 8)
+	indexBytes, sizeBytes := metadataBytes(maxCapacity, maxValueSize)
 	if sizeBytes > indexBytes {
 		panic("Single element size > Maximal capacity")
 	}
@@ -96,6 +202,26 @@ func NewHeapChunk(maxCapacity, maxValueSize, keySize, maxSize int32) *HeapChunk
 	return chunk
 }
 
+// metadataBytes returns how many bytes are appended to a key to state the position and the length of its value.
+func metadataBytes(maxCapacity, maxValueSize int32) (indexBytes, sizeBytes float64) {
+	indexBytes = math.Ceil(math.Log2(float64(maxCapacity)) / 8)
+	sizeBytes = math.Ceil(math.Log2(float64(maxValueSize)) / 8)
+	return indexBytes, sizeBytes
+}
+
+// MaxKeysForTargetBytes returns a maximal number of keys for the chunks created by NewHeapChunk that is large enough
+// to never be reached before the serialized size of the chunk exceeds targetBytes (see HeapChunk.SetTargetBytes).
+// The heap is sized for the smallest possible entries: a key with its metadata and an empty value.
+// The returned number is even, as required by the heap of hashes.
+func MaxKeysForTargetBytes(maxCapacity, maxValueSize, keySize, targetBytes int32) int32 {
+	indexBytes, sizeBytes := metadataBytes(maxCapacity, maxValueSize)
+	maxSize := targetBytes/(keySize+int32(indexBytes+sizeBytes)) + 1
+	if maxSize < 2 {
+		maxSize = 2
+	}
+	return maxSize + maxSize%2
+}
+
 // returns a new empty HeapChunk with same carachteristics as the input one
 func NewHeapChunkCopy(otherChunk *HeapChunk) *HeapChunk {
 	newChunk := &HeapChunk{
@@ -108,6 +234,7 @@ func NewHeapChunkCopy(otherChunk *HeapChunk) *HeapChunk {
 		maxSize:            otherChunk.maxSize,
 		nextFreeByte:       0,
 		keyAndMetadataSize: otherChunk.keyAndMetadataSize,
+		targetBytes:        otherChunk.targetBytes,
 	}
 	// offset := newChunk.maxSize - 1
 
@@ -122,6 +249,59 @@ func (chunk *HeapChunk) IsFull() bool {
 	return chunk.currKeysNumber >= chunk.maxSize
 }
 
+// SetTargetBytes limits the size of the chunk in bytes: the chunk has no room for a new K-V pair
+// if its serialized size would exceed targetBytes (see HeapChunk.HasRoomFor).
+// The maximal number of keys still applies: use MaxKeysForTargetBytes to create a chunk large enough.
+// A non-positive target removes the limit. The target is not serialized.
+func (chunk *HeapChunk) SetTargetBytes(targetBytes int32) {
+	chunk.targetBytes = targetBytes
+}
+
+// GetTargetBytes returns the size limit of the chunk in bytes set by HeapChunk.SetTargetBytes, or 0 if there is none.
+func (chunk *HeapChunk) GetTargetBytes() int32 {
+	if chunk.targetBytes < 0 {
+		return 0
+	}
+	return chunk.targetBytes
+}
+
+// HasRoomFor returns true if a new key with the given value can be inserted with HeapChunk.Insert.
+// Otherwise the chunk must be split with HeapChunk.InsertAndSplit.
+// The chunk has no room if it contains the maximal number of keys or if the new K-V pair would make its
+// serialized size exceed the target set by HeapChunk.SetTargetBytes. An empty chunk always has room for a K-V pair.
+func (chunk *HeapChunk) HasRoomFor(value []byte) bool {
+	if chunk.IsFull() {
+		return false
+	}
+	if chunk.targetBytes <= 0 || chunk.currKeysNumber == 0 {
+		return true
+	}
+	return chunk.serializedSizeWith(chunk.currKeysNumber+1, len(chunk.values)+len(value)) <= int(chunk.targetBytes)
+}
+
+// HasRoomForUpdate returns true if the value mapped to the key can be replaced with HeapChunk.Update.
+// Otherwise the chunk must be split with HeapChunk.UpdateAndSplitWithPolicy.
+// The chunk has no room if it has a target (see HeapChunk.SetTargetBytes) and more than one K-V pair, and the chunk
+// without the key would have no room for the key with the new value, the holes left in the values not counted.
+func (chunk *HeapChunk) HasRoomForUpdate(key, value []byte) bool {
+	index := chunk.indexOf(key)
+	if index == -1 || chunk.targetBytes <= 0 || chunk.currKeysNumber <= 1 {
+		return true
+	}
+	valueBytes := chunk.usedValueBytes() - uint64(chunk.getValueLength(index))
+	return chunk.serializedSizeWith(chunk.currKeysNumber, int(valueBytes)+len(value)) <= int(chunk.targetBytes)
+}
+
+// usedValueBytes returns the number of bytes of the values mapped to the keys, the holes left by updates
+// and removals excluded.
+func (chunk *HeapChunk) usedValueBytes() uint64 {
+	used := uint64(0)
+	for k := int32(0); k < chunk.currKeysNumber; k++ {
+		used += uint64(chunk.getValueLength(k))
+	}
+	return used
+}
+
 func (chunk *HeapChunk) getOffset() int32 {
 	return chunk.maxSize - 1
 }
@@ -146,6 +326,12 @@ func (chunk *HeapChunk) setNewValueStartIndex(keyIndex int32, index uint32) {
 	//LittleEndianEncodeUint(chunk.keys[b+chunk.keyAndMetadataSize-chunk.sizeBytes:b+chunk.keyAndMetadataSize], size)
 }
 
+// setNewValueLength updates the length of the value mapped to the key at the given index.
+func (chunk *HeapChunk) setNewValueLength(keyIndex int32, length uint32) {
+	b := keyIndex*chunk.keyAndMetadataSize + chunk.keySize + chunk.indexBytes
+	LittleEndianEncodeUint(chunk.keys[b:b+chunk.sizeBytes], length)
+}
+
 // getValueStartIndex returns the first byte where a value resides within the values array.
 // The called must pass the index to the key mapped to the desired value.
 func (chunk *HeapChunk) getValueStartIndex(keyIndex int32) uint32 {
@@ -194,15 +380,15 @@ func (chunk *HeapChunk) getInsertionIndex(key []byte) int32 {
 	return 0
 }
 
+// encodeIndexAndLength returns a new slice containing the key followed by its metadata.
+// The given key is never modified.
 func encodeIndexAndLength(key []byte, index, length uint32, indexBufLength, lengthBufLength int32) []byte {
-	indexBytes := make([]byte, indexBufLength)
-	lengthBytes := make([]byte, lengthBufLength)
+	encoded := make([]byte, len(key)+int(indexBufLength+lengthBufLength))
+	copy(encoded, key)
 
-	LittleEndianEncodeUint(indexBytes, index)
-	LittleEndianEncodeUint(lengthBytes, length)
-
-	key = append(key, indexBytes...)
-	return append(key, lengthBytes...)
+	LittleEndianEncodeUint(encoded[len(key):len(key)+int(indexBufLength)], index)
+	LittleEndianEncodeUint(encoded[len(key)+int(indexBufLength):], length)
+	return encoded
 }
 
 // LittleEndianEncodeUint take an unsigned integer and a buffer.
@@ -224,9 +410,54 @@ func LittleEndianDecodeUint32(buff []byte) uint32 {
 	return x
 }
 
-func (chunk *HeapChunk) Insert(key, value []byte) {
-	if chunk.IsFull() {
-		panic("Inserting a full chunk")
+// CheckEntry returns an error if the key does not have the key size of the chunk or the value is too large
+// to be stored in the chunk. It does not check whether the chunk has room for the K-V pair.
+func (chunk *HeapChunk) CheckEntry(key, value []byte) error {
+	if int32(len(key)) != chunk.keySize {
+		return errors.Wrapf(ErrInvalidKeySize, "key of %d bytes, expected %d", len(key), chunk.keySize)
+	}
+	if uint64(len(value)) >= uint64(1)<<(8*chunk.sizeBytes) {
+		return errors.Wrapf(ErrValueTooLarge, "value of %d bytes", len(value))
+	}
+	return nil
+}
+
+// hasCapacityFor returns true if size more bytes can be appended to the values.
+func (chunk *HeapChunk) hasCapacityFor(size int) bool {
+	return uint64(chunk.nextFreeByte)+uint64(size) < uint64(1)<<(8*chunk.indexBytes)
+}
+
+// ensureCapacityFor makes sure that size more bytes can be appended to the values,
+// compacting them (closing the holes left by updates) if needed.
+func (chunk *HeapChunk) ensureCapacityFor(size int) error {
+	if !chunk.hasCapacityFor(size) {
+		chunk.compactValues()
+		if !chunk.hasCapacityFor(size) {
+			return ErrCapacityExceeded
+		}
+	}
+	return nil
+}
+
+// Insert inserts a new K-V pair in the chunk, keeping the keys sorted, and updates the hashes of the heap.
+// An error is returned, and the chunk is left unchanged, if the chunk has no room for the K-V pair
+// (see HeapChunk.HasRoomFor), the key already exists
+// or the K-V pair cannot be stored in the chunk.
+func (chunk *HeapChunk) Insert(key, value []byte) error {
+	if chunk.readOnly {
+		return ErrReadOnly
+	}
+	if !chunk.HasRoomFor(value) {
+		return ErrChunkFull
+	}
+	if err := chunk.CheckEntry(key, value); err != nil {
+		return err
+	}
+	if chunk.indexOf(key) != -1 {
+		return ErrKeyExists
+	}
+	if err := chunk.ensureCapacityFor(len(value)); err != nil {
+		return err
 	}
 	h := sha256.New()
 
@@ -264,7 +495,7 @@ func (chunk *HeapChunk) Insert(key, value []byte) {
 		chunk.root = offset - chunk.currKeysNumber
 	}
 	chunk.computeHashes()
-
+	return nil
 }
 
 func (chunk *HeapChunk) computeRootPosition() {
@@ -295,134 +526,39 @@ func (chunk *HeapChunk) compactValues() {
 	chunk.nextFreeByte = bytesCount
 }
 
-// FIXME NOW KEYS ARE IN A DYNAMIC ARRAY. RETURN A COPY, NOT A POINTER! (I guess?)
-func (chunk *HeapChunk) InsertAndSplit(key, value []byte) (leftChunk *HeapChunk, middleKey []byte, rightChunk *HeapChunk) {
-	if !chunk.IsFull() {
-		panic("Chunk not full")
+// InsertAndSplitWithPolicy inserts a new K-V pair in a full chunk by splitting it into two chunks,
+// at the position chosen by policy.
+// The left chunk reuses the calling chunk, the right chunk is a new chunk whose smallest key is returned as middleKey.
+// If the chunk has a target (see HeapChunk.SetTargetBytes), the split is moved away from the position chosen by policy
+// as little as needed for the chunk that receives the new K-V pair to fit in the target, unless it holds the pair alone.
+// An error is returned, and the chunk is left unchanged, if the chunk has room for the K-V pair
+// (see HeapChunk.HasRoomFor), the key already exists, the K-V pair cannot be stored in the chunk
+// or no split into two chunks fits the target (ErrSplitNotFound).
+func (chunk *HeapChunk) InsertAndSplitWithPolicy(key, value []byte, policy SplitPolicy) (leftChunk *HeapChunk, middleKey []byte, rightChunk *HeapChunk, err error) {
+	if chunk.readOnly {
+		return nil, nil, nil, ErrReadOnly
 	}
-	rightChunk = NewHeapChunkCopy(chunk)
-
-	offset := chunk.getOffset()
-
-	insertionIndex := chunk.getInsertionIndex(key)
-	m_1 := (chunk.currKeysNumber + 1) / 2
-
-	i := m_1
-	j := 0
-	if insertionIndex < m_1 { // new value is in the LEFT CHUNK
-		// copy right part in the right chunk
-		changedSize := chunk.currKeysNumber - i
-
-		// move the keys
-		firstKeyByte := chunk.indexToByte(i)
-		lastKeyByte := chunk.currKeysNumber * chunk.keyAndMetadataSize
-
-		copy(rightChunk.keys[0:], chunk.keys[firstKeyByte:lastKeyByte])
-		// TODO empty keys beyond the mid in right (=set to 0)? Or keep junk??
-
-		for i != chunk.currKeysNumber {
-			rightChunk.hashes[int32(j)+offset] = chunk.hashes[i+offset]
-
-			// chunk.hashes[i+offset] = getNilHash()
-			chunk.hashes[i+offset] = nil
-			i += 1
-			j += 1
-		}
-		rightChunk.currKeysNumber = changedSize
-
-		// MOVE values to the RIGHT CHUNK
-		for k := int32(0); k < rightChunk.currKeysNumber; k++ {
-			startValue := rightChunk.getValueStartIndex(k)
-			lenValue := rightChunk.getValueLength(k)
-			rightChunk.values = append(rightChunk.values, chunk.values[startValue:startValue+lenValue]...)
-			rightChunk.setNewValueStartIndex(k, rightChunk.nextFreeByte)
-			rightChunk.nextFreeByte += lenValue
-		}
-		rightChunk.computeRootPosition()
-		rightChunk.computeHashes()
-
-		chunk.currKeysNumber -= changedSize
-		// compact values (close holes)
-		chunk.compactValues()
-
-		// chunk.computeRootPosition()
-		chunk.Insert(key, value) // this also updates root index
-
-		// !!NOTE!!:
-		// Returning the middle key like this (without making a copy) assumes that the underlying array of keys is never changed (reallocated)
-		// This means that whatever happens to the chunk (eg splits), the left-most key is always in the first 'keyAndMetadataSize' positions.
-		// Only keys that are not the left-most are affected by splits with the current implementation.
-		// Keep this in mind if you want to change this structure.
-		return chunk, rightChunk.keys[0:rightChunk.keySize], rightChunk
-
+	if chunk.HasRoomFor(value) {
+		return nil, nil, nil, ErrChunkNotFull
 	}
-	// new value is in the RIGHT CHUNK
-	changedSize := chunk.currKeysNumber - i
-
-	h := sha256.New()
-	h.Write(key)
-	h.Write(value)
-	// make space and insert new hash value and values
-	// also move values (new values is not yet appended!)
-	for i != chunk.currKeysNumber {
-		if insertionIndex == m_1+int32(j) { // Insert the new value in the right chunk
-			rightChunk.hashes[int32(j)+offset] = h.Sum(nil)
-			j += 1
-		} else { // copy the right half of the chunk's hash values
-			startValue := chunk.getValueStartIndex(i)
-			lenValue := chunk.getValueLength(i)
-			rightChunk.values = append(rightChunk.values, chunk.values[startValue:startValue+lenValue]...)
-			// the metadata (startIndex) in the keys is already updated while the keys are still in the old chunk.
-			// When keys are copied to the right side, they dont need any update (thats why index i is used)
-			chunk.setNewValueStartIndex(i, rightChunk.nextFreeByte)
-			rightChunk.nextFreeByte += lenValue
-
-			rightChunk.hashes[int32(j)+offset] = chunk.hashes[i+offset]
-			// chunk.hashes[i+offset] = getNilHash()
-			chunk.hashes[i+offset] = nil
-			i += 1
-			j += 1
-		}
+	if err = chunk.CheckEntry(key, value); err != nil {
+		return nil, nil, nil, err
 	}
-	// edge case: the value is inserted at the very end (not covered in the loop above)
-	if insertionIndex == chunk.currKeysNumber {
-		rightChunk.hashes[changedSize+offset] = h.Sum(nil)
-	}
-	// make space and insert new keys
-	// m_1 = middle, insertionIndex >= m_1
-	// CHUNK:
-	// [----------(m_1)----(insert)---]
-	//      |            |          |
-	//   left chunk     rightLeft   rightRight
-	//
-	// rightLeft is the keys in the right chunk, on the left of the insertion index.
-	// rightRight is the keys in the right chunk, on the right of the insertion index.
-	// TODO: copy rightLeft, add new key, copy leftRight
-
-	// copy rightLeft
-	firstKeyByte := chunk.indexToByte(m_1)
-	lastKeyByte := chunk.indexToByte(insertionIndex)
-	copy(rightChunk.keys[0:], chunk.keys[firstKeyByte:lastKeyByte])
-	// copy rightRight leaving 1 spot free
-	firstKeyByte = chunk.indexToByte(insertionIndex)
-	copy(rightChunk.keys[((insertionIndex-m_1)+1)*chunk.keyAndMetadataSize:], chunk.keys[firstKeyByte:]) // + 1 to leave space for the key to insert
-	// copy new key
-	encodedKey := encodeIndexAndLength(key, rightChunk.nextFreeByte, uint32(len(value)), rightChunk.indexBytes, rightChunk.sizeBytes)
-	copy(rightChunk.keys[(insertionIndex-m_1)*chunk.keyAndMetadataSize:((insertionIndex-m_1)+1)*chunk.keyAndMetadataSize], encodedKey)
-	// copy new value
-	rightChunk.values = append(rightChunk.values, value...)
-	rightChunk.nextFreeByte += uint32(len(value))
-
-	rightChunk.currKeysNumber = changedSize
-	rightChunk.currKeysNumber += 1
-	rightChunk.computeRootPosition()
-	rightChunk.computeHashes()
-	chunk.currKeysNumber -= changedSize
-	chunk.compactValues()
-	chunk.computeRootPosition()
-	chunk.computeHashes()
-	return chunk, rightChunk.keys[0:rightChunk.keySize], rightChunk
-
+	if chunk.indexOf(key) != -1 {
+		return nil, nil, nil, ErrKeyExists
+	}
+	// after the split both halves are compacted: the values currently in use plus the new one must fit in a chunk
+	if chunk.usedValueBytes()+uint64(len(value)) >= uint64(1)<<(8*chunk.indexBytes) {
+		return nil, nil, nil, ErrCapacityExceeded
+	}
+	insertionIndex := chunk.getInsertionIndex(key)
+	entries := chunk.splitEntries(insertionIndex, key, value, true)
+	leftSize, ok := chunk.fittingSplit(entries, insertionIndex, chunk.splitIndex(policy, entries, insertionIndex))
+	if !ok {
+		return nil, nil, nil, ErrSplitNotFound
+	}
+	middleKey, rightChunk = chunk.splitInto(entries, leftSize)
+	return chunk, middleKey, rightChunk, nil
 }
 
 // given the index i in HeapChunk.hashes, returns the index of its left child.
@@ -511,6 +647,8 @@ func (chunk *HeapChunk) computeHashesHelper(i int32) []byte {
 	return hash
 }
 
+// Get returns the value mapped to the given key, or nil if the key is not found.
+// Note that this is NOT A COPIED slice: it points into the values of the chunk, which later insertions may reallocate.
 func (chunk *HeapChunk) Get(key []byte) []byte {
 	size := chunk.currKeysNumber
 	l, r := int32(0), size
@@ -531,6 +669,77 @@ func (chunk *HeapChunk) Get(key []byte) []byte {
 	return nil
 }
 
+// Update replaces the value mapped to an existing key and updates the hashes of the heap.
+// If the new value fits in the space of the old one, it is written in place, otherwise it is appended
+// at the first free byte and the space of the old value is left unused. The values are compacted when the unused
+// space exceeds the used one, or makes the chunk exceed its target (see HeapChunk.SetTargetBytes).
+// It returns false if the key is not found in the chunk, and an error if the chunk has no room for the new value
+// (see HeapChunk.HasRoomForUpdate) or the value cannot be stored in the chunk.
+func (chunk *HeapChunk) Update(key, value []byte) (bool, error) {
+	if chunk.readOnly {
+		return false, ErrReadOnly
+	}
+	index := chunk.indexOf(key)
+	if index == -1 {
+		return false, nil
+	}
+	if err := chunk.CheckEntry(key, value); err != nil {
+		return false, err
+	}
+	if !chunk.HasRoomForUpdate(key, value) {
+		return false, ErrChunkFull
+	}
+	if uint32(len(value)) <= chunk.getValueLength(index) {
+		start := chunk.getValueStartIndex(index)
+		copy(chunk.values[start:], value)
+	} else {
+		if err := chunk.ensureCapacityFor(len(value)); err != nil {
+			return false, err
+		}
+		chunk.setNewValueStartIndex(index, chunk.nextFreeByte)
+		chunk.values = append(chunk.values, value...)
+		chunk.nextFreeByte += uint32(len(value))
+	}
+	chunk.setNewValueLength(index, uint32(len(value)))
+	used := chunk.usedValueBytes()
+	if uint64(len(chunk.values)) > 2*used || (chunk.targetBytes > 0 && chunk.SerializedSize() > int(chunk.targetBytes)) {
+		chunk.compactValues()
+	}
+
+	h := sha256.New()
+	h.Write(key)
+	h.Write(value)
+	chunk.hashes[index+chunk.getOffset()] = h.Sum(nil)
+	chunk.computeHashes()
+	return true, nil
+}
+
+// Remove removes a key and its value from the chunk and updates the hashes of the heap.
+// The space of the value is left unused until the values are compacted.
+// It returns false if the key is not found in the chunk or the chunk is read-only.
+// Careful: if the smallest key is removed, the smallest key of the chunk changes in place.
+func (chunk *HeapChunk) Remove(key []byte) bool {
+	index := chunk.indexOf(key)
+	if index == -1 || chunk.readOnly {
+		return false
+	}
+	copy(chunk.keys[chunk.indexToByte(index):], chunk.keys[chunk.indexToByte(index+1):chunk.indexToByte(chunk.currKeysNumber)])
+	offset := chunk.getOffset()
+	copy(chunk.hashes[offset+index:], chunk.hashes[offset+index+1:offset+chunk.currKeysNumber])
+	chunk.hashes[offset+chunk.currKeysNumber-1] = nil
+	chunk.currKeysNumber -= 1
+
+	if chunk.currKeysNumber == 0 {
+		chunk.root = 0
+		chunk.values = chunk.values[:0]
+		chunk.nextFreeByte = 0
+		return true
+	}
+	chunk.computeRootPosition()
+	chunk.computeHashes()
+	return true
+}
+
 func (chunk *HeapChunk) indexOf(key []byte) int32 {
 	size := chunk.currKeysNumber
 	l, r := int32(0), size
@@ -0,0 +1,151 @@
+package chunk
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// ErrReadOnly is returned when modifying a chunk that wraps a memory-mapped region (see NewMappedHeapChunk).
+var ErrReadOnly = errors.New("chunk is read-only")
+
+// Layout of a chunk in a memory-mapped file. A mapped chunk is made of three page-aligned sections:
+//   - a header of mappedHeaderSize bytes followed by the hashes of the heap currently in use (see HeapChunk.GetHeap),
+//     each preceded by a byte set to 1 if the hash is present (0 for nil);
+//   - the keys with their metadata, exactly as in HeapChunk.keys;
+//   - the values, exactly as in HeapChunk.values.
+//
+// The header contains, as little-endian 32-bit integers: the number of keys, the maximal number of keys,
+// the key size, the index bytes, the size bytes, the number of hashes, the offsets of the keys and the values
+// (from the start of the chunk) and the length of the values.
+// The size of a mapped chunk is a multiple of the page size, so that chunks can be written one after the other.
+const mappedHeaderSize = 9 * 4
+
+// mappedHashSlotSize is the size of a hash in the header of a mapped chunk: a presence byte and the hash.
+const mappedHashSlotSize = 1 + sha256.Size
+
+// mappedLayout returns the offsets of the keys and the values and the total size of a mapped chunk.
+func mappedLayout(hashCount, keysLength, valuesLength, pageSize int) (keysOffset, valuesOffset, size int) {
+	keysOffset = alignToPage(mappedHeaderSize+hashCount*mappedHashSlotSize, pageSize)
+	valuesOffset = keysOffset + alignToPage(keysLength, pageSize)
+	return keysOffset, valuesOffset, valuesOffset + alignToPage(valuesLength, pageSize)
+}
+
+func alignToPage(n, pageSize int) int {
+	return (n + pageSize - 1) / pageSize * pageSize
+}
+
+// mappedHashCount returns the number of hashes of the heap currently in use.
+func (chunk *HeapChunk) mappedHashCount() int {
+	if chunk.currKeysNumber == 0 {
+		return 0
+	}
+	return int(2*(chunk.getOffset()-chunk.root) + 1)
+}
+
+// MappedSize returns the number of bytes written by HeapChunk.WriteMapped.
+func (chunk *HeapChunk) MappedSize(pageSize int) int {
+	keysLength := int(chunk.keyAndMetadataSize * chunk.currKeysNumber)
+	_, _, size := mappedLayout(chunk.mappedHashCount(), keysLength, len(chunk.values), pageSize)
+	return size
+}
+
+// WriteMapped writes the chunk in the format read by NewMappedHeapChunk, padding its sections to pageSize.
+// The keys and the values are page-aligned as long as the chunk is written at a page-aligned offset.
+func (chunk *HeapChunk) WriteMapped(buffer io.Writer, pageSize int) error {
+	if pageSize <= 0 {
+		return errors.Errorf("invalid page size %d", pageSize)
+	}
+	hashCount := chunk.mappedHashCount()
+	keys := chunk.keys[0 : chunk.keyAndMetadataSize*chunk.currKeysNumber]
+	keysOffset, valuesOffset, size := mappedLayout(hashCount, len(keys), len(chunk.values), pageSize)
+
+	region := make([]byte, size)
+	header := []uint32{
+		uint32(chunk.currKeysNumber), uint32(chunk.maxSize), uint32(chunk.keySize),
+		uint32(chunk.indexBytes), uint32(chunk.sizeBytes), uint32(hashCount),
+		uint32(keysOffset), uint32(valuesOffset), uint32(len(chunk.values)),
+	}
+	for i, field := range header {
+		binary.LittleEndian.PutUint32(region[4*i:], field)
+	}
+	slot := mappedHeaderSize
+	for _, hash := range chunk.hashes[chunk.root : int(chunk.root)+hashCount] {
+		if hash != nil {
+			region[slot] = 1
+			copy(region[slot+1:slot+mappedHashSlotSize], hash)
+		}
+		slot += mappedHashSlotSize
+	}
+	copy(region[keysOffset:], keys)
+	copy(region[valuesOffset:], chunk.values)
+
+	_, err := buffer.Write(region)
+	if err != nil {
+		return errors.Wrap(err, "while writing mapped chunk")
+	}
+	return nil
+}
+
+// NewMappedHeapChunk returns a read-only chunk that wraps a region written by HeapChunk.WriteMapped, usually
+// memory-mapped from a file. Nothing is copied nor hashed: the keys, the values and the hashes of the returned chunk
+// point into the region, which must not be modified nor unmapped while the chunk is in use.
+// Only the layout of the region is checked: use HeapChunk.Verify to check its content.
+// Every modification of the returned chunk fails with ErrReadOnly.
+func NewMappedHeapChunk(region []byte) (*HeapChunk, error) {
+	if len(region) < mappedHeaderSize {
+		return nil, errors.New("mapped chunk too short")
+	}
+	var header [9]int64
+	for i := range header {
+		header[i] = int64(binary.LittleEndian.Uint32(region[4*i:]))
+	}
+	currSize, maxSize, keySize, indexBytes, sizeBytes := header[0], header[1], header[2], header[3], header[4]
+	hashCount, keysOffset, valuesOffset, valuesLength := header[5], header[6], header[7], header[8]
+
+	if maxSize <= 0 || maxSize > 1<<30 || currSize > maxSize || keySize <= 0 ||
+		indexBytes > 4 || sizeBytes > 4 || keySize > 1<<30 {
+		return nil, errors.New("invalid mapped chunk metadata")
+	}
+	chunk := &HeapChunk{
+		hashes:             make([][]byte, 2*maxSize-1),
+		currKeysNumber:     int32(currSize),
+		maxSize:            int32(maxSize),
+		keySize:            int32(keySize),
+		indexBytes:         int32(indexBytes),
+		sizeBytes:          int32(sizeBytes),
+		keyAndMetadataSize: int32(keySize + indexBytes + sizeBytes),
+		nextFreeByte:       uint32(valuesLength),
+		readOnly:           true,
+	}
+	chunk.computeRootPosition()
+	if int64(chunk.mappedHashCount()) != hashCount {
+		return nil, errors.Errorf("mapped chunk has %d hashes, expected %d", hashCount, chunk.mappedHashCount())
+	}
+	keysLength := currSize * int64(chunk.keyAndMetadataSize)
+	if mappedHeaderSize+hashCount*mappedHashSlotSize > keysOffset || keysOffset+keysLength > valuesOffset ||
+		valuesOffset+valuesLength > int64(len(region)) {
+		return nil, errors.New("invalid mapped chunk layout")
+	}
+
+	for i := int64(0); i < hashCount; i++ {
+		slot := mappedHeaderSize + i*mappedHashSlotSize
+		if region[slot] == 1 {
+			chunk.hashes[int64(chunk.root)+i] = region[slot+1 : slot+mappedHashSlotSize : slot+mappedHashSlotSize]
+		}
+	}
+	// full slice expressions make appends reallocate instead of writing past the sections
+	chunk.keys = region[keysOffset : keysOffset+keysLength : keysOffset+keysLength]
+	chunk.values = region[valuesOffset : valuesOffset+valuesLength : valuesOffset+valuesLength]
+	if currSize == 0 {
+		chunk.root = 0
+	}
+	return chunk, nil
+}
+
+// IsReadOnly returns true if the chunk wraps a memory-mapped region (see NewMappedHeapChunk).
+func (chunk *HeapChunk) IsReadOnly() bool {
+	return chunk.readOnly
+}
@@ -0,0 +1,68 @@
+package chunk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMappedHeapChunk(t *testing.T) {
+	assert := assert.New(t)
+	const pageSize = 4096
+
+	for _, n := range []int{1, 2, 7, 64} {
+		chunk := NewHeapChunk(int32(16000000), int32(1024), int32(4), int32(64))
+		for _, elem := range rand.Perm(n) {
+			key := make([]byte, 4)
+			binary.BigEndian.PutUint32(key, uint32(elem))
+			assert.NoError(chunk.Insert(key, bytes.Repeat(key, 1+elem%3)))
+		}
+
+		var buffer bytes.Buffer
+		assert.NoError(chunk.WriteMapped(&buffer, pageSize))
+		assert.Equal(chunk.MappedSize(pageSize), buffer.Len())
+		assert.Zero(buffer.Len() % pageSize)
+
+		region := buffer.Bytes()
+		mapped, err := NewMappedHeapChunk(region)
+		assert.NoError(err)
+		assert.NoError(mapped.Verify())
+		assert.True(mapped.IsReadOnly())
+		assert.Equal(chunk.GetHash(), mapped.GetHash())
+		assert.Equal(chunk.GetHeap(), mapped.GetHeap())
+
+		// the keys and the values are page-aligned and not copied
+		keysOffset := int(binary.LittleEndian.Uint32(region[6*4:]))
+		valuesOffset := int(binary.LittleEndian.Uint32(region[7*4:]))
+		assert.Zero(keysOffset % pageSize)
+		assert.Zero(valuesOffset % pageSize)
+		assert.Equal(&region[keysOffset], &mapped.GetSmallestKeyUnsafe()[0])
+
+		for i := int32(0); i < chunk.GetCurrSize(); i++ {
+			key := chunk.GetKeyAt(i)
+			assert.Equal(chunk.Get(key), mapped.Get(key))
+			proof, err := mapped.GetProof(key)
+			assert.NoError(err)
+			assert.Equal(chunk.GetHash(), proof.ValidateProof(key, chunk.Get(key)))
+		}
+
+		key := chunk.GetKeyAt(0)
+		assert.Equal(ErrReadOnly, mapped.Insert([]byte{1, 2, 3, 4}, []byte{1}))
+		_, err = mapped.Update(key, []byte{1})
+		assert.Equal(ErrReadOnly, err)
+		assert.False(mapped.Remove(key))
+		assert.Equal(chunk.Get(key), mapped.Get(key))
+	}
+
+	_, err := NewMappedHeapChunk(make([]byte, 10))
+	assert.Error(err)
+	var buffer bytes.Buffer
+	chunk := NewHeapChunk(int32(16000000), int32(1024), int32(4), int32(8))
+	chunk.Insert([]byte{1, 2, 3, 4}, []byte{5})
+	assert.NoError(chunk.WriteMapped(&buffer, 64))
+	_, err = NewMappedHeapChunk(buffer.Bytes()[:64])
+	assert.Error(err)
+}
@@ -2,8 +2,10 @@ package chunk
 
 import (
 	"crypto/sha256"
+	"io"
 
 	"github.com/pkg/errors"
+	"github.com/tendermint/go-amino"
 )
 
 // HeapChunkProof is an in-memory representation of a proof for a given element in the HeapChunk.
@@ -71,3 +73,98 @@ func (proof *HeapChunkProof) ValidateProof(key, value []byte) []byte {
 	}
 	return currHash
 }
+
+// GetIndex returns the index of the K-V pair proven by the proof in a chunk holding size K-V pairs, found from the
+// position in the heap given by the directions of the proof. It returns false if the position is not the one of
+// a K-V pair in such a chunk. With an odd size, the last K-V pair has an empty sibling: its proof must start with
+// an empty hash, so that a chunk with one more K-V pair is not taken for this one.
+// Together with the proofs of the first and the last K-V pair of the chunk, it proves the number of K-V pairs
+// in the chunk and which K-V pairs are adjacent.
+func (proof *HeapChunkProof) GetIndex(size int32) (int32, bool) {
+	if size <= 0 {
+		return 0, false
+	}
+	// the inner hashes come first, then the direct hashes of the K-V pairs, followed by an empty one
+	// with an odd size
+	inner := int(size) - 1
+	if size%2 == 1 {
+		inner = int(size)
+	}
+	position := 0
+	for i := len(proof.directions) - 1; i >= 0; i-- {
+		if proof.directions[i] { // the sibling is on the left: the path goes to the right child
+			position = rightChild(position)
+		} else {
+			position = leftChild(position)
+		}
+		if position > 2*inner {
+			return 0, false
+		}
+	}
+	index := position - inner
+	if index < 0 || index >= int(size) {
+		return 0, false
+	}
+	if size%2 == 1 && index == int(size)-1 && len(proof.hashes[0]) != 0 {
+		return 0, false
+	}
+	return int32(index), true
+}
+
+// SerializeProof serializes a proof into a buffer.
+func (proof *HeapChunkProof) SerializeProof(buffer io.Writer) error {
+	err := amino.EncodeInt32(buffer, int32(len(proof.hashes)))
+	if err != nil {
+		return errors.Wrap(err, "while encoding proof size")
+	}
+
+	for _, h := range proof.hashes {
+		err = amino.EncodeByteSlice(buffer, h)
+		if err != nil {
+			return errors.Wrap(err, "while encoding hash")
+		}
+	}
+
+	for _, dir := range proof.directions {
+		err = amino.EncodeBool(buffer, dir)
+		if err != nil {
+			return errors.Wrap(err, "while encoding direction")
+		}
+	}
+	return nil
+}
+
+// DeserializeProof takes a buffer containing a serialized proof and rebuilds the proof.
+func DeserializeProof(buffer []byte) (*HeapChunkProof, error) {
+	proofSize, j, err := amino.DecodeInt32(buffer)
+	if err != nil {
+		return nil, errors.Wrap(err, "while decoding proof size")
+	}
+	if proofSize < 0 || int(proofSize) > len(buffer) {
+		return nil, errors.New("invalid proof size")
+	}
+	buffer = buffer[j:]
+
+	hashes := make([][]byte, proofSize)
+	directions := make([]bool, proofSize)
+
+	for i := 0; i < int(proofSize); i++ {
+		h, j, err := amino.DecodeByteSlice(buffer)
+		if err != nil {
+			return nil, errors.Wrap(err, "while decoding hash")
+		}
+		buffer = buffer[j:]
+		hashes[i] = h
+	}
+
+	for i := 0; i < int(proofSize); i++ {
+		d, j, err := amino.DecodeBool(buffer)
+		if err != nil {
+			return nil, errors.Wrap(err, "while decoding direction")
+		}
+		buffer = buffer[j:]
+		directions[i] = d
+	}
+
+	return &HeapChunkProof{hashes: hashes, directions: directions}, nil
+}
@@ -89,3 +89,59 @@ func TestBiggerProof(t *testing.T) {
 	assert.False(bytes.Equal(proof.ValidateProof([]byte{34, 0, 0, 0}, []byte{18, 0, 0, 0}), chunk.hashes[chunk.root]))
 
 }
+
+func TestSearchKey(t *testing.T) {
+	assert := assert.New(t)
+	for n := 1; n <= 16; n++ {
+		chunk := NewHeapChunk(1024, 256, 4, 16)
+		var keys, values [][]byte
+		for i := 0; i < n; i++ {
+			num := make([]byte, 4)
+			binary.BigEndian.PutUint32(num, uint32(i))
+			chunk.Insert(num, []byte{byte(i), byte(i)})
+			keys = append(keys, num)
+			values = append(values, []byte{byte(i), byte(i)})
+		}
+		assert.Equal(int32(0), chunk.SearchKey([]byte{0, 0, 0, 0}))
+		assert.Equal(int32(n), chunk.SearchKey([]byte{1, 0, 0, 0}))
+		assert.Equal(keys[n-1], chunk.GetKeyAt(chunk.SearchKey(keys[n-1])))
+		assert.Equal(values[n-1], chunk.GetValueAt(int32(n-1)))
+	}
+}
+
+func TestProofIndex(t *testing.T) {
+	assert := assert.New(t)
+	for n := 1; n <= 16; n++ {
+		chunk := NewHeapChunk(1024, 256, 4, 16)
+		var proofs []*HeapChunkProof
+		for i := 0; i <= n; i++ {
+			num := make([]byte, 4)
+			binary.BigEndian.PutUint32(num, uint32(i))
+			chunk.Insert(num, num)
+		}
+		// the chunk had one more K-V pair, to check that removals leave an empty direct hash
+		chunk.Remove([]byte{0, 0, 0, byte(n)})
+
+		for i := 0; i < n; i++ {
+			num := make([]byte, 4)
+			binary.BigEndian.PutUint32(num, uint32(i))
+			proof, err := chunk.GetProof(num)
+			assert.Nil(err)
+			index, ok := proof.GetIndex(int32(n))
+			assert.True(ok, "key %d of %d", i, n)
+			assert.Equal(int32(i), index)
+			proofs = append(proofs, proof)
+		}
+
+		// the proofs of the first and the last K-V pairs do not fit together a chunk of another size
+		for size := int32(1); size <= 20; size++ {
+			first, okFirst := proofs[0].GetIndex(size)
+			last, okLast := proofs[n-1].GetIndex(size)
+			if size != int32(n) {
+				assert.False(okFirst && okLast && first == 0 && last == size-1, "%d keys as %d", n, size)
+			}
+		}
+	}
+	_, ok := (&HeapChunkProof{}).GetIndex(4)
+	assert.False(ok)
+}
@@ -0,0 +1,102 @@
+package chunk
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidMove is returned when K-V pairs cannot be moved between two chunks.
+var ErrInvalidMove = errors.New("invalid move between chunks")
+
+// MoveLastTo moves the count largest K-V pairs of the chunk to right, whose keys must all be larger.
+// The chunk must keep at least one K-V pair and right must have enough free space.
+// An error is returned, and both chunks are left unchanged, if the K-V pairs cannot be moved.
+// Careful: the smallest key of right changes.
+func (chunk *HeapChunk) MoveLastTo(right *HeapChunk, count int32) error {
+	first := chunk.currKeysNumber - count
+	if err := chunk.checkMove(right, first, count); err != nil {
+		return err
+	}
+	if right.currKeysNumber > 0 && bytes.Compare(chunk.GetKeyAt(chunk.currKeysNumber-1), right.GetSmallestKeyUnsafe()) != -1 {
+		return errors.Wrap(ErrInvalidMove, "the keys are not smaller than the keys of the right chunk")
+	}
+
+	// insert from the largest key: every pair is inserted at the beginning of right
+	for i := chunk.currKeysNumber - 1; i >= first; i-- {
+		if err := right.Insert(chunk.GetKeyAt(i), chunk.GetValueAt(i)); err != nil {
+			// cannot happen: the move was checked above
+			return err
+		}
+	}
+	offset := chunk.getOffset()
+	for i := first; i < chunk.currKeysNumber; i++ {
+		chunk.hashes[i+offset] = nil
+	}
+	chunk.currKeysNumber = first
+	chunk.rebuild()
+	return nil
+}
+
+// MoveFirstTo moves the count smallest K-V pairs of the chunk to left, whose keys must all be smaller.
+// The chunk must keep at least one K-V pair and left must have enough free space.
+// An error is returned, and both chunks are left unchanged, if the K-V pairs cannot be moved.
+// Careful: the smallest key of the chunk changes.
+func (chunk *HeapChunk) MoveFirstTo(left *HeapChunk, count int32) error {
+	if err := chunk.checkMove(left, 0, count); err != nil {
+		return err
+	}
+	if left.currKeysNumber > 0 && bytes.Compare(left.GetKeyAt(left.currKeysNumber-1), chunk.GetSmallestKeyUnsafe()) != -1 {
+		return errors.Wrap(ErrInvalidMove, "the keys are not larger than the keys of the left chunk")
+	}
+
+	// every pair is inserted at the end of left
+	for i := int32(0); i < count; i++ {
+		if err := left.Insert(chunk.GetKeyAt(i), chunk.GetValueAt(i)); err != nil {
+			// cannot happen: the move was checked above
+			return err
+		}
+	}
+	// shift the remaining keys and their direct hashes to the beginning
+	remaining := chunk.currKeysNumber - count
+	copy(chunk.keys, chunk.keys[chunk.indexToByte(count):chunk.indexToByte(chunk.currKeysNumber)])
+	offset := chunk.getOffset()
+	copy(chunk.hashes[offset:], chunk.hashes[offset+count:offset+chunk.currKeysNumber])
+	for i := remaining; i < chunk.currKeysNumber; i++ {
+		chunk.hashes[i+offset] = nil
+	}
+	chunk.currKeysNumber = remaining
+	chunk.rebuild()
+	return nil
+}
+
+// checkMove returns an error if the count K-V pairs starting at index first cannot be moved to other.
+func (chunk *HeapChunk) checkMove(other *HeapChunk, first, count int32) error {
+	if chunk.readOnly || other.readOnly {
+		return ErrReadOnly
+	}
+	if count < 1 || count >= chunk.currKeysNumber {
+		return errors.Wrapf(ErrInvalidMove, "cannot move %d of %d keys", count, chunk.currKeysNumber)
+	}
+	if other.keySize != chunk.keySize || other.indexBytes != chunk.indexBytes || other.sizeBytes != chunk.sizeBytes {
+		return errors.Wrap(ErrInvalidMove, "the chunks have different parameters")
+	}
+	if count > other.maxSize-other.currKeysNumber {
+		return errors.Wrapf(ErrInvalidMove, "no space for %d keys", count)
+	}
+	movedBytes := 0
+	for i := first; i < first+count; i++ {
+		movedBytes += int(chunk.getValueLength(i))
+	}
+	if other.targetBytes > 0 && other.SerializedSize()+int(count*other.keyAndMetadataSize)+movedBytes > int(other.targetBytes) {
+		return errors.Wrapf(ErrInvalidMove, "%d keys exceed the target size", count)
+	}
+	return other.ensureCapacityFor(movedBytes)
+}
+
+// rebuild compacts the values and recomputes the heap after K-V pairs were removed.
+func (chunk *HeapChunk) rebuild() {
+	chunk.compactValues()
+	chunk.computeRootPosition()
+	chunk.computeHashes()
+}
@@ -0,0 +1,75 @@
+package chunk
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// chunkWithKeys returns a chunk of 8 keys containing the given keys, each mapped to a value of key+1 bytes.
+func chunkWithKeys(keys ...byte) *HeapChunk {
+	chunk := NewHeapChunk(1024, 256, 1, 8)
+	for _, k := range keys {
+		chunk.Insert([]byte{k}, make([]byte, k+1))
+	}
+	return chunk
+}
+
+func assertKeys(assert *assert.Assertions, chunk *HeapChunk, keys ...byte) {
+	assert.Equal(int32(len(keys)), chunk.GetCurrSize())
+	for i, k := range keys {
+		assert.Equal([]byte{k}, chunk.GetKeyAt(int32(i)))
+		assert.Equal(make([]byte, k+1), chunk.GetValueAt(int32(i)))
+	}
+	assert.Nil(chunk.Verify())
+}
+
+func TestMoveLastTo(t *testing.T) {
+	assert := assert.New(t)
+	left := chunkWithKeys(1, 2, 3, 4, 5, 6, 7, 8)
+	right := chunkWithKeys(10, 11)
+	smallestKey := right.GetSmallestKeyUnsafe()
+
+	assert.NoError(left.MoveLastTo(right, 3))
+	assertKeys(assert, left, 1, 2, 3, 4, 5)
+	assertKeys(assert, right, 6, 7, 8, 10, 11)
+	// the smallest key is updated in place
+	assert.Equal([]byte{6}, smallestKey)
+
+	assert.NoError(left.MoveLastTo(chunkWithKeys(), 1))
+	assertKeys(assert, left, 1, 2, 3, 4)
+}
+
+func TestMoveFirstTo(t *testing.T) {
+	assert := assert.New(t)
+	left := chunkWithKeys(1, 2)
+	right := chunkWithKeys(10, 11, 12, 13, 14, 15, 16, 17)
+	smallestKey := right.GetSmallestKeyUnsafe()
+
+	assert.NoError(right.MoveFirstTo(left, 4))
+	assertKeys(assert, left, 1, 2, 10, 11, 12, 13)
+	assertKeys(assert, right, 14, 15, 16, 17)
+	assert.Equal([]byte{14}, smallestKey)
+
+	assert.NoError(right.MoveFirstTo(left, 1))
+	assertKeys(assert, right, 15, 16, 17)
+	assertKeys(assert, left, 1, 2, 10, 11, 12, 13, 14)
+}
+
+func TestInvalidMove(t *testing.T) {
+	assert := assert.New(t)
+	left := chunkWithKeys(1, 2, 3, 4, 5, 6, 7, 8)
+	right := chunkWithKeys(10, 11, 12, 13, 14)
+
+	// the source must keep a key, the destination must have space and the keys must stay sorted
+	assert.True(errors.Is(left.MoveLastTo(right, 0), ErrInvalidMove))
+	assert.True(errors.Is(left.MoveLastTo(chunkWithKeys(), 8), ErrInvalidMove))
+	assert.True(errors.Is(left.MoveLastTo(right, 4), ErrInvalidMove))
+	assert.True(errors.Is(right.MoveLastTo(left, 1), ErrInvalidMove))
+	assert.True(errors.Is(left.MoveFirstTo(right, 1), ErrInvalidMove))
+	assert.True(errors.Is(left.MoveLastTo(NewHeapChunk(1024, 256, 2, 8), 1), ErrInvalidMove))
+
+	assertKeys(assert, left, 1, 2, 3, 4, 5, 6, 7, 8)
+	assertKeys(assert, right, 10, 11, 12, 13, 14)
+}
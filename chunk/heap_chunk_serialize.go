@@ -8,6 +8,17 @@ import (
 	"github.com/tendermint/go-amino"
 )
 
+// SerializedSize returns the number of bytes written by HeapChunk.Serialize.
+func (chunk *HeapChunk) SerializedSize() int {
+	return chunk.serializedSizeWith(chunk.currKeysNumber, len(chunk.values))
+}
+
+// serializedSizeWith returns the serialized size of the chunk if it had keys keys and valueBytes bytes of values.
+func (chunk *HeapChunk) serializedSizeWith(keys int32, valueBytes int) int {
+	keysLength := int(chunk.keyAndMetadataSize * keys)
+	return 4*4 + amino.UvarintSize(uint64(keysLength)) + keysLength + amino.UvarintSize(uint64(valueBytes)) + valueBytes
+}
+
 func (chunk *HeapChunk) Serialize(buffer io.Writer) error {
 
 	err := amino.EncodeInt32(buffer, chunk.currKeysNumber)
@@ -43,33 +54,55 @@ func (chunk *HeapChunk) Serialize(buffer io.Writer) error {
 }
 
 func Deserialize(buffer []byte, maxSize int32) (*HeapChunk, error) {
+	chunk, _, err := DeserializeWithLength(buffer, maxSize)
+	return chunk, err
+}
+
+// DeserializeWithLength works like Deserialize but also returns the number of bytes of the buffer
+// that were consumed by the chunk. This allows callers to find data appended after a serialized chunk.
+func DeserializeWithLength(buffer []byte, maxSize int32) (*HeapChunk, int, error) {
 	// decode
+	n := 0
 
 	currSize, j, err := amino.DecodeInt32(buffer)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	buffer = buffer[j:]
+	n += j
 
 	sizeBytes, j, err := amino.DecodeInt32(buffer)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	buffer = buffer[j:]
+	n += j
 
 	indexBytes, j, err := amino.DecodeInt32(buffer)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	buffer = buffer[j:]
+	n += j
 
 	keySize, j, err := amino.DecodeInt32(buffer)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	buffer = buffer[j:]
+	n += j
+
+	if currSize < 0 || currSize > maxSize || keySize <= 0 || indexBytes < 0 || sizeBytes < 0 {
+		return nil, 0, errors.New("invalid chunk metadata")
+	}
 
 	keys, j, err := amino.DecodeByteSlice(buffer)
+	if err != nil {
+		return nil, 0, err
+	}
+	if int32(len(keys)) != currSize*(keySize+indexBytes+sizeBytes) {
+		return nil, 0, errors.New("invalid keys length")
+	}
 	// if the chunk was not full, the returned slice will have a smaller capacity.
 	// The structure requires that the space for all keys is preallocated (cap(keys) == maxSize * keyAndMetadataSize)
 	// Must ensure that the underlying array has the correct capacity.
@@ -78,15 +111,14 @@ func Deserialize(buffer []byte, maxSize int32) (*HeapChunk, error) {
 		copy(newKeysSlice[0:], keys)
 		keys = newKeysSlice
 	}
-	if err != nil {
-		return nil, err
-	}
 	buffer = buffer[j:]
+	n += j
 
-	values, _, err := amino.DecodeByteSlice(buffer)
+	values, j, err := amino.DecodeByteSlice(buffer)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
+	n += j
 
 	chunk := &HeapChunk{
 		hashes:             make([][]byte, (maxSize*2)-1),
@@ -108,6 +140,9 @@ func Deserialize(buffer []byte, maxSize int32) (*HeapChunk, error) {
 		currKey := chunk.getKey(i - offset)
 		start := chunk.getValueStartIndex(i - offset)
 		end := chunk.getValueLength(i - offset)
+		if uint64(start)+uint64(end) > uint64(len(chunk.values)) {
+			return nil, 0, errors.New("value out of bounds")
+		}
 		currVal := chunk.values[start : start+end]
 		h.Write(currKey)
 		h.Write(currVal)
@@ -121,5 +156,5 @@ func Deserialize(buffer []byte, maxSize int32) (*HeapChunk, error) {
 
 	chunk.computeRootPosition()
 	chunk.computeHashes()
-	return chunk, nil
+	return chunk, n, nil
 }
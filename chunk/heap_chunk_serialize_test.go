@@ -28,6 +28,7 @@ func TestHeapChunk_Serialize(t *testing.T) {
 	var buffer bytes.Buffer
 	err := chunk.Serialize(&buffer)
 	assert.Nil(err)
+	assert.Equal(buffer.Len(), chunk.SerializedSize())
 	deserializedChunk, err := Deserialize(buffer.Bytes(), int32(fullSize))
 
 	assert.Nil(err)
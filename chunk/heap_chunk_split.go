@@ -0,0 +1,261 @@
+package chunk
+
+import "crypto/sha256"
+
+// SplitPolicy decides where a full chunk is split by HeapChunk.InsertAndSplitWithPolicy.
+type SplitPolicy uint8
+
+const (
+	// SplitMidpoint splits the chunk in two halves with the same number of keys.
+	SplitMidpoint SplitPolicy = iota
+	// SplitAppend keeps 90% of the keys in the left chunk when the new key is inserted at the right edge
+	// of the chunk, and splits at the midpoint otherwise. With monotonically increasing keys, chunks stay
+	// 90% full instead of half empty.
+	SplitAppend
+	// SplitBySize splits the chunk so that both halves have about the same serialized size.
+	SplitBySize
+)
+
+// appendSplitRatio is the percentage of keys kept in the left chunk by SplitAppend.
+const appendSplitRatio = 90
+
+// String returns the name of the policy.
+func (policy SplitPolicy) String() string {
+	switch policy {
+	case SplitMidpoint:
+		return "midpoint"
+	case SplitAppend:
+		return "append"
+	case SplitBySize:
+		return "size"
+	}
+	return "unknown"
+}
+
+// InsertAndSplit inserts a new K-V pair in a full chunk by splitting it into two halves with the same number of keys.
+// See HeapChunk.InsertAndSplitWithPolicy.
+func (chunk *HeapChunk) InsertAndSplit(key, value []byte) (leftChunk *HeapChunk, middleKey []byte, rightChunk *HeapChunk, err error) {
+	return chunk.InsertAndSplitWithPolicy(key, value, SplitMidpoint)
+}
+
+// UpdateAndSplitWithPolicy replaces the value mapped to an existing key in a chunk that has no room for the new value
+// (see HeapChunk.HasRoomForUpdate) by splitting the chunk, as HeapChunk.InsertAndSplitWithPolicy does for a new key.
+// An error is returned, and the chunk is left unchanged, if the chunk has room for the new value, the key is not found,
+// the K-V pair cannot be stored in the chunk or no split into two chunks fits the target (ErrSplitNotFound).
+func (chunk *HeapChunk) UpdateAndSplitWithPolicy(key, value []byte, policy SplitPolicy) (leftChunk *HeapChunk, middleKey []byte, rightChunk *HeapChunk, err error) {
+	if chunk.readOnly {
+		return nil, nil, nil, ErrReadOnly
+	}
+	index := chunk.indexOf(key)
+	if index == -1 {
+		return nil, nil, nil, ErrKeyNotFound
+	}
+	if chunk.HasRoomForUpdate(key, value) {
+		return nil, nil, nil, ErrChunkNotFull
+	}
+	if err = chunk.CheckEntry(key, value); err != nil {
+		return nil, nil, nil, err
+	}
+	if chunk.usedValueBytes()-uint64(chunk.getValueLength(index))+uint64(len(value)) >= uint64(1)<<(8*chunk.indexBytes) {
+		return nil, nil, nil, ErrCapacityExceeded
+	}
+	entries := chunk.splitEntries(index, key, value, false)
+	leftSize, ok := chunk.fittingSplit(entries, index, chunk.splitIndex(policy, entries, index))
+	if !ok {
+		return nil, nil, nil, ErrSplitNotFound
+	}
+	middleKey, rightChunk = chunk.splitInto(entries, leftSize)
+	return chunk, middleKey, rightChunk, nil
+}
+
+// SplitAt splits a chunk into two chunks without changing its K-V pairs: the left chunk reuses the calling chunk and
+// keeps the first index K-V pairs, the right chunk is a new chunk whose smallest key is returned as middleKey.
+// It is used to make room next to a key when HeapChunk.InsertAndSplitWithPolicy or HeapChunk.UpdateAndSplitWithPolicy
+// return ErrSplitNotFound. The caller must ensure that 0 < index < HeapChunk.GetCurrSize().
+func (chunk *HeapChunk) SplitAt(index int32) (leftChunk *HeapChunk, middleKey []byte, rightChunk *HeapChunk, err error) {
+	if chunk.readOnly {
+		return nil, nil, nil, ErrReadOnly
+	}
+	middleKey, rightChunk = chunk.splitInto(chunk.splitEntries(-1, nil, nil, false), index)
+	return chunk, middleKey, rightChunk, nil
+}
+
+// splitEntry is a K-V pair of a chunk being split, together with its direct hash.
+type splitEntry struct {
+	key, value, hash []byte
+}
+
+// splitEntries returns the K-V pairs of the chunk in key order, with the given K-V pair inserted at index if insert
+// is set, or replacing the K-V pair at index otherwise. A negative index returns the K-V pairs of the chunk unchanged.
+// The returned slices point into the chunk.
+func (chunk *HeapChunk) splitEntries(index int32, key, value []byte, insert bool) []splitEntry {
+	offset := chunk.getOffset()
+	changed := splitEntry{key: key, value: value}
+	if index >= 0 {
+		h := sha256.New()
+		h.Write(key)
+		h.Write(value)
+		changed.hash = h.Sum(nil)
+	}
+	entries := make([]splitEntry, 0, chunk.currKeysNumber+1)
+	for k := int32(0); k < chunk.currKeysNumber; k++ {
+		if k == index {
+			entries = append(entries, changed)
+			if !insert {
+				continue
+			}
+		}
+		entries = append(entries, splitEntry{chunk.getKey(k), chunk.GetValueAt(k), chunk.hashes[k+offset]})
+	}
+	if insert && index == chunk.currKeysNumber {
+		entries = append(entries, changed)
+	}
+	return entries
+}
+
+// splitInto splits the chunk into two chunks made of the given entries: the first leftSize entries are kept in the
+// calling chunk and the others are moved to the returned right chunk, whose smallest key is returned as middleKey.
+// Both chunks are compacted.
+func (chunk *HeapChunk) splitInto(entries []splitEntry, leftSize int32) (middleKey []byte, rightChunk *HeapChunk) {
+	leftChunk := NewHeapChunkCopy(chunk)
+	leftChunk.fill(entries[:leftSize])
+	rightChunk = NewHeapChunkCopy(chunk)
+	rightChunk.fill(entries[leftSize:])
+
+	// !!NOTE!!:
+	// the entries point into the chunk: it is only changed once both chunks are built.
+	// The keys of the left chunk are copied to the underlying array of keys of the chunk, which is never reallocated:
+	// the smallest key of a chunk is returned as middle key without making a copy (see HeapChunk.GetSmallestKeyUnsafe).
+	copy(chunk.keys, leftChunk.keys)
+	chunk.values = leftChunk.values
+	chunk.hashes = leftChunk.hashes
+	chunk.currKeysNumber = leftChunk.currKeysNumber
+	chunk.nextFreeByte = leftChunk.nextFreeByte
+	chunk.root = leftChunk.root
+	return rightChunk.keys[0:rightChunk.keySize], rightChunk
+}
+
+// fill appends the entries, in key order, to an empty chunk and computes the hashes of its heap.
+func (chunk *HeapChunk) fill(entries []splitEntry) {
+	offset := chunk.getOffset()
+	for k, entry := range entries {
+		encodedKey := encodeIndexAndLength(entry.key, chunk.nextFreeByte, uint32(len(entry.value)), chunk.indexBytes, chunk.sizeBytes)
+		copy(chunk.keys[chunk.indexToByte(int32(k)):], encodedKey)
+		chunk.values = append(chunk.values, entry.value...)
+		chunk.nextFreeByte += uint32(len(entry.value))
+		chunk.hashes[int32(k)+offset] = entry.hash
+	}
+	chunk.currKeysNumber = int32(len(entries))
+	chunk.computeRootPosition()
+	chunk.computeHashes()
+}
+
+// fittingSplit returns the number of entries kept in the left chunk by the split closest to preferred such that the
+// chunk receiving the changed entry fits the target of the chunk once compacted, or holds the changed entry alone.
+// The chunk receiving only unchanged entries always fits, as the chunk did. It returns false if there is no such split.
+func (chunk *HeapChunk) fittingSplit(entries []splitEntry, changed int32, preferred int32) (int32, bool) {
+	n := int32(len(entries))
+	// valueBytes[k] is the number of bytes of the values of the first k entries
+	valueBytes := make([]int, n+1)
+	for k, entry := range entries {
+		valueBytes[k+1] = valueBytes[k] + len(entry.value)
+	}
+	fits := func(from, to int32) bool {
+		if chunk.targetBytes <= 0 || to-from == 1 || changed < from || changed >= to {
+			return true
+		}
+		return chunk.serializedSizeWith(to-from, valueBytes[to]-valueBytes[from]) <= int(chunk.targetBytes)
+	}
+	for d := int32(0); d < n; d++ {
+		for _, leftSize := range []int32{preferred - d, preferred + d} {
+			if leftSize >= 1 && leftSize < n && fits(0, leftSize) && fits(leftSize, n) {
+				return leftSize, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// splitIndex returns the number of entries kept in the left chunk when the chunk is split at the position chosen by
+// policy, the changed entry being at index changed. The position is chosen among the other entries, the changed
+// entry going to the left chunk when there are other entries after it in the left chunk.
+// Both chunks get at least one entry.
+func (chunk *HeapChunk) splitIndex(policy SplitPolicy, entries []splitEntry, changed int32) int32 {
+	n := int32(len(entries)) - 1 // the number of other entries
+	m := (n + 1) / 2
+	switch policy {
+	case SplitAppend:
+		if changed == n {
+			m = n * appendSplitRatio / 100
+		}
+	case SplitBySize:
+		m = chunk.sizeSplitIndex(entries, changed)
+	}
+	if m < 1 {
+		m = 1
+	}
+	if m > n {
+		m = n
+	}
+	if m == n && changed < n {
+		// the changed entry goes to the left chunk: the right chunk needs at least one of the other entries
+		m = n - 1
+	}
+	if changed < m {
+		m++
+	}
+	if m < 1 {
+		// a single other entry after the changed one: the changed entry goes alone in the left chunk
+		m = 1
+	}
+	return m
+}
+
+// sizeSplitIndex returns the number of other entries (see HeapChunk.splitIndex) kept in the left chunk that best
+// balances the serialized bytes (keys, metadata and values) between the two chunks.
+// Among equally balanced split indexes, the one closest to the midpoint is returned.
+func (chunk *HeapChunk) sizeSplitIndex(entries []splitEntry, changed int32) int32 {
+	entryBytes := func(k int32) uint64 {
+		return uint64(chunk.keyAndMetadataSize) + uint64(len(entries[k].value))
+	}
+	total := uint64(0)
+	for k := range entries {
+		total += entryBytes(int32(k))
+	}
+
+	// left is the number of bytes in the left chunk when m other entries are kept in it.
+	// The changed entry goes to the left chunk when changed < m.
+	n := int32(len(entries)) - 1
+	midpoint := (n + 1) / 2
+	best, bestDifference := int32(1), uint64(0)
+	left := uint64(0)
+	for m := int32(1); m <= n; m++ {
+		k := m - 1
+		if k >= changed {
+			k++
+		}
+		left += entryBytes(k)
+		if changed == m-1 {
+			left += entryBytes(changed)
+		}
+		var difference uint64
+		if 2*left > total {
+			difference = 2*left - total
+		} else {
+			difference = total - 2*left
+		}
+		if m == 1 || difference < bestDifference ||
+			(difference == bestDifference && distance(m, midpoint) < distance(best, midpoint)) {
+			best, bestDifference = m, difference
+		}
+	}
+	return best
+}
+
+// distance returns the absolute difference between a and b.
+func distance(a, b int32) int32 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
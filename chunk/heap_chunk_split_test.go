@@ -0,0 +1,185 @@
+package chunk
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fullChunk returns a full chunk with the keys 10, 20, ..., 80. The value of key 80 is 100 bytes long.
+func fullChunk() *HeapChunk {
+	chunk := NewHeapChunk(1024, 256, 1, 8)
+	for k := byte(10); k < 80; k += 10 {
+		chunk.Insert([]byte{k}, []byte{k})
+	}
+	chunk.Insert([]byte{80}, bytes.Repeat([]byte{80}, 100))
+	return chunk
+}
+
+func TestSplitPolicies(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		policy    SplitPolicy
+		key       byte
+		leftSize  int32
+		rightSize int32
+	}{
+		{SplitMidpoint, 90, 4, 5},
+		{SplitMidpoint, 15, 5, 4},
+		{SplitAppend, 90, 7, 2},
+		{SplitAppend, 15, 5, 4},
+		{SplitAppend, 75, 4, 5},
+		{SplitBySize, 90, 7, 2},
+		{SplitBySize, 15, 8, 1},
+		{SplitBySize, 75, 7, 2},
+	}
+	for _, test := range tests {
+		left, middleKey, right, err := fullChunk().InsertAndSplitWithPolicy([]byte{test.key}, []byte{test.key}, test.policy)
+		assert.NoError(err)
+		assert.Equal(test.leftSize, left.GetCurrSize(), "%s policy, key %d", test.policy, test.key)
+		assert.Equal(test.rightSize, right.GetCurrSize(), "%s policy, key %d", test.policy, test.key)
+		assert.Equal(right.GetSmallestKey(), middleKey)
+		assert.Nil(left.Verify())
+		assert.Nil(right.Verify())
+	}
+}
+
+// TestSplitAtEveryPosition checks the content of both chunks for every policy and insertion position.
+func TestSplitAtEveryPosition(t *testing.T) {
+	assert := assert.New(t)
+	for _, policy := range []SplitPolicy{SplitMidpoint, SplitAppend, SplitBySize} {
+		for key := byte(5); key <= 85; key += 10 {
+			chunk := fullChunk()
+			expected := map[byte][]byte{key: {key, key}}
+			chunk.Range(func(k, v []byte) bool {
+				expected[k[0]] = append([]byte(nil), v...)
+				return true
+			})
+
+			left, _, right, err := chunk.InsertAndSplitWithPolicy([]byte{key}, []byte{key, key}, policy)
+			assert.NoError(err)
+			assert.True(left.GetCurrSize() > 0 && right.GetCurrSize() > 0)
+			assert.Equal(int32(len(expected)), left.GetCurrSize()+right.GetCurrSize())
+			assert.Equal(-1, bytes.Compare(left.GetKeyAt(left.GetCurrSize()-1), right.GetSmallestKey()))
+			for k, v := range expected {
+				value := left.Get([]byte{k})
+				if value == nil {
+					value = right.Get([]byte{k})
+				}
+				assert.Equal(v, value, "%s policy, key %d", policy, k)
+			}
+			assert.Nil(left.Verify())
+			assert.Nil(right.Verify())
+		}
+	}
+}
+
+func TestSplitBySizeEmptyValues(t *testing.T) {
+	assert := assert.New(t)
+	// keys and metadata count: with equal entries, the chunk is split at the midpoint
+	for _, key := range []byte{5, 45, 85} {
+		chunk := NewHeapChunk(1024, 256, 1, 8)
+		for k := byte(10); k <= 80; k += 10 {
+			chunk.Insert([]byte{k}, []byte{})
+		}
+		left, _, right, err := chunk.InsertAndSplitWithPolicy([]byte{key}, []byte{}, SplitBySize)
+		assert.NoError(err)
+		assert.Equal(int32(9), left.GetCurrSize()+right.GetCurrSize())
+		assert.LessOrEqual(distance(left.GetCurrSize(), right.GetCurrSize()), int32(1), "key %d", key)
+		assert.Nil(left.Verify())
+		assert.Nil(right.Verify())
+	}
+}
+
+func TestSplitNotFound(t *testing.T) {
+	assert := assert.New(t)
+	chunk := NewHeapChunk(1024, 256, 1, MaxKeysForTargetBytes(1024, 256, 1, 100))
+	chunk.SetTargetBytes(100)
+	assert.NoError(chunk.Insert([]byte{10}, make([]byte, 30)))
+	assert.NoError(chunk.Insert([]byte{20}, make([]byte, 10)))
+	assert.NoError(chunk.Insert([]byte{30}, make([]byte, 30)))
+	hash := chunk.GetHash()
+
+	// with its new value, the middle key fits in neither chunk of any split: the chunk is left unchanged
+	_, _, _, err := chunk.UpdateAndSplitWithPolicy([]byte{20}, make([]byte, 60), SplitBySize)
+	assert.Equal(ErrSplitNotFound, err)
+	_, _, _, err = chunk.InsertAndSplitWithPolicy([]byte{25}, make([]byte, 60), SplitMidpoint)
+	assert.Equal(ErrSplitNotFound, err)
+	assert.Equal(hash, chunk.GetHash())
+	assert.Equal(make([]byte, 10), chunk.Get([]byte{20}))
+	assert.Nil(chunk.Verify())
+
+	// once the chunk is split next to the key, the key is at the edge of a chunk
+	smallestKey := chunk.GetSmallestKeyUnsafe()
+	left, middleKey, right, err := chunk.SplitAt(1)
+	assert.NoError(err)
+	assert.Equal([]byte{20}, middleKey)
+	assert.Equal([]byte{10}, smallestKey)
+	assert.Equal(int32(1), left.GetCurrSize())
+	assert.Equal(int32(2), right.GetCurrSize())
+	assert.Nil(left.Verify())
+	assert.Nil(right.Verify())
+	left, middleKey, right, err = right.UpdateAndSplitWithPolicy([]byte{20}, make([]byte, 60), SplitBySize)
+	assert.NoError(err)
+	assert.Equal([]byte{30}, middleKey)
+	assert.Equal(make([]byte, 60), left.Get([]byte{20}))
+	assert.Equal(int32(1), left.GetCurrSize())
+	assert.Nil(right.Verify())
+}
+
+// TestSplitNearTarget splits chunks filled with values close to the target: either both chunks fit the target
+// or hold a single K-V pair, or the chunk is left unchanged.
+func TestSplitNearTarget(t *testing.T) {
+	assert := assert.New(t)
+	for _, target := range []int32{300, 4096, 65536} {
+		maxSize := MaxKeysForTargetBytes(1<<24, 1<<16, 4, target)
+		for i := 0; i < 200; i++ {
+			chunk := NewHeapChunk(1<<24, 1<<16, 4, maxSize)
+			chunk.SetTargetBytes(target)
+			randomValue := func() []byte {
+				return make([]byte, 10+rand.Intn(int(target)*9/10))
+			}
+			randomKey := func() []byte {
+				key := make([]byte, 4)
+				rand.Read(key)
+				return key
+			}
+			for {
+				key, value := randomKey(), randomValue()
+				if !chunk.HasRoomFor(value) {
+					break
+				}
+				chunk.Insert(key, value)
+			}
+			hash := chunk.GetHash()
+			size := chunk.GetCurrSize()
+
+			var left, right *HeapChunk
+			var err error
+			key, value := randomKey(), randomValue()
+			if index := int32(rand.Intn(int(size))); rand.Intn(2) == 0 && !chunk.HasRoomForUpdate(chunk.GetKeyAt(index), value) {
+				key = chunk.GetKeyAt(index)
+				left, _, right, err = chunk.UpdateAndSplitWithPolicy(key, value, SplitPolicy(i%3))
+				size--
+			} else if !chunk.HasRoomFor(value) && chunk.Get(key) == nil {
+				left, _, right, err = chunk.InsertAndSplitWithPolicy(key, value, SplitPolicy(i%3))
+			} else {
+				continue
+			}
+			if err == ErrSplitNotFound {
+				assert.Equal(hash, chunk.GetHash())
+				assert.Nil(chunk.Verify())
+				continue
+			}
+			assert.NoError(err)
+			assert.Equal(size+1, left.GetCurrSize()+right.GetCurrSize())
+			for _, c := range []*HeapChunk{left, right} {
+				assert.True(c.SerializedSize() <= int(target) || c.GetCurrSize() == 1, "chunk of %d bytes", c.SerializedSize())
+				assert.Nil(c.Verify())
+			}
+			assert.Equal(value, append(left.Get(key), right.Get(key)...))
+		}
+	}
+}
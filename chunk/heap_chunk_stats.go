@@ -0,0 +1,38 @@
+package chunk
+
+import "math/bits"
+
+// HeapChunkStats summarizes the memory usage of a HeapChunk.
+type HeapChunkStats struct {
+	Keys             int32  // number of keys in the chunk
+	KeyBytes         int    // bytes used by the keys, including their metadata
+	ValueBytes       int    // bytes used by the values currently mapped to a key
+	WastedValueBytes int    // bytes in the values array that are no longer mapped to a key (eg. after updates)
+	HashBytes        int    // bytes used by the hashes of the heap
+	LargestValue     uint32 // size of the largest value in the chunk
+	ProofLengthSum   int    // sum of the proof lengths of all the keys in the chunk
+}
+
+// GetStats returns statistics about the memory usage of the chunk.
+func (chunk *HeapChunk) GetStats() HeapChunkStats {
+	stats := HeapChunkStats{
+		Keys:     chunk.currKeysNumber,
+		KeyBytes: int(chunk.currKeysNumber * chunk.keyAndMetadataSize),
+	}
+	offset := chunk.getOffset()
+	for i := int32(0); i < chunk.currKeysNumber; i++ {
+		length := chunk.getValueLength(i)
+		stats.ValueBytes += int(length)
+		if length > stats.LargestValue {
+			stats.LargestValue = length
+		}
+		// the proof of a key is as long as the depth of its direct hash in the heap
+		relativeIndex := uint32(i + offset - chunk.root)
+		stats.ProofLengthSum += bits.Len32(relativeIndex+1) - 1
+	}
+	stats.WastedValueBytes = len(chunk.values) - stats.ValueBytes
+	for _, h := range chunk.GetHeap() {
+		stats.HashBytes += len(h)
+	}
+	return stats
+}
@@ -9,6 +9,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	// "time"
 )
@@ -229,7 +230,8 @@ func TestSplitSmallHeapInsertLeft(t *testing.T) {
 
 	assert.True(chunk.IsFull())
 
-	left, midKey, right := chunk.InsertAndSplit([]byte{30, 10, 10, 10}, []byte("New value that goes in the left chunk"))
+	left, midKey, right, err := chunk.InsertAndSplit([]byte{30, 10, 10, 10}, []byte("New value that goes in the left chunk"))
+	assert.NoError(err)
 
 	// check that the right chunk contains the correct values
 	val := right.Get([]byte{60, 10, 10, 10})
@@ -284,7 +286,8 @@ func TestSplitSmallHeapInsertRight(t *testing.T) {
 	chunk.Insert([]byte{50, 10, 10, 10}, []byte("cento diviso due"))
 	chunk.Insert([]byte{20, 10, 10, 10}, []byte("Some Text"))
 	assert.True(chunk.IsFull())
-	left, _, right := chunk.InsertAndSplit([]byte{75, 10, 10, 10}, []byte("New value that goes in the right chunk"))
+	left, _, right, err := chunk.InsertAndSplit([]byte{75, 10, 10, 10}, []byte("New value that goes in the right chunk"))
+	assert.NoError(err)
 
 	assert.NotNil(right)
 
@@ -383,3 +386,270 @@ func TestSplitSmallHeapInsertRight(t *testing.T) {
 // right.computeHashes()
 // assert.True(bytes.Equal(right.hashes[right.root], oldRootHash))
 // }
+
+func TestGetKeyAtAndHeap(t *testing.T) {
+	assert := assert.New(t)
+	chunk := NewHeapChunk(1024, 256, 1, 8)
+	assert.Nil(chunk.GetHeap())
+
+	chunk.Insert([]byte{30}, []byte{30})
+	chunk.Insert([]byte{10}, []byte{10})
+	chunk.Insert([]byte{20}, []byte{20})
+
+	assert.Equal([]byte{10}, chunk.GetKeyAt(0))
+	assert.Equal([]byte{20}, chunk.GetKeyAt(1))
+	assert.Equal([]byte{30}, chunk.GetKeyAt(2))
+
+	// 3 inner hashes and 4 direct hashes, the last one is empty
+	heap := chunk.GetHeap()
+	assert.Equal(7, len(heap))
+	assert.True(bytes.Equal(chunk.GetHash(), heap[0]))
+	assert.Nil(heap[6])
+	for i := 0; i < 3; i++ {
+		h := sha256.New()
+		h.Write(heap[2*i+1])
+		h.Write(heap[2*i+2])
+		assert.True(bytes.Equal(h.Sum(nil), heap[i]))
+	}
+
+	chunk.Insert([]byte{40}, []byte{40})
+	assert.Equal(7, len(chunk.GetHeap()))
+	assert.NotNil(chunk.GetHeap()[6])
+}
+
+func TestUpdateAndVerify(t *testing.T) {
+	assert := assert.New(t)
+	chunk := NewHeapChunk(1024, 256, 1, 8)
+	for _, k := range []byte{50, 10, 40, 20, 30} {
+		chunk.Insert([]byte{k}, []byte{k, k, k})
+	}
+	assert.Nil(chunk.Verify())
+
+	// shorter values are written in place, longer ones are appended
+	updated, err := chunk.Update([]byte{20}, []byte{1})
+	assert.True(updated)
+	assert.NoError(err)
+	updated, err = chunk.Update([]byte{40}, []byte("a longer value"))
+	assert.True(updated)
+	assert.NoError(err)
+	updated, err = chunk.Update([]byte{25}, []byte{1})
+	assert.False(updated)
+	assert.NoError(err)
+	assert.Nil(chunk.Verify())
+
+	assert.Equal([]byte{1}, chunk.Get([]byte{20}))
+	assert.Equal([]byte("a longer value"), chunk.Get([]byte{40}))
+	assert.Equal([]byte{30, 30, 30}, chunk.Get([]byte{30}))
+	assert.Equal(int32(5), chunk.GetCurrSize())
+
+	proof, err := chunk.GetProof([]byte{40})
+	assert.Nil(err)
+	assert.True(bytes.Equal(chunk.GetHash(), proof.ValidateProof([]byte{40}, []byte("a longer value"))))
+
+	// an empty value does not overlap the value stored after it
+	assert.NoError(chunk.Insert([]byte{60}, []byte{}))
+	assert.NoError(chunk.Insert([]byte{70}, []byte{70}))
+	assert.Nil(chunk.Verify())
+
+	chunk.CorruptData(0)
+	assert.NotNil(chunk.Verify())
+}
+
+func TestGetStats(t *testing.T) {
+	assert := assert.New(t)
+	chunk := NewHeapChunk(1024, 256, 1, 8)
+	for _, k := range []byte{50, 10, 40, 20, 30} {
+		chunk.Insert([]byte{k}, []byte{k, k, k})
+	}
+	chunk.Update([]byte{40}, []byte("a longer value"))
+
+	stats := chunk.GetStats()
+	assert.Equal(int32(5), stats.Keys)
+	assert.Equal(5*int(chunk.keyAndMetadataSize), stats.KeyBytes)
+	assert.Equal(4*3+14, stats.ValueBytes)
+	assert.Equal(3, stats.WastedValueBytes)
+	assert.Equal(uint32(14), stats.LargestValue)
+	assert.Equal(10*sha256.Size, stats.HashBytes) // 5 inner and 5 direct hashes
+
+	proofLengthSum := 0
+	for _, k := range []byte{10, 20, 30, 40, 50} {
+		proof, err := chunk.GetProof([]byte{k})
+		assert.Nil(err)
+		proofLengthSum += proof.GetLength()
+	}
+	assert.Equal(proofLengthSum, stats.ProofLengthSum)
+}
+
+func TestInvalidInsertions(t *testing.T) {
+	assert := assert.New(t)
+	chunk := NewHeapChunk(256, 16, 1, 4)
+
+	assert.True(errors.Is(chunk.Insert([]byte{1, 2}, []byte{1}), ErrInvalidKeySize))
+	assert.True(errors.Is(chunk.Insert([]byte{1}, make([]byte, 300)), ErrValueTooLarge))
+	assert.Equal(int32(0), chunk.GetCurrSize())
+
+	for _, k := range []byte{10, 20, 30} {
+		assert.NoError(chunk.Insert([]byte{k}, []byte{k}))
+	}
+	assert.Equal(ErrKeyExists, chunk.Insert([]byte{10}, []byte{1}))
+	assert.NoError(chunk.Insert([]byte{40}, []byte{40}))
+	assert.Equal(ErrChunkFull, chunk.Insert([]byte{50}, []byte{50}))
+
+	_, _, _, err := chunk.InsertAndSplit([]byte{20}, []byte{1})
+	assert.Equal(ErrKeyExists, err)
+	_, _, _, err = chunk.InsertAndSplit([]byte{1, 2}, []byte{1})
+	assert.True(errors.Is(err, ErrInvalidKeySize))
+
+	updated, err := chunk.Update([]byte{10}, make([]byte, 300))
+	assert.False(updated)
+	assert.True(errors.Is(err, ErrValueTooLarge))
+	assert.Nil(chunk.Verify())
+	assert.Equal([]byte{10}, chunk.Get([]byte{10}))
+
+	left, _, right, err := chunk.InsertAndSplit([]byte{25}, []byte{25})
+	assert.NoError(err)
+	_, _, _, err = left.InsertAndSplit([]byte{15}, []byte{15})
+	assert.Equal(ErrChunkNotFull, err)
+	assert.Equal(int32(5), left.GetCurrSize()+right.GetCurrSize())
+}
+
+func TestCapacityExceeded(t *testing.T) {
+	assert := assert.New(t)
+	// values can be addressed up to 255 bytes
+	chunk := NewHeapChunk(256, 256, 1, 4)
+	assert.NoError(chunk.Insert([]byte{10}, make([]byte, 200)))
+	assert.True(errors.Is(chunk.Insert([]byte{20}, make([]byte, 100)), ErrCapacityExceeded))
+
+	// updates leave holes in the values: they are compacted when the capacity is reached
+	assert.NoError(chunk.Insert([]byte{20}, make([]byte, 50)))
+	updated, err := chunk.Update([]byte{10}, make([]byte, 201))
+	assert.False(updated)
+	assert.Equal(ErrCapacityExceeded, err)
+	updated, err = chunk.Update([]byte{10}, make([]byte, 1))
+	assert.True(updated)
+	assert.NoError(err)
+	updated, err = chunk.Update([]byte{10}, make([]byte, 150))
+	assert.True(updated)
+	assert.NoError(err)
+	assert.Equal(make([]byte, 150), chunk.Get([]byte{10}))
+	assert.Nil(chunk.Verify())
+}
+
+func TestTargetBytes(t *testing.T) {
+	assert := assert.New(t)
+	maxSize := MaxKeysForTargetBytes(1024, 256, 1, 100)
+	assert.Equal(int32(100/(1+2+1)+1), maxSize)
+	// rounded up to an even number of keys
+	assert.Equal(int32(74), MaxKeysForTargetBytes(1024, 256, 4, 510))
+	chunk := NewHeapChunk(1024, 256, 1, maxSize)
+	chunk.SetTargetBytes(100)
+	assert.Equal(int32(100), chunk.GetTargetBytes())
+
+	// an empty chunk always has room, even for a value larger than the target
+	assert.True(chunk.HasRoomFor(make([]byte, 200)))
+	assert.NoError(chunk.Insert([]byte{50}, make([]byte, 40)))
+	assert.NoError(chunk.Insert([]byte{60}, make([]byte, 20)))
+	assert.False(chunk.HasRoomFor(make([]byte, 30)))
+	assert.True(chunk.HasRoomFor(make([]byte, 10)))
+	assert.Equal(ErrChunkFull, chunk.Insert([]byte{70}, make([]byte, 30)))
+	_, _, _, err := chunk.InsertAndSplit([]byte{70}, make([]byte, 10))
+	assert.Equal(ErrChunkNotFull, err)
+
+	left, middleKey, right, err := chunk.InsertAndSplitWithPolicy([]byte{70}, make([]byte, 30), SplitBySize)
+	assert.NoError(err)
+	assert.Equal([]byte{60}, middleKey)
+	assert.Equal(int32(1), left.GetCurrSize())
+	assert.Equal(int32(2), right.GetCurrSize())
+	assert.Equal(int32(100), right.GetTargetBytes())
+	assert.True(left.SerializedSize() <= 100 && right.SerializedSize() <= 100)
+
+	// a chunk with a single large value is split by moving the value to the right chunk
+	left, middleKey, right, err = left.InsertAndSplitWithPolicy([]byte{10}, make([]byte, 90), SplitBySize)
+	assert.NoError(err)
+	assert.Equal([]byte{50}, middleKey)
+	assert.Equal(make([]byte, 90), left.Get([]byte{10}))
+	assert.Equal(make([]byte, 40), right.Get([]byte{50}))
+	assert.Equal(int32(1), left.GetCurrSize())
+	assert.Equal(int32(1), right.GetCurrSize())
+	assert.Nil(left.Verify())
+	assert.Nil(right.Verify())
+}
+
+func TestUpdateTargetBytes(t *testing.T) {
+	assert := assert.New(t)
+	chunk := NewHeapChunk(1024, 256, 1, MaxKeysForTargetBytes(1024, 256, 1, 100))
+	chunk.SetTargetBytes(100)
+	for _, k := range []byte{10, 20, 30} {
+		assert.NoError(chunk.Insert([]byte{k}, make([]byte, 10)))
+	}
+
+	// growing values leave holes that are compacted before the target is exceeded
+	for i := 0; i < 20; i++ {
+		updated, err := chunk.Update([]byte{20}, make([]byte, 11+i%10))
+		assert.True(updated)
+		assert.NoError(err)
+		assert.LessOrEqual(chunk.SerializedSize(), 100)
+	}
+	assert.Nil(chunk.Verify())
+
+	// a value that does not fit in the target once compacted is not updated
+	assert.False(chunk.HasRoomForUpdate([]byte{20}, make([]byte, 60)))
+	updated, err := chunk.Update([]byte{20}, make([]byte, 60))
+	assert.False(updated)
+	assert.Equal(ErrChunkFull, err)
+	assert.Equal(make([]byte, 20), chunk.Get([]byte{20}))
+	assert.True(chunk.HasRoomForUpdate([]byte{25}, make([]byte, 60)))
+
+	left, middleKey, right, err := chunk.UpdateAndSplitWithPolicy([]byte{20}, make([]byte, 60), SplitBySize)
+	assert.NoError(err)
+	assert.Equal([]byte{20}, middleKey)
+	assert.Equal(make([]byte, 60), right.Get([]byte{20}))
+	assert.Equal(int32(3), left.GetCurrSize()+right.GetCurrSize())
+	assert.True(left.SerializedSize() <= 100 && right.SerializedSize() <= 100)
+	assert.Nil(left.Verify())
+	assert.Nil(right.Verify())
+
+	// a chunk with a single K-V pair can exceed the target
+	updated, err = left.Update([]byte{10}, make([]byte, 200))
+	assert.True(updated)
+	assert.NoError(err)
+	_, _, _, err = left.UpdateAndSplitWithPolicy([]byte{10}, make([]byte, 10), SplitBySize)
+	assert.Equal(ErrChunkNotFull, err)
+	_, _, _, err = right.UpdateAndSplitWithPolicy([]byte{25}, make([]byte, 10), SplitBySize)
+	assert.Equal(ErrKeyNotFound, err)
+}
+
+func TestRemove(t *testing.T) {
+	assert := assert.New(t)
+	chunk := NewHeapChunk(1024, 256, 1, 8)
+	for _, k := range []byte{50, 10, 40, 20, 30} {
+		chunk.Insert([]byte{k}, []byte{k, k, k})
+	}
+	smallestKey := chunk.GetSmallestKeyUnsafe()
+
+	assert.False(chunk.Remove([]byte{25}))
+	assert.True(chunk.Remove([]byte{30}))
+	assert.Nil(chunk.Get([]byte{30}))
+	assert.Equal(int32(4), chunk.GetCurrSize())
+	assert.Nil(chunk.Verify())
+
+	// the hashes match the ones of a chunk built without the removed key
+	other := NewHeapChunk(1024, 256, 1, 8)
+	for _, k := range []byte{10, 20, 40, 50} {
+		other.Insert([]byte{k}, []byte{k, k, k})
+	}
+	assert.Equal(other.GetHash(), chunk.GetHash())
+
+	assert.True(chunk.Remove([]byte{10}))
+	assert.Equal([]byte{20}, smallestKey)
+	assert.True(chunk.Remove([]byte{50}))
+	assert.Nil(chunk.Verify())
+	assert.Equal([]byte{40, 40, 40}, chunk.Get([]byte{40}))
+
+	assert.True(chunk.Remove([]byte{20}))
+	assert.True(chunk.Remove([]byte{40}))
+	assert.Equal(int32(0), chunk.GetCurrSize())
+	assert.NoError(chunk.Insert([]byte{60}, []byte{60}))
+	assert.Nil(chunk.Verify())
+	assert.Equal([]byte{60}, chunk.Get([]byte{60}))
+}
@@ -0,0 +1,104 @@
+package chunk
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Verify checks the internal consistency of the chunk: keys must be sorted and unique,
+// the metadata of every key must point to a distinct region within the values,
+// and every hash in the heap must match the hash recomputed from the K-V pairs.
+// It returns an error describing the first violation found.
+func (chunk *HeapChunk) Verify() error {
+	if chunk.currKeysNumber < 0 || chunk.currKeysNumber > chunk.maxSize {
+		return errors.Errorf("invalid number of keys %d (max %d)", chunk.currKeysNumber, chunk.maxSize)
+	}
+	if chunk.nextFreeByte != uint32(len(chunk.values)) {
+		return errors.Errorf("next free byte %d does not match the values size %d", chunk.nextFreeByte, len(chunk.values))
+	}
+
+	for i := int32(1); i < chunk.currKeysNumber; i++ {
+		if bytes.Compare(chunk.getKey(i-1), chunk.getKey(i)) != -1 {
+			return errors.Errorf("keys %d and %d are not sorted or not unique", i-1, i)
+		}
+	}
+
+	// values must be within bounds and must not overlap
+	type region struct{ start, end uint64 }
+	regions := make([]region, 0, chunk.currKeysNumber)
+	for i := int32(0); i < chunk.currKeysNumber; i++ {
+		start := uint64(chunk.getValueStartIndex(i))
+		end := start + uint64(chunk.getValueLength(i))
+		if end > uint64(len(chunk.values)) {
+			return errors.Errorf("value of key %d is out of bounds", i)
+		}
+		if start == end {
+			// an empty value occupies no bytes, it can start where another value starts
+			continue
+		}
+		regions = append(regions, region{start, end})
+	}
+	sort.Slice(regions, func(i, j int) bool { return regions[i].start < regions[j].start })
+	for i := 1; i < len(regions); i++ {
+		if regions[i].start < regions[i-1].end {
+			return errors.New("values of two keys overlap")
+		}
+	}
+
+	if chunk.currKeysNumber == 0 {
+		return nil
+	}
+	offset := chunk.getOffset()
+	expectedRoot := offset - chunk.currKeysNumber
+	if chunk.currKeysNumber%2 == 0 {
+		expectedRoot = offset - (chunk.currKeysNumber - 1)
+	}
+	if chunk.root != expectedRoot {
+		return errors.Errorf("heap root at %d, expected at %d", chunk.root, expectedRoot)
+	}
+
+	h := sha256.New()
+	for i := int32(0); i < chunk.currKeysNumber; i++ {
+		h.Reset()
+		h.Write(chunk.getKey(i))
+		start := chunk.getValueStartIndex(i)
+		h.Write(chunk.values[start : start+chunk.getValueLength(i)])
+		if !bytes.Equal(h.Sum(nil), chunk.hashes[i+offset]) {
+			return errors.Errorf("hash of key %d does not match its K-V pair", i)
+		}
+	}
+	if _, err := chunk.verifyHashesHelper(chunk.root); err != nil {
+		return err
+	}
+	return nil
+}
+
+// verifyHashesHelper works like computeHashesHelper but compares the recomputed hashes
+// with the stored ones instead of updating them.
+func (chunk *HeapChunk) verifyHashesHelper(i int32) ([]byte, error) {
+	if chunk.isLeaf(i) {
+		if i-chunk.getOffset() >= chunk.currKeysNumber {
+			return nil, nil // empty position in the heap
+		}
+		return chunk.hashes[i], nil
+	}
+	left, err := chunk.verifyHashesHelper(leftChildOffset(i, chunk.root))
+	if err != nil {
+		return nil, err
+	}
+	right, err := chunk.verifyHashesHelper(rightChildOffset(i, chunk.root))
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	h.Write(left)
+	h.Write(right)
+	hash := h.Sum(nil)
+	if !bytes.Equal(hash, chunk.hashes[i]) {
+		return nil, errors.Errorf("hash at position %d in the heap does not match its children", i)
+	}
+	return hash, nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bplus/bplusavl"
+	hchunk "bplus/chunk"
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+func runBuild(args []string) error {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	in := fs.String("in", "", "input file (default: stdin)")
+	format := fs.String("format", "csv", "input format: csv or jsonl")
+	out := fs.String("out", "", "output snapshot file (required)")
+	keySize := fs.Int("keysize", 8, "size of the keys in bytes")
+	chunkSize := fs.Int("chunksize", 64, "maximal number of keys in a chunk")
+	isHex := fs.Bool("hex", false, "keys and values are hexadecimal strings")
+	split := fs.String("split", "", "split policy: midpoint, append or size (default: midpoint, or size with -chunkbytes)")
+	chunkBytes := fs.Int("chunkbytes", 0, "split chunks by serialized size in bytes instead of -chunksize")
+	redistribute := fs.Bool("redistribute", false, "move keys to neighbouring chunks before splitting")
+	canonical := fs.Bool("canonical", false, "give the tree a shape that only depends on its keys and values")
+	fs.Parse(args)
+
+	if *out == "" {
+		return errors.New("missing -out")
+	}
+	if *keySize <= 0 || *chunkSize <= 1 {
+		return errors.New("-keysize must be positive and -chunksize greater than 1")
+	}
+
+	var r io.Reader = os.Stdin
+	if *in != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	options := []bplusavl.TreeOption{bplusavl.WithChunkBytes(int32(*chunkBytes))}
+	if *split != "" {
+		policy, err := parseSplitPolicy(*split)
+		if err != nil {
+			return err
+		}
+		options = append(options, bplusavl.WithSplitPolicy(policy))
+	}
+	if *redistribute {
+		options = append(options, bplusavl.WithRedistribution())
+	}
+	if *canonical {
+		options = append(options, bplusavl.WithCanonicalShape())
+	}
+	pairs, err := readPairs(r, *format, *isHex, int32(*keySize))
+	if err != nil {
+		return err
+	}
+	tree := bplusavl.NewIAVL(int32(*chunkSize), int32(*keySize), options...)
+	for _, p := range pairs {
+		if _, err = tree.Set(p.key, p.value); err != nil {
+			return err
+		}
+	}
+
+	var buffer bytes.Buffer
+	if err = tree.ExportSnapshot(&buffer); err != nil {
+		return err
+	}
+	if err = os.WriteFile(*out, buffer.Bytes(), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %d keys in %d chunks to %s\n", len(pairs), tree.GetNumberOfChunks(), *out)
+	fmt.Printf("root hash: %x\n", tree.GetRootHash())
+	return nil
+}
+
+func parseSplitPolicy(name string) (hchunk.SplitPolicy, error) {
+	for _, policy := range []hchunk.SplitPolicy{hchunk.SplitMidpoint, hchunk.SplitAppend, hchunk.SplitBySize} {
+		if policy.String() == name {
+			return policy, nil
+		}
+	}
+	return 0, errors.Errorf("unknown split policy %q", name)
+}
+
+func runGet(args []string) error {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	snapshot := fs.String("snapshot", "", "snapshot file (required)")
+	keyString := fs.String("key", "", "key to look up (required)")
+	isHex := fs.Bool("hex", false, "the key is given and the value is printed in hexadecimal")
+	fs.Parse(args)
+
+	tree, err := loadSnapshot(*snapshot)
+	if err != nil {
+		return err
+	}
+	key, err := decodeKey(*keyString, *isHex, tree.GetKeySize())
+	if err != nil {
+		return err
+	}
+	value := tree.Get(key)
+	if value == nil {
+		return errors.Errorf("key %q not found", *keyString)
+	}
+	if *isHex {
+		fmt.Println(hex.EncodeToString(value))
+	} else {
+		fmt.Println(string(value))
+	}
+	return nil
+}
+
+func runProve(args []string) error {
+	fs := flag.NewFlagSet("prove", flag.ExitOnError)
+	snapshot := fs.String("snapshot", "", "snapshot file (required)")
+	keyString := fs.String("key", "", "key to prove (required)")
+	out := fs.String("out", "", "output proof file (default: hexadecimal on stdout)")
+	isHex := fs.Bool("hex", false, "the key is a hexadecimal string")
+	fs.Parse(args)
+
+	tree, err := loadSnapshot(*snapshot)
+	if err != nil {
+		return err
+	}
+	key, err := decodeKey(*keyString, *isHex, tree.GetKeySize())
+	if err != nil {
+		return err
+	}
+	proof, err := tree.GetElementProof(key)
+	if err != nil {
+		return errors.Wrapf(err, "key %q", *keyString)
+	}
+
+	var buffer bytes.Buffer
+	if err = proof.SerializeProof(&buffer); err != nil {
+		return err
+	}
+	if *out == "" {
+		fmt.Println(hex.EncodeToString(buffer.Bytes()))
+		return nil
+	}
+	return os.WriteFile(*out, buffer.Bytes(), 0644)
+}
+
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	proofPath := fs.String("proof", "", "proof file written by prove -out (required)")
+	root := fs.String("root", "", "expected root hash in hexadecimal (required)")
+	keyString := fs.String("key", "", "proven key (required)")
+	valueString := fs.String("value", "", "proven value")
+	isHex := fs.Bool("hex", false, "key and value are hexadecimal strings")
+	fs.Parse(args)
+
+	if *proofPath == "" {
+		return errors.New("missing -proof")
+	}
+	rootHash, err := hex.DecodeString(*root)
+	if err != nil || len(rootHash) == 0 {
+		return errors.New("missing or invalid -root")
+	}
+	key, err := decode(*keyString, *isHex)
+	if err != nil {
+		return errors.Wrap(err, "invalid key")
+	}
+	value, err := decode(*valueString, *isHex)
+	if err != nil {
+		return errors.Wrap(err, "invalid value")
+	}
+
+	buffer, err := os.ReadFile(*proofPath)
+	if err != nil {
+		return err
+	}
+	proof, err := bplusavl.DeserializeElementProof(buffer)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(proof.ValidateProof(key, value), rootHash) {
+		return errors.New("invalid proof")
+	}
+	fmt.Println("valid proof")
+	return nil
+}
+
+func runChunks(args []string) error {
+	fs := flag.NewFlagSet("chunks", flag.ExitOnError)
+	snapshot := fs.String("snapshot", "", "snapshot file (required)")
+	fs.Parse(args)
+
+	tree, err := loadSnapshot(*snapshot)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-8s %-8s %-6s %-9s %-24s %s\n", "position", "leafID", "size", "keyHeight", "smallest key", "hash")
+	i := 0
+	for leaf := tree.GetLeaf(0); leaf != nil; leaf = leaf.Next() {
+		fmt.Printf("%-8d %-8d %-6d %-9d %-24x %x\n", i, leaf.ID(), leaf.Len(),
+			leaf.KeyHeight(), leaf.SmallestKey(), leaf.Hash())
+		i++
+	}
+	return nil
+}
+
+func runStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	snapshot := fs.String("snapshot", "", "snapshot file (required)")
+	fs.Parse(args)
+
+	tree, err := loadSnapshot(*snapshot)
+	if err != nil {
+		return err
+	}
+	stats := tree.Stats()
+	fmt.Printf("keys:         %d\n", stats.Keys)
+	fmt.Printf("chunks:       %d\n", stats.Chunks)
+	fmt.Printf("inner nodes:  %d\n", stats.InnerNodes)
+	fmt.Printf("height:       %d\n", stats.Height)
+	fmt.Printf("fill factor:  ")
+	for i, count := range stats.FillHistogram {
+		fmt.Printf("%d-%d%%: %d  ", i*100/bplusavl.FillHistogramBuckets, (i+1)*100/bplusavl.FillHistogramBuckets, count)
+	}
+	fmt.Println()
+	fmt.Printf("key bytes:    %d\n", stats.KeyBytes)
+	fmt.Printf("value bytes:  %d (%d wasted)\n", stats.ValueBytes, stats.WastedValueBytes)
+	fmt.Printf("hash bytes:   %d\n", stats.HashBytes)
+	fmt.Printf("avg. proof:   %.2f hashes\n", stats.AverageProofLength)
+	fmt.Printf("largest val.: %d bytes\n", stats.LargestValue)
+	fmt.Printf("key size:     %d\n", tree.GetKeySize())
+	fmt.Printf("root hash:    %x\n", tree.GetRootHash())
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bplus/bplusavl"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// run runs a command and returns what it printed on the standard output.
+func run(t *testing.T, fn func(args []string) error, args ...string) (string, error) {
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	err = fn(args)
+	w.Close()
+	os.Stdout = stdout
+	out, _ := io.ReadAll(r)
+	return string(out), err
+}
+
+func TestBuildGetProveVerify(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	in, snapshot, proof := filepath.Join(dir, "data.csv"), filepath.Join(dir, "tree.snap"), filepath.Join(dir, "key.proof")
+	var csv strings.Builder
+	for k := 0; k < 200; k++ {
+		fmt.Fprintf(&csv, "key%05d,value %d\n", k, k)
+	}
+	assert.NoError(os.WriteFile(in, []byte(csv.String()), 0644))
+
+	out, err := run(t, runBuild, "-in", in, "-keysize", "8", "-chunksize", "8", "-out", snapshot)
+	assert.NoError(err)
+	assert.Contains(out, "wrote 200 keys")
+	tree, err := loadSnapshot(snapshot)
+	assert.NoError(err)
+	root := fmt.Sprintf("%x", tree.GetRootHash())
+	assert.Contains(out, "root hash: "+root)
+
+	out, err = run(t, runGet, "-snapshot", snapshot, "-key", "key00042")
+	assert.NoError(err)
+	assert.Equal("value 42\n", out)
+	_, err = run(t, runGet, "-snapshot", snapshot, "-key", "key99999")
+	assert.ErrorContains(err, "not found")
+
+	_, err = run(t, runProve, "-snapshot", snapshot, "-key", "key00042", "-out", proof)
+	assert.NoError(err)
+	out, err = run(t, runVerify, "-proof", proof, "-root", root, "-key", "key00042", "-value", "value 42")
+	assert.NoError(err)
+	assert.Equal("valid proof\n", out)
+	_, err = run(t, runVerify, "-proof", proof, "-root", root, "-key", "key00042", "-value", "value 43")
+	assert.ErrorContains(err, "invalid proof")
+	_, err = run(t, runVerify, "-proof", proof, "-root", root, "-key", "key00043", "-value", "value 42")
+	assert.ErrorContains(err, "invalid proof")
+
+	out, err = run(t, runChunks, "-snapshot", snapshot)
+	assert.NoError(err)
+	assert.Equal(tree.GetNumberOfChunks()+1, strings.Count(out, "\n"))
+	out, err = run(t, runStats, "-snapshot", snapshot)
+	assert.NoError(err)
+	assert.Contains(out, "keys:         200\n")
+}
+
+func TestBuildJSONLHex(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	in, snapshot := filepath.Join(dir, "data.jsonl"), filepath.Join(dir, "tree.snap")
+	var jsonl strings.Builder
+	for k := 0; k < 100; k++ {
+		fmt.Fprintf(&jsonl, "{\"key\": \"%04x\", \"value\": \"%02x\"}\n", k, k)
+	}
+	assert.NoError(os.WriteFile(in, []byte(jsonl.String()), 0644))
+
+	_, err := run(t, runBuild, "-in", in, "-format", "jsonl", "-hex", "-keysize", "2", "-chunksize", "4",
+		"-chunkbytes", "64", "-out", snapshot)
+	assert.NoError(err)
+	out, err := run(t, runGet, "-snapshot", snapshot, "-hex", "-key", "0063")
+	assert.NoError(err)
+	assert.Equal("63\n", out)
+	out, err = run(t, runProve, "-snapshot", snapshot, "-hex", "-key", "0063")
+	assert.NoError(err)
+	assert.NotEmpty(strings.TrimSpace(out))
+
+	// invalid parameters are rejected before the input is read
+	_, err = run(t, runBuild, "-in", in, "-keysize", "0", "-out", snapshot)
+	assert.Error(err)
+	_, err = run(t, runBuild, "-in", in, "-split", "random", "-out", snapshot)
+	assert.ErrorContains(err, "unknown split policy")
+}
+
+func TestBuildCanonical(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	var roots []string
+	for i, order := range [][]int{rand.Perm(300), rand.Perm(300)} {
+		in, snapshot := filepath.Join(dir, fmt.Sprintf("data%d.csv", i)), filepath.Join(dir, fmt.Sprintf("tree%d.snap", i))
+		var csv strings.Builder
+		for _, k := range order {
+			fmt.Fprintf(&csv, "key%05d,value %d\n", k, k)
+		}
+		assert.NoError(os.WriteFile(in, []byte(csv.String()), 0644))
+		_, err := run(t, runBuild, "-in", in, "-keysize", "8", "-chunksize", "8", "-canonical", "-out", snapshot)
+		assert.NoError(err)
+
+		// the loaded tree stays canonical: writing it gives the same tree as writing a canonical tree
+		tree, err := loadSnapshot(snapshot)
+		assert.NoError(err)
+		roots = append(roots, fmt.Sprintf("%x", tree.GetRootHash()))
+		expected := bplusavl.NewIAVL(8, 8, bplusavl.WithCanonicalShape())
+		for k := 0; k < 400; k += 2 {
+			key := []byte(fmt.Sprintf("key%05d", k))
+			_, err = tree.Set(key, []byte("changed"))
+			assert.NoError(err)
+		}
+		for k := 0; k < 400; k++ {
+			key := []byte(fmt.Sprintf("key%05d", k))
+			if k%2 == 0 {
+				expected.Set(key, []byte("changed"))
+			} else if k < 300 {
+				expected.Set(key, []byte(fmt.Sprintf("value %d", k)))
+			}
+		}
+		assert.Equal(expected.GetRootHash(), tree.GetRootHash())
+		assert.NoError(tree.Verify())
+	}
+	// the shape does not depend on the order of the input
+	assert.Equal(roots[0], roots[1])
+}
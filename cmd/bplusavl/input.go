@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bplus/bplusavl"
+	"bufio"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// pair is a single key/value entry read from an input file.
+type pair struct {
+	key   []byte
+	value []byte
+}
+
+// jsonPair is the format of a single line of a JSONL input file.
+type jsonPair struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// decode returns the bytes represented by s, decoding it from hexadecimal if isHex is set.
+func decode(s string, isHex bool) ([]byte, error) {
+	if isHex {
+		return hex.DecodeString(s)
+	}
+	return []byte(s), nil
+}
+
+// decodeKey works like decode but also checks that the key has the expected size.
+func decodeKey(s string, isHex bool, keySize int32) ([]byte, error) {
+	key, err := decode(s, isHex)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid key %q", s)
+	}
+	if int32(len(key)) != keySize {
+		return nil, errors.Errorf("key %q is %d bytes long, expected %d", s, len(key), keySize)
+	}
+	return key, nil
+}
+
+// readPairs reads all key/value pairs from r, which is either in "csv" (key,value per record)
+// or in "jsonl" ({"key": ..., "value": ...} per line) format.
+func readPairs(r io.Reader, format string, isHex bool, keySize int32) ([]pair, error) {
+	var pairs []pair
+	add := func(line int, k, v string) error {
+		key, err := decodeKey(k, isHex, keySize)
+		if err != nil {
+			return errors.Wrapf(err, "line %d", line)
+		}
+		value, err := decode(v, isHex)
+		if err != nil {
+			return errors.Wrapf(err, "line %d: invalid value", line)
+		}
+		pairs = append(pairs, pair{key, value})
+		return nil
+	}
+
+	switch format {
+	case "csv":
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = 2
+		for line := 1; ; line++ {
+			record, err := reader.Read()
+			if err == io.EOF {
+				return pairs, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			if err = add(line, record[0], record[1]); err != nil {
+				return nil, err
+			}
+		}
+	case "jsonl":
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			var p jsonPair
+			if err := json.Unmarshal(scanner.Bytes(), &p); err != nil {
+				return nil, errors.Wrapf(err, "line %d", line)
+			}
+			if err := add(line, p.Key, p.Value); err != nil {
+				return nil, err
+			}
+		}
+		return pairs, scanner.Err()
+	}
+	return nil, errors.Errorf("unknown format %q", format)
+}
+
+// loadSnapshot reads and imports the snapshot stored at path. The tree keeps the modes it was built with.
+func loadSnapshot(path string) (*bplusavl.IAVL, error) {
+	if path == "" {
+		return nil, errors.New("missing -snapshot")
+	}
+	buffer, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := bplusavl.ImportSnapshot(buffer)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while loading %s", path)
+	}
+	return tree, nil
+}
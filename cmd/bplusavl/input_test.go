@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadPairs(t *testing.T) {
+	assert := assert.New(t)
+	expected := []pair{
+		{[]byte("key00001"), []byte("first value")},
+		{[]byte("key00002"), []byte("second, with a comma")},
+		{[]byte("key00003"), []byte("")},
+	}
+
+	csv := "key00001,first value\nkey00002,\"second, with a comma\"\nkey00003,\n"
+	pairs, err := readPairs(strings.NewReader(csv), "csv", false, 8)
+	assert.NoError(err)
+	assert.Equal(expected, pairs)
+
+	jsonl := `{"key": "key00001", "value": "first value"}
+{"key": "key00002", "value": "second, with a comma"}
+
+{"key": "key00003", "value": ""}
+`
+	pairs, err = readPairs(strings.NewReader(jsonl), "jsonl", false, 8)
+	assert.NoError(err)
+	assert.Equal(expected, pairs)
+
+	// hexadecimal keys and values
+	pairs, err = readPairs(strings.NewReader("00ff,cafe\n"), "csv", true, 2)
+	assert.NoError(err)
+	assert.Equal([]pair{{[]byte{0x00, 0xff}, []byte{0xca, 0xfe}}}, pairs)
+	pairs, err = readPairs(strings.NewReader(`{"key": "00ff", "value": "cafe"}`), "jsonl", true, 2)
+	assert.NoError(err)
+	assert.Equal([]pair{{[]byte{0x00, 0xff}, []byte{0xca, 0xfe}}}, pairs)
+
+	// errors name the faulty line
+	_, err = readPairs(strings.NewReader("key00001,value\nshort,value\n"), "csv", false, 8)
+	assert.ErrorContains(err, "line 2")
+	_, err = readPairs(strings.NewReader("key00001,value,extra\n"), "csv", false, 8)
+	assert.Error(err)
+	_, err = readPairs(strings.NewReader("{\"key\": \"key00001\", \"value\": \"v\"}\n{\"key\":"), "jsonl", false, 8)
+	assert.ErrorContains(err, "line 2")
+	_, err = readPairs(strings.NewReader("00zz,cafe\n"), "csv", true, 2)
+	assert.ErrorContains(err, "invalid key")
+	_, err = readPairs(strings.NewReader("00ff,zz\n"), "csv", true, 2)
+	assert.ErrorContains(err, "invalid value")
+	_, err = readPairs(strings.NewReader(""), "xml", false, 8)
+	assert.ErrorContains(err, "unknown format")
+}
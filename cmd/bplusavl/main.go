@@ -0,0 +1,62 @@
+// Command bplusavl builds, inspects and queries B+AVL trees stored as snapshots
+// (see bplusavl.IAVL.ExportSnapshot).
+//
+// Usage:
+//
+//	bplusavl build  -in data.csv -format csv -keysize 8 -chunksize 64 [-split append] [-chunkbytes 65536] [-redistribute] [-canonical] -out tree.snap
+//	bplusavl get    -snapshot tree.snap -key mykey001
+//	bplusavl prove  -snapshot tree.snap -key mykey001 -out key.proof
+//	bplusavl verify -proof key.proof -root <hex root hash> -key mykey001 -value myvalue
+//	bplusavl chunks -snapshot tree.snap
+//	bplusavl stats  -snapshot tree.snap
+//
+// Keys and values are read as raw strings, or as hexadecimal strings when -hex is given.
+// Keys must be exactly as long as the key size of the tree.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"build", "load key/value pairs from CSV or JSONL into a tree and export it", runBuild},
+	{"get", "print the value of a key", runGet},
+	{"prove", "emit a serialized proof for a key", runProve},
+	{"verify", "check a serialized proof against a root hash", runVerify},
+	{"chunks", "list the leaves of a tree", runChunks},
+	{"stats", "print statistics about a tree", runStats},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: bplusavl <command> [flags]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-7s %s\n", cmd.name, cmd.usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nrun 'bplusavl <command> -h' for the flags of a command.")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	for _, cmd := range commands {
+		if cmd.name == os.Args[1] {
+			if err := cmd.run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "bplusavl %s: %v\n", cmd.name, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	usage()
+	os.Exit(2)
+}